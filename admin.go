@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/sinks"
+)
+
+// maxSettingsBody is the largest request body accepted by the /settings
+// endpoint.
+const maxSettingsBody = 1 << 20
+
+// adminSettings is the part of the configuration that can be read and changed
+// through the /settings admin endpoint. Honeycomb is the settings of the
+// default Honeycomb sink; those of named sinks are only changed by reloading
+// the config file.
+type adminSettings struct {
+	Debug      bool                    `json:"debug"`
+	Stdout     bool                    `json:"stdout"`
+	Honeycomb  sinks.HoneycombSettings `json:"honeycomb"`
+	Processors ProcessorsConfig        `json:"processors"`
+}
+
+func settingsFromConfig(cfg *Config) adminSettings {
+	return adminSettings{
+		Debug:      cfg.Debug,
+		Stdout:     cfg.Sinks.Stdout.Enabled,
+		Honeycomb:  cfg.Sinks.Honeycomb.settings(),
+		Processors: cfg.Processors,
+	}
+}
+
+// applyTo returns a copy of cfg with these settings.
+func (s adminSettings) applyTo(cfg *Config) *Config {
+	c := *cfg
+	c.Debug = s.Debug
+	c.Sinks.Stdout.Enabled = s.Stdout
+	c.Sinks.Honeycomb.Dataset = s.Honeycomb.Dataset
+	c.Sinks.Honeycomb.SampleRate = s.Honeycomb.SampleRate
+	c.Sinks.Honeycomb.DropFields = s.Honeycomb.DropFields
+	c.Sinks.Honeycomb.ServiceDatasets = s.Honeycomb.ServiceDatasets
+	c.Sinks.Honeycomb.ServiceSampleRates = s.Honeycomb.ServiceSampleRates
+	c.Sinks.Honeycomb.Routes = s.Honeycomb.Routes
+	c.Processors = s.Processors
+	return &c
+}
+
+// removeEmptyOverrides removes per-service overrides that have been set to
+// an empty dataset or a zero sample rate, since a PATCH can't otherwise remove
+// a map entry.
+func (s *adminSettings) removeEmptyOverrides() {
+	for k, v := range s.Honeycomb.ServiceDatasets {
+		if v == "" {
+			delete(s.Honeycomb.ServiceDatasets, k)
+		}
+	}
+	for k, v := range s.Honeycomb.ServiceSampleRates {
+		if v == 0 {
+			delete(s.Honeycomb.ServiceSampleRates, k)
+		}
+	}
+}
+
+// settingsHandler serves the /settings admin endpoint. GET returns the
+// current adminSettings as JSON, and PATCH changes the settings present in a
+// JSON request body, leaving the others as they are. Changes to settings that
+// only take effect after a restart are rejected. Requests must carry the
+// header "Authorization: Bearer <Token>". Each change is recorded in Audit.
+type settingsHandler struct {
+	Proxy *proxy
+	Token string
+	Audit *logrus.Logger
+}
+
+func (sh *settingsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !sh.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		sh.Proxy.mu.Lock()
+		settings := settingsFromConfig(sh.Proxy.cfg)
+		sh.Proxy.mu.Unlock()
+		writeSettings(w, settings)
+	case "PATCH":
+		sh.update(w, r)
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (sh *settingsHandler) authorized(r *http.Request) bool {
+	if sh.Token == "" {
+		return false
+	}
+	expected := []byte("Bearer " + sh.Token)
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+}
+
+func (sh *settingsHandler) update(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSettingsBody))
+	if err != nil {
+		http.Error(w, "error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	sh.Proxy.mu.Lock()
+	defer sh.Proxy.mu.Unlock()
+
+	// Decode the request over a deep copy of the current settings, so that
+	// settings missing from the request keep their values, and the current
+	// settings aren't modified if the request is invalid.
+	before, _ := json.Marshal(settingsFromConfig(sh.Proxy.cfg))
+	var settings adminSettings
+	json.Unmarshal(before, &settings)
+	// Routes in the request replace the current ones as a whole, rather than
+	// being decoded over them.
+	var routes struct {
+		Honeycomb struct {
+			Routes json.RawMessage `json:"routes"`
+		} `json:"honeycomb"`
+	}
+	if json.Unmarshal(body, &routes) == nil && routes.Honeycomb.Routes != nil {
+		settings.Honeycomb.Routes = nil
+	}
+	if err := json.Unmarshal(body, &settings); err != nil {
+		http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	settings.removeEmptyOverrides()
+	cfg := settings.applyTo(sh.Proxy.cfg)
+	if err := cfg.Validate(); err != nil {
+		http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Reject changes that wouldn't take effect, such as RED metrics buckets,
+	// rather than report them as applied.
+	if changed := sh.Proxy.restartRequired(cfg); len(changed) > 0 {
+		http.Error(w, "settings can only be changed by restarting: "+strings.Join(changed, ", "), http.StatusBadRequest)
+		return
+	}
+	sh.Proxy.apply(cfg)
+
+	after, _ := json.Marshal(settings)
+	sh.Audit.WithFields(logrus.Fields{
+		"remote_addr": r.RemoteAddr,
+		"change":      string(body),
+		"before":      string(before),
+		"after":       string(after),
+	}).Info("Settings changed through the admin API")
+	writeSettings(w, settings)
+}
+
+func writeSettings(w http.ResponseWriter, settings adminSettings) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
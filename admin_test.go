@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/metrics"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/processors"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/sinks"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestProxy() *proxy {
+	options := &Options{Writekey: "key", Dataset: "traces", SampleRate: 10}
+	p := &proxy{
+		options:    options,
+		honeycombs: map[string]*sinks.HoneycombSink{"honeycomb": {}},
+		stdout:     &sinks.StdoutSink{},
+		processor:  &processors.CompositeProcessor{},
+	}
+	p.apply(configFromOptions(options))
+	return p
+}
+
+func settingsRequest(sh *settingsHandler, method, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/settings", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, r)
+	return w
+}
+
+func TestSettingsAPI(t *testing.T) {
+	assert := assert.New(t)
+	var auditLog bytes.Buffer
+	audit := logrus.New()
+	audit.Out = &auditLog
+	p := newTestProxy()
+	sh := &settingsHandler{Proxy: p, Token: "secret", Audit: audit}
+
+	assert.Equal(http.StatusUnauthorized, settingsRequest(sh, "GET", "", "").Code)
+	assert.Equal(http.StatusUnauthorized, settingsRequest(sh, "GET", "wrong", "").Code)
+	assert.Equal(http.StatusMethodNotAllowed, settingsRequest(sh, "DELETE", "secret", "").Code)
+
+	w := settingsRequest(sh, "GET", "secret", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"samplerate":10`)
+
+	w = settingsRequest(sh, "PATCH", "secret",
+		`{"honeycomb": {"service_samplerates": {"checkout": 1}, "service_datasets": {"checkout": "checkout-traces"}}}`)
+	assert.Equal(http.StatusOK, w.Code)
+	settings := p.honeycombs["honeycomb"].Settings()
+	assert.Equal(map[string]uint{"checkout": 1}, settings.ServiceSampleRates)
+	assert.Equal(map[string]string{"checkout": "checkout-traces"}, settings.ServiceDatasets)
+	// Settings missing from the request are unchanged.
+	assert.Equal(uint(10), settings.SampleRate)
+	assert.Equal("traces", settings.Dataset)
+	assert.Contains(auditLog.String(), "Settings changed through the admin API")
+
+	// Invalid changes are rejected, leaving the settings as they were.
+	auditLog.Reset()
+	w = settingsRequest(sh, "PATCH", "secret", `{"processors": {"error_classification": {"enabled": true, "rules": ["bogus"]}}}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	w = settingsRequest(sh, "PATCH", "secret", `{"honeycomb": {"samplerate": "high"}}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.False(p.cfg.Processors.ErrorClassification.Enabled)
+	assert.Equal(uint(10), p.honeycombs["honeycomb"].Settings().SampleRate)
+	assert.Empty(auditLog.String())
+
+	// Zero values remove per-service overrides.
+	w = settingsRequest(sh, "PATCH", "secret", `{"honeycomb": {"service_samplerates": {"checkout": 0}}}`)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Empty(p.honeycombs["honeycomb"].Settings().ServiceSampleRates)
+
+	// Routes replace the current ones as a whole.
+	w = settingsRequest(sh, "PATCH", "secret",
+		`{"honeycomb": {"routes": [{"match": "service=payments*", "dataset": "payments", "samplerate": 1}, {"match": "name=*health*", "samplerate": 100}]}}`)
+	assert.Equal(http.StatusOK, w.Code)
+	w = settingsRequest(sh, "PATCH", "secret", `{"honeycomb": {"routes": [{"match": "service=checkout"}]}}`)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal([]sinks.Route{{Match: "service=checkout"}}, p.honeycombs["honeycomb"].Settings().Routes)
+	w = settingsRequest(sh, "PATCH", "secret", `{"honeycomb": {"routes": [{"match": "checkout"}]}}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	// RED metrics can be turned on and off, but their buckets and series
+	// limit only change on restart.
+	p.red = &processors.REDMetrics{Registry: &metrics.Registry{}, MaxSeries: 1000}
+	w = settingsRequest(sh, "PATCH", "secret", `{"processors": {"red_metrics": {"enabled": true, "max_series": 1000}}}`)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.True(p.cfg.Processors.REDMetrics.Enabled)
+	auditLog.Reset()
+	w = settingsRequest(sh, "PATCH", "secret", `{"processors": {"red_metrics": {"max_series": 10}}}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), "processors.red_metrics.max_series")
+	w = settingsRequest(sh, "PATCH", "secret", `{"processors": {"red_metrics": {"buckets": [0.1, 1]}}}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal(1000, p.cfg.Processors.REDMetrics.MaxSeries)
+	assert.Empty(auditLog.String())
+}
@@ -2,157 +2,408 @@ package app
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/backoff"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/diskqueue"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/processors"
 	"github.com/honeycombio/honeycomb-opentracing-proxy/sinks"
 	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
 	v1 "github.com/honeycombio/honeycomb-opentracing-proxy/types/v1"
 	v2 "github.com/honeycombio/honeycomb-opentracing-proxy/types/v2"
+	"github.com/klauspost/compress/zstd"
 )
 
 const V1Endpoint string = "/api/v1/spans"
 const V2Endpoint string = "/api/v2/spans"
+const HealthzEndpoint string = "/healthz"
+const ReadyzEndpoint string = "/readyz"
 
 type App struct {
-	Port   string
-	server *http.Server
-	Sink   sinks.Sink
-	Mirror *Mirror
+	Port      string
+	server    *http.Server
+	Sink      sinks.Sink
+	Mirrors   []*Mirror
+	Processor processors.Processor
+
+	// AdminPort, if set, is a separate port to serve AdminHandlers on, so
+	// that operational endpoints aren't exposed alongside the span endpoints.
+	AdminPort     string
+	AdminHandlers map[string]http.Handler
+	adminServer   *http.Server
+
+	// MaxBodySize limits the size of request bodies as they're received, and
+	// MaxDecompressedSize limits the size of compressed request bodies once
+	// they're decompressed. They're DefaultMaxBodySize and
+	// DefaultMaxDecompressedSize if not set.
+	MaxBodySize         int64
+	MaxDecompressedSize int64
+
+	// MaxSpansPerRequest, MaxTagsPerSpan and MaxTagValueLength limit the
+	// number of spans in a request, and the number of tags on each span and
+	// the length of their values. Requests that exceed them are rejected.
+	// They're not enforced if not set.
+	MaxSpansPerRequest int
+	MaxTagsPerSpan     int
+	MaxTagValueLength  int
+
+	// ThrottleQueueFill and UnavailableQueueFill are fractions between 0 and
+	// 1. Requests are rejected with a 429 while the Sink's queue is at least
+	// ThrottleQueueFill full, and with a 503 while it's at least
+	// UnavailableQueueFill full. The Mirror and Buffer thresholds are the
+	// same for the fullest of the Mirrors' queues, and for the fullest of the
+	// Sink's and Mirrors' disk buffers. They're not enforced if not set.
+	// Clients are asked to retry after RetryAfter, which is DefaultRetryAfter
+	// if not set.
+	ThrottleQueueFill          float64
+	UnavailableQueueFill       float64
+	MirrorThrottleQueueFill    float64
+	MirrorUnavailableQueueFill float64
+	ThrottleBufferFill         float64
+	UnavailableBufferFill      float64
+	RetryAfter                 time.Duration
+
+	// AllowedWriteKeys and AllowedDatasets are the Honeycomb write keys and
+	// datasets that clients may choose for their spans, with the
+	// X-Honeycomb-Team and X-Honeycomb-Dataset headers, or with a dataset in
+	// the path, e.g. /api/v2/spans/mydataset. "*" allows any. Clients can't
+	// choose a setting that has no allowlist. AllowedDatasets also applies to
+	// spans' honeycomb.dataset tags.
+	AllowedWriteKeys []string
+	AllowedDatasets  []string
 }
 
 // handleSpansV1 handles the /api/v1/spans POST endpoint. It decodes the request
-// body and normalizes it to a slice of types.Span instances. The Sink
-// handles that slice. The Mirror, if configured, takes the request body
-// verbatim and sends it to another host.
+// body and normalizes it to a slice of types.Span instances. The Processor, if
+// configured, transforms each span, and the Sink handles the resulting slice.
+// Once the Sink has taken them, each Mirror whose filters match the request
+// sends either the request body verbatim, or the processed spans re-encoded in
+// its Format, to another host.
+// JSON requests that no Mirror wants are handled by streamJSON instead.
 func (a *App) handleSpansV1(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	data, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		logrus.WithError(err).Info("Error reading request body")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("error reading request"))
-	}
-
 	contentType := r.Header.Get("Content-Type")
+	if contentType == "application/json" && !a.mirrored(V1Endpoint) {
+		a.streamJSON(w, r, V1Endpoint, v1.DecodeJSONFunc)
+		return
+	}
 
-	if a.Mirror != nil {
-		if err := a.Mirror.Send(payload{Endpoint: V1Endpoint, ContentType: contentType, Body: data}); err != nil {
-			logrus.WithError(err).Info("Error mirroring data")
-		}
+	data, err := ioutil.ReadAll(r.Body)
+	if le, ok := err.(limitError); ok {
+		rejectOverLimit(w, V1Endpoint, le)
+		return
+	} else if err != nil {
+		logrus.WithError(err).Info("Error reading request body")
+		decodeErrors.Inc(V1Endpoint, contentType)
+		status, message := readErrorResponse(err)
+		w.WriteHeader(status)
+		w.Write([]byte(message))
+		return
 	}
 
+	p := payload{Endpoint: V1Endpoint, ContentType: contentType, Body: data, received: receivedBody(r)}
 	var spans []*types.Span
 	switch contentType {
 	case "application/json":
-		spans, err = v1.DecodeJSON(bytes.NewReader(data))
+		spans, err = a.decodeJSON(v1.DecodeJSONFunc, bytes.NewReader(data))
 	case "application/x-thrift":
 		spans, err = v1.DecodeThrift(bytes.NewReader(data))
 	default:
+		a.mirror(p, nil)
 		logrus.WithField("contentType", contentType).Info("unknown content type")
+		decodeErrors.Inc(V1Endpoint, "unknown")
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("unknown content type"))
 		return
 	}
-	if err != nil {
+	if le, ok := err.(limitError); ok {
+		rejectOverLimit(w, V1Endpoint, le)
+		return
+	} else if err != nil {
+		a.mirror(p, nil)
 		logrus.WithError(err).WithField("type", contentType).Info("error unmarshaling spans")
+		decodeErrors.Inc(V1Endpoint, contentType)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("error unmarshaling span data"))
 		return
 	}
+	spansReceived.Add(float64(len(spans)), V1Endpoint, contentType)
+	if le, ok := a.checkLimits(spans).(limitError); ok {
+		rejectOverLimit(w, V1Endpoint, le)
+		return
+	}
 
-	if err := a.Sink.Send(spans); err != nil {
-		logrus.WithError(err).Info("error forwarding spans")
+	if err := a.setDestination(r, spans); err != nil {
+		forbid(w, V1Endpoint, "dataset", err.Error())
+		return
+	}
+	a.process(spans)
+	if err := a.send(spans); err != nil {
+		// Not mirrored, so that a client's retry doesn't mirror the spans
+		// twice.
+		a.sendFailed(w, err)
+		return
 	}
+	a.mirror(p, spans)
 	w.WriteHeader(http.StatusAccepted)
 }
 
 // handleSpansV2 handles the /api/v2/spans POST endpoint. It decodes the request
-// body and normalizes it to a slice of types.Span instances. The Sink
-// handles that slice. The Mirror, if configured, takes the request body
-// verbatim and sends it to another host.
+// body and normalizes it to a slice of types.Span instances. The Processor, if
+// configured, transforms each span, and the Sink handles the resulting slice.
+// Once the Sink has taken them, each Mirror whose filters match the request
+// sends either the request body verbatim, or the processed spans re-encoded in
+// its Format, to another host.
+// JSON requests that no Mirror wants are handled by streamJSON instead.
 func (a *App) handleSpansV2(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	data, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		logrus.WithError(err).Info("Error reading request body")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("error reading request"))
-	}
-
 	contentType := r.Header.Get("Content-Type")
+	if contentType == "application/json" && !a.mirrored(V2Endpoint) {
+		a.streamJSON(w, r, V2Endpoint, v2.DecodeJSONFunc)
+		return
+	}
 
-	if a.Mirror != nil {
-		if err := a.Mirror.Send(payload{Endpoint: V2Endpoint, ContentType: contentType, Body: data}); err != nil {
-			logrus.WithError(err).Info("Error mirroring data")
-		}
+	data, err := ioutil.ReadAll(r.Body)
+	if le, ok := err.(limitError); ok {
+		rejectOverLimit(w, V2Endpoint, le)
+		return
+	} else if err != nil {
+		logrus.WithError(err).Info("Error reading request body")
+		decodeErrors.Inc(V2Endpoint, contentType)
+		status, message := readErrorResponse(err)
+		w.WriteHeader(status)
+		w.Write([]byte(message))
+		return
 	}
 
+	p := payload{Endpoint: V2Endpoint, ContentType: contentType, Body: data, received: receivedBody(r)}
 	var spans []*types.Span
 	switch contentType {
 	case "application/json":
-		spans, err = v2.DecodeJSON(bytes.NewReader(data))
+		spans, err = a.decodeJSON(v2.DecodeJSONFunc, bytes.NewReader(data))
 	default:
+		a.mirror(p, nil)
 		logrus.WithField("contentType", contentType).Info("unknown content type")
+		decodeErrors.Inc(V2Endpoint, "unknown")
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("unknown content type"))
 		return
 	}
-	if err != nil {
+	if le, ok := err.(limitError); ok {
+		rejectOverLimit(w, V2Endpoint, le)
+		return
+	} else if err != nil {
+		a.mirror(p, nil)
 		logrus.WithError(err).WithField("type", contentType).Info("error unmarshaling spans")
+		decodeErrors.Inc(V2Endpoint, contentType)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("error unmarshaling span data"))
 		return
 	}
+	spansReceived.Add(float64(len(spans)), V2Endpoint, contentType)
+	if le, ok := a.checkLimits(spans).(limitError); ok {
+		rejectOverLimit(w, V2Endpoint, le)
+		return
+	}
 
-	if err := a.Sink.Send(spans); err != nil {
-		logrus.WithError(err).Info("error forwarding spans")
+	if err := a.setDestination(r, spans); err != nil {
+		forbid(w, V2Endpoint, "dataset", err.Error())
+		return
+	}
+	a.process(spans)
+	if err := a.send(spans); err != nil {
+		// Not mirrored, so that a client's retry doesn't mirror the spans
+		// twice.
+		a.sendFailed(w, err)
+		return
 	}
+	a.mirror(p, spans)
 	w.WriteHeader(http.StatusAccepted)
 }
 
-// ungzipWrap wraps a handleFunc and transparently ungzips the body of the
-// request if it is gzipped
-func ungzipWrap(hf func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var newBody io.ReadCloser
-		isGzipped := r.Header.Get("Content-Encoding")
-		if isGzipped == "gzip" {
-			buf := bytes.Buffer{}
-			if _, err := io.Copy(&buf, r.Body); err != nil {
-				logrus.WithError(err).Info("error allocating buffer for ungzipping")
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte("error allocating buffer for ungzipping"))
-				return
-			}
+// mirror sends a request to each of the Mirrors whose filters match it. spans
+// is nil if the request body couldn't be decoded.
+func (a *App) mirror(p payload, spans []*types.Span) {
+	for _, m := range a.Mirrors {
+		if !m.matches(p, spans) {
+			continue
+		}
+		out := p
+		if m.Format != FormatOriginal {
 			var err error
-			newBody, err = gzip.NewReader(&buf)
-			if err != nil {
-				logrus.WithError(err).Info("error ungzipping span data")
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte("error ungzipping span data"))
-				return
+			if out, err = m.encode(spans); err != nil {
+				mirrorDropped.Inc(m.Name, "encoding")
+				logrus.WithError(err).WithField("mirror", m.Name).Info("Error encoding spans to mirror")
+				continue
 			}
-			r.Body = newBody
 		}
-		hf(w, r)
+		out, err := m.compress(out)
+		if err != nil {
+			mirrorDropped.Inc(m.Name, "encoding")
+			logrus.WithError(err).WithField("mirror", m.Name).Info("Error compressing data to mirror")
+			continue
+		}
+		if err := m.Send(out); err != nil {
+			logrus.WithError(err).WithField("mirror", m.Name).Info("Error mirroring data")
+		}
 	}
 }
 
+// decodeJSON decodes a JSON request body with decode, span by span. It fails
+// with a limitError as soon as there are more than MaxSpansPerRequest spans,
+// rather than decoding the rest.
+func (a *App) decodeJSON(decode func(io.Reader, func(*types.Span) error) error, r io.Reader) ([]*types.Span, error) {
+	var spans []*types.Span
+	err := decode(r, func(s *types.Span) error {
+		spans = append(spans, s)
+		if a.MaxSpansPerRequest > 0 && len(spans) > a.MaxSpansPerRequest {
+			return errTooManySpans(a.MaxSpansPerRequest)
+		}
+		return nil
+	})
+	return spans, err
+}
+
+// send hands spans to the Sink, in chunks of at most sinkChunkSize spans, and
+// logs any failures. After trying every chunk, it returns the first error,
+// unless only best-effort sinks failed. If the Sink took some chunks but not
+// others, the error is a partialSendError.
+func (a *App) send(spans []*types.Span) error {
+	var firstErr error
+	var taken bool
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > sinkChunkSize {
+			n = sinkChunkSize
+		}
+		err := a.Sink.Send(spans[:n])
+		spans = spans[n:]
+		if err == nil {
+			taken = true
+			continue
+		}
+		me, ok := err.(*sinks.MultiError)
+		if !ok {
+			sinkErrors.Inc("sink")
+			logrus.WithError(err).Info("error forwarding spans")
+		} else {
+			for _, r := range me.Results {
+				if r.Err == nil {
+					continue
+				}
+				sinkErrors.Inc(r.Name)
+				logrus.WithError(r.Err).WithFields(logrus.Fields{
+					"sink":     r.Name,
+					"required": r.Required,
+					"accepted": r.Accepted,
+					"dropped":  r.Dropped,
+					"failed":   r.Failed,
+				}).Info("error forwarding spans")
+			}
+			if !me.RequiredFailed() {
+				taken = true
+				continue
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil && taken {
+		return partialSendError{firstErr}
+	}
+	return firstErr
+}
+
+// partialSendError is returned by send when the Sink took only some of the
+// chunks of a request's spans.
+type partialSendError struct {
+	error
+}
+
+// sendFailed responds to a request whose spans the Sink failed to take. The
+// client is asked to retry later, unless some of the spans were taken, since a
+// retry would then send those twice.
+func (a *App) sendFailed(w http.ResponseWriter, err error) {
+	if _, ok := err.(partialSendError); ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("error forwarding some spans"))
+		return
+	}
+	a.retryLater(w, http.StatusServiceUnavailable, "error forwarding spans")
+}
+
+// process runs the configured Processor, if any, over each span.
+func (a *App) process(spans []*types.Span) {
+	if a.Processor == nil {
+		return
+	}
+	for _, s := range spans {
+		a.Processor.Process(s)
+	}
+}
+
+// handleHealthz handles the /healthz endpoint. It always succeeds while the
+// process is able to serve requests at all, so it's suitable for liveness
+// probes.
+func (a *App) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// handleReadyz handles the /readyz endpoint. It fails with a 503 if the Sink
+// or any of the Mirrors can't currently handle spans, so that load balancers
+// can shift traffic to other replicas.
+func (a *App) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := a.ready(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (a *App) ready() error {
+	if rc, ok := a.Sink.(sinks.ReadinessChecker); ok {
+		if err := rc.Ready(); err != nil {
+			return err
+		}
+	}
+	for _, m := range a.Mirrors {
+		if err := m.Ready(); err != nil {
+			if m.Name != "" {
+				return fmt.Errorf("%s: %v", m.Name, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
 func (a *App) Start() error {
 	mux := http.NewServeMux()
-	mux.HandleFunc(V1Endpoint, ungzipWrap(a.handleSpansV1))
-	mux.HandleFunc(V2Endpoint, ungzipWrap(a.handleSpansV2))
+	mux.HandleFunc(HealthzEndpoint, a.handleHealthz)
+	mux.HandleFunc(ReadyzEndpoint, a.handleReadyz)
+	handleV1 := instrumentWrap(V1Endpoint, a.destinationWrap(V1Endpoint, a.backpressureWrap(a.limitWrap(a.decompressWrap(a.handleSpansV1)))))
+	handleV2 := instrumentWrap(V2Endpoint, a.destinationWrap(V2Endpoint, a.backpressureWrap(a.limitWrap(a.decompressWrap(a.handleSpansV2)))))
+	mux.HandleFunc(V1Endpoint, handleV1)
+	mux.HandleFunc(V2Endpoint, handleV2)
+	// The endpoints also take a dataset in the path.
+	mux.HandleFunc(V1Endpoint+"/", handleV1)
+	mux.HandleFunc(V2Endpoint+"/", handleV2)
 
 	a.server = &http.Server{
 		Addr:    a.Port,
@@ -160,38 +411,228 @@ func (a *App) Start() error {
 	}
 	go a.server.ListenAndServe()
 	logrus.WithField("port", a.Port).Info("Listening")
+
+	if a.AdminPort != "" {
+		adminMux := http.NewServeMux()
+		for pattern, handler := range a.AdminHandlers {
+			adminMux.Handle(pattern, handler)
+		}
+		a.adminServer = &http.Server{
+			Addr:    a.AdminPort,
+			Handler: adminMux,
+		}
+		go a.adminServer.ListenAndServe()
+		logrus.WithField("port", a.AdminPort).Info("Admin endpoints listening")
+	}
 	return nil
 }
 
+// defaultShutdownTimeout is how long Stop waits for requests that are being
+// handled to finish.
+const defaultShutdownTimeout = 30 * time.Second
+
 func (a *App) Stop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
 	defer cancel()
-	return a.server.Shutdown(ctx)
+	return a.Shutdown(ctx)
+}
+
+// Shutdown stops accepting new requests, and waits until requests that are
+// being handled have finished, or until ctx is done. Once it returns without
+// an error, the Sink and Mirrors won't be sent any more spans by the App.
+func (a *App) Shutdown(ctx context.Context) error {
+	err := a.server.Shutdown(ctx)
+	if a.adminServer != nil {
+		if adminErr := a.adminServer.Shutdown(ctx); err == nil {
+			err = adminErr
+		}
+	}
+	return err
 }
 
 type payload struct {
-	Endpoint    string
-	ContentType string
-	Body        []byte
+	Endpoint        string
+	ContentType     string
+	ContentEncoding string
+	Body            []byte
+
+	// received is the request body as it was received, if it was
+	// compressed.
+	received *encodedBody
 }
 
+// Mirror forwards requests to a downstream host. If Format is
+// FormatOriginal, request bodies are forwarded verbatim. Otherwise, the spans
+// in each request are re-encoded in Format after the App's Processor has run,
+// and requests that couldn't be decoded aren't forwarded. It's not ready while
+// its queue is more than MaxBufferFill (a fraction between 0 and 1) full, if
+// MaxBufferFill is set.
+//
+// If Endpoints is set, only request bodies received on those endpoints are
+// forwarded. If Services is set, only request bodies containing at least one
+// span from one of those services are forwarded; the other spans in the same
+// request are forwarded along with them if Format is FormatOriginal, and left
+// out otherwise. Each Mirror has its own queue and workers, so a slow
+// downstream host doesn't hold up the others. Name identifies the Mirror in
+// logs and metrics.
+//
+// Headers are added to each request, as is an Authorization header with the
+// bearer token in BearerTokenFile, or with BasicAuthUser and the password in
+// BasicAuthPasswordFile. The files are read when the Mirror starts. CAFile is
+// a PEM bundle of certificate authorities to trust instead of the system's,
+// and CertFile and KeyFile are a client certificate and key to present. All
+// workers share one HTTP transport, keeping connections alive between
+// requests. ConnectTimeout limits connecting to the downstream host, including
+// the TLS handshake, and RequestTimeout limits each attempt to send a payload.
+//
+// If Compression is set, request bodies are compressed with gzip or zstd at
+// CompressionLevel, or the default level if it's 0. Request bodies that are
+// forwarded verbatim and were received compressed the same way are sent as
+// they were received, without decompressing and compressing them again.
+//
+// If BufferDir is set, payloads are queued on disk in that directory instead
+// of in memory, and sent downstream in order, up to MaxConcurrency at a time,
+// retrying while the downstream host is unavailable. Payloads still in the
+// queue when the process exits are sent once it restarts. BufferMaxSize caps
+// the size of the queue in bytes, and BufferName names it in metrics; it's
+// "mirror-" followed by Name if not set.
+//
+// Otherwise, sending each payload is retried up to MaxRetries times after
+// network errors and 429 or 5xx responses, waiting between MinBackoff and
+// MaxBackoff between attempts, for at most PayloadTimeout in all. In both
+// cases, once BreakerThreshold consecutive attempts have failed, the mirror
+// assumes the downstream host is down, and stops sending to it for
+// BreakerCooldown before trying again; in the meantime, payloads queued in
+// memory are dropped.
 type Mirror struct {
-	DownstreamURL  *url.URL
-	BufSize        int
-	MaxConcurrency int
+	Name             string
+	DownstreamURL    *url.URL
+	Format           string
+	Services         []string
+	Endpoints        []string
+	BufSize          int
+	MaxConcurrency   int
+	MaxBufferFill    float64
+	BufferDir        string
+	BufferMaxSize    int64
+	BufferName       string
+	MaxRetries       int
+	MinBackoff       time.Duration
+	MaxBackoff       time.Duration
+	PayloadTimeout   time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	Headers               map[string]string
+	BearerTokenFile       string
+	BasicAuthUser         string
+	BasicAuthPasswordFile string
+	CAFile                string
+	CertFile              string
+	KeyFile               string
+	ConnectTimeout        time.Duration
+	RequestTimeout        time.Duration
+
+	Compression      string
+	CompressionLevel int
+
+	client        *http.Client
+	authorization string
+	zstdEncoder   *zstd.Encoder
 
+	// mu guards stopped, and closing payloads.
+	mu       sync.RWMutex
 	payloads chan payload
 	stopped  bool
 	wg       sync.WaitGroup
+	inFlight int64
+
+	buffer   *diskqueue.Queue
+	replayer *diskqueue.Replayer
+	breaker  *breaker
 }
 
+// Formats that a Mirror can forward requests in.
+const (
+	FormatOriginal = ""
+	FormatV1JSON   = "v1_json"
+	FormatV2JSON   = "v2_json"
+	FormatV2Proto  = "v2_proto"
+)
+
+var errCircuitOpen = errors.New("not sending downstream while it appears to be down")
+
 func (m *Mirror) Start() error {
+	if m.Name == "" {
+		m.Name = "downstream"
+	}
+	switch m.Format {
+	case FormatOriginal, FormatV1JSON, FormatV2JSON, FormatV2Proto:
+	default:
+		return fmt.Errorf("unknown mirror format %s", m.Format)
+	}
+	if err := CheckCompression(m.Compression, m.CompressionLevel); err != nil {
+		return err
+	}
 	if m.MaxConcurrency == 0 {
 		m.MaxConcurrency = 100
 	}
 	if m.BufSize == 0 {
 		m.BufSize = 4096
 	}
+	if m.MinBackoff == 0 {
+		m.MinBackoff = 100 * time.Millisecond
+	}
+	if m.MaxBackoff == 0 {
+		m.MaxBackoff = 10 * time.Second
+	}
+	if m.PayloadTimeout == 0 {
+		m.PayloadTimeout = 30 * time.Second
+	}
+	if m.BreakerCooldown == 0 {
+		m.BreakerCooldown = 30 * time.Second
+	}
+	if m.ConnectTimeout == 0 {
+		m.ConnectTimeout = 10 * time.Second
+	}
+	var err error
+	if m.client, err = m.newClient(); err != nil {
+		return err
+	}
+	if m.authorization, err = m.readAuthorization(); err != nil {
+		return err
+	}
+	if m.Compression == CompressionZstd {
+		level := zstd.SpeedDefault
+		if m.CompressionLevel != 0 {
+			level = zstd.EncoderLevelFromZstd(m.CompressionLevel)
+		}
+		if m.zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level)); err != nil {
+			return err
+		}
+	}
+	m.breaker = &breaker{name: m.Name, threshold: m.BreakerThreshold, cooldown: m.BreakerCooldown}
+	if m.BufferDir != "" {
+		if m.BufferName == "" {
+			m.BufferName = "mirror-" + m.Name
+		}
+		m.buffer = &diskqueue.Queue{
+			Dir:     m.BufferDir,
+			Name:    m.BufferName,
+			MaxSize: m.BufferMaxSize,
+		}
+		if err := m.buffer.Open(); err != nil {
+			return err
+		}
+		m.replayer = &diskqueue.Replayer{
+			Queue:      m.buffer,
+			Deliver:    m.deliverBuffered,
+			BatchSize:  m.MaxConcurrency,
+			MinBackoff: m.MinBackoff,
+			MaxBackoff: m.MaxBackoff,
+		}
+		return m.replayer.Start()
+	}
 	m.payloads = make(chan payload, m.BufSize)
 	for i := 0; i < m.MaxConcurrency; i++ {
 		m.wg.Add(1)
@@ -201,50 +642,289 @@ func (m *Mirror) Start() error {
 }
 
 func (m *Mirror) Stop() error {
-	m.stopped = true
-	if m.payloads == nil {
+	return m.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting payloads, and waits until queued payloads have
+// been sent downstream, or until ctx is done. In the latter case, it returns an
+// error with the number of payloads that weren't sent.
+func (m *Mirror) Shutdown(ctx context.Context) error {
+	if m.replayer != nil {
+		return m.shutdownBuffer(ctx)
+	}
+	m.mu.Lock()
+	if m.stopped || m.payloads == nil {
+		m.stopped = true
+		m.mu.Unlock()
 		return nil
 	}
+	m.stopped = true
 	close(m.payloads)
-	m.wg.Wait()
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d payloads weren't sent downstream: %v",
+			len(m.payloads)+int(atomic.LoadInt64(&m.inFlight)), ctx.Err())
+	}
+}
+
+// shutdownBuffer stops accepting payloads, and waits until the disk buffer
+// has been sent downstream, or until ctx is done. In the latter case, the
+// remaining payloads stay in the buffer.
+func (m *Mirror) shutdownBuffer(ctx context.Context) error {
+	m.mu.Lock()
+	stopped := m.stopped
+	m.stopped = true
+	m.mu.Unlock()
+	if stopped {
+		return nil
+	}
+	err := m.replayer.Drain(ctx)
+	m.buffer.Close()
+	if err != nil {
+		return fmt.Errorf("%d payloads weren't sent downstream, and remain in the disk buffer: %v",
+			m.buffer.Len(), err)
+	}
 	return nil
 }
 
 func (m *Mirror) runWorker() {
+	defer m.wg.Done()
 	for p := range m.payloads {
-		downstreamURL := m.DownstreamURL
-		downstreamURL.Path = p.Endpoint
-		r, err := http.NewRequest("POST", downstreamURL.String(), bytes.NewReader(p.Body))
-		r.Header.Set("Content-Type", p.ContentType)
-		if err != nil {
-			logrus.WithError(err).Info("Error building downstream request")
-			return
+		atomic.AddInt64(&m.inFlight, 1)
+		if err := m.deliver(p, m.MaxRetries); err == errCircuitOpen {
+			mirrorDropped.Inc(m.Name, "circuit_open")
+		} else if err != nil {
+			mirrorDropped.Inc(m.Name, "failed")
+			logrus.WithError(err).WithField("mirror", m.Name).Info("Error sending payload downstream")
 		}
-		client := &http.Client{}
-		resp, err := client.Do(r)
-		if err != nil {
-			logrus.WithError(err).Info("Error sending payload downstream")
+		atomic.AddInt64(&m.inFlight, -1)
+	}
+}
+
+// deliver sends a payload downstream, retrying up to retries times with
+// exponential backoff while the error is temporary, and giving up after
+// PayloadTimeout. It returns errCircuitOpen without trying if the downstream
+// host appears to be down.
+func (m *Mirror) deliver(p payload, retries int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.PayloadTimeout)
+	defer cancel()
+	for attempt := 0; ; attempt++ {
+		if !m.breaker.allow() {
+			return errCircuitOpen
+		}
+		err := m.send(ctx, p)
+		m.breaker.record(err == nil)
+		if err == nil || attempt >= retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff.Jittered(uint(attempt), m.MinBackoff, m.MaxBackoff)):
+			mirrorRetries.Inc(m.Name)
+		}
+	}
+}
+
+// deliverBuffered sends payloads from the disk buffer downstream, all at
+// once. It returns how many payloads at the start of records were sent; the
+// replayer retries the rest itself, in order, so payloads after one that
+// failed may be sent again.
+func (m *Mirror) deliverBuffered(records [][]byte) (int, error) {
+	errs := make([]error, len(records))
+	var wg sync.WaitGroup
+	for i, record := range records {
+		var p payload
+		if err := json.Unmarshal(record, &p); err != nil {
+			logrus.WithError(err).Error("Dropping unreadable payload from disk buffer")
 			continue
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusAccepted {
-			responseBody, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 1024})
-			logrus.WithField("status", resp.Status).
-				WithField("response", string(responseBody)).
-				Info("Error response sending payload downstream")
+		wg.Add(1)
+		go func(i int, p payload) {
+			defer wg.Done()
+			errs[i] = m.deliver(p, 0)
+		}(i, p)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
+
+// send sends a payload downstream. It returns an error if the payload wasn't
+// delivered but might be if it were sent again, i.e. if the request failed or
+// the downstream host returned a 429 or 5xx status. Other error responses are
+// only logged.
+func (m *Mirror) send(ctx context.Context, p payload) error {
+	downstreamURL := *m.DownstreamURL
+	downstreamURL.Path = p.Endpoint
+	r, err := http.NewRequest("POST", downstreamURL.String(), bytes.NewReader(p.Body))
+	if err != nil {
+		logrus.WithError(err).Info("Error building downstream request")
+		return nil
+	}
+	for k, v := range m.Headers {
+		r.Header.Set(k, v)
+	}
+	if m.authorization != "" {
+		r.Header.Set("Authorization", m.authorization)
+	}
+	r.Header.Set("Content-Type", p.ContentType)
+	if p.ContentEncoding != "" {
+		r.Header.Set("Content-Encoding", p.ContentEncoding)
+	}
+	start := time.Now()
+	resp, err := m.client.Do(r.WithContext(ctx))
+	mirrorDuration.Observe(time.Since(start).Seconds(), m.Name)
+	if err != nil {
+		mirrorResponses.Inc(m.Name, "error")
+		return err
+	}
+	mirrorResponses.Inc(m.Name, strconv.Itoa(resp.StatusCode))
+	defer func() {
+		// Read the rest of the response so that the connection can be
+		// reused.
+		io.CopyN(ioutil.Discard, resp.Body, maxDiscardedResponse)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusAccepted {
+		responseBody, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 1024})
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return fmt.Errorf("downstream returned %s: %s", resp.Status, responseBody)
 		}
+		logrus.WithField("status", resp.Status).
+			WithField("response", string(responseBody)).
+			WithField("mirror", m.Name).
+			Info("Error response sending payload downstream")
 	}
-	m.wg.Done()
+	return nil
+}
+
+// matches reports whether a request body should be forwarded by this
+// Mirror, given the spans decoded from it.
+func (m *Mirror) matches(p payload, spans []*types.Span) bool {
+	if len(m.Endpoints) > 0 && !contains(m.Endpoints, p.Endpoint) {
+		return false
+	}
+	if m.Format != FormatOriginal && len(spans) == 0 {
+		return false
+	}
+	if len(m.Services) == 0 {
+		return true
+	}
+	for _, s := range spans {
+		if contains(m.Services, s.ServiceName) {
+			return true
+		}
+	}
+	return false
+}
+
+// encode encodes spans in the Mirror's Format, leaving out spans from other
+// services if Services is set.
+func (m *Mirror) encode(spans []*types.Span) (payload, error) {
+	if len(m.Services) > 0 {
+		var matching []*types.Span
+		for _, s := range spans {
+			if contains(m.Services, s.ServiceName) {
+				matching = append(matching, s)
+			}
+		}
+		spans = matching
+	}
+	var buf bytes.Buffer
+	switch m.Format {
+	case FormatV1JSON:
+		err := v1.EncodeJSON(&buf, spans)
+		return payload{Endpoint: V1Endpoint, ContentType: "application/json", Body: buf.Bytes()}, err
+	case FormatV2JSON:
+		err := v2.EncodeJSON(&buf, spans)
+		return payload{Endpoint: V2Endpoint, ContentType: "application/json", Body: buf.Bytes()}, err
+	default:
+		body, err := v2.EncodeProto(spans)
+		return payload{Endpoint: V2Endpoint, ContentType: "application/x-protobuf", Body: body}, err
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Ready reports whether the mirror has started and its queue isn't saturated.
+func (m *Mirror) Ready() error {
+	if m.buffer != nil {
+		if size := m.buffer.Size(); m.MaxBufferFill > 0 && float64(size) >= m.MaxBufferFill*float64(m.buffer.MaxSize) {
+			return fmt.Errorf("mirror disk buffer has %d of %d bytes", size, m.buffer.MaxSize)
+		}
+		return nil
+	}
+	if m.payloads == nil {
+		return errors.New("mirror not started")
+	}
+	if m.MaxBufferFill > 0 && float64(len(m.payloads)) >= m.MaxBufferFill*float64(cap(m.payloads)) {
+		return fmt.Errorf("mirror queue has %d of %d payloads", len(m.payloads), cap(m.payloads))
+	}
+	return nil
+}
+
+// QueueFill returns how full the Mirror's queue is, as a fraction of its
+// capacity, or 0 if it has a disk buffer instead.
+func (m *Mirror) QueueFill() float64 {
+	if m.payloads == nil {
+		return 0
+	}
+	return float64(len(m.payloads)) / float64(cap(m.payloads))
+}
+
+// BufferFill returns how full the Mirror's disk buffer is, as a fraction of
+// its maximum size, or 0 if it doesn't have one.
+func (m *Mirror) BufferFill() float64 {
+	if m.buffer == nil {
+		return 0
+	}
+	return float64(m.buffer.Size()) / float64(m.buffer.MaxSize)
 }
 
 func (m *Mirror) Send(p payload) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	if m.stopped {
+		mirrorDropped.Inc(m.Name, "stopped")
 		return errors.New("sink stopped")
 	}
+	if m.buffer != nil {
+		record, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if err := m.buffer.Push(record); err != nil {
+			mirrorDropped.Inc(m.Name, "full")
+			return err
+		}
+		return nil
+	}
 	select {
 	case m.payloads <- p:
 		return nil
 	default:
+		mirrorDropped.Inc(m.Name, "full")
 		return errors.New("sink full")
 	}
 }
@@ -2,32 +2,48 @@ package app
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/golang/snappy"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/metrics"
 	"github.com/honeycombio/honeycomb-opentracing-proxy/sinks"
 	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
 	v1 "github.com/honeycombio/honeycomb-opentracing-proxy/types/v1"
 	v2 "github.com/honeycombio/honeycomb-opentracing-proxy/types/v2"
 	libhoney "github.com/honeycombio/libhoney-go"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"github.com/uber/jaeger/thrift-gen/zipkincore"
 )
 
 type MockSink struct {
 	spans []types.Span
+	sends int
 }
 
 func (ms *MockSink) Send(spans []*types.Span) error {
+	ms.sends++
 	for _, span := range spans {
 		ms.spans = append(ms.spans, *span)
 	}
@@ -37,15 +53,33 @@ func (ms *MockSink) Send(spans []*types.Span) error {
 func (ms *MockSink) Start() error { return nil }
 func (ms *MockSink) Stop() error  { return nil }
 
+// zstdCompress compresses data into a zstd frame at a level of the zstd
+// command line tool.
+func zstdCompress(data []byte, level int) []byte {
+	enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	return enc.EncodeAll(data, nil)
+}
+
+func zstdDecompress(data []byte) ([]byte, error) {
+	dec, _ := zstd.NewReader(nil)
+	defer dec.Close()
+	return dec.DecodeAll(data, nil)
+}
+
+// startHoneycombSink starts a HoneycombSink that hands its events to output,
+// with "test" as its write key and default dataset.
+func startHoneycombSink(hs *sinks.HoneycombSink, output *libhoney.MockOutput) *sinks.HoneycombSink {
+	hs.Writekey = "test"
+	hs.Dataset = "test"
+	hs.Output = output
+	hs.Start()
+	return hs
+}
+
 func TestMissingJSONTimestampHandlingV1(t *testing.T) {
 	mockHoneycomb := &libhoney.MockOutput{}
 	assert := assert.New(t)
-	libhoney.Init(libhoney.Config{
-		WriteKey: "test",
-		Dataset:  "test",
-		Output:   mockHoneycomb,
-	})
-	a := &App{Sink: &sinks.HoneycombSink{}}
+	a := &App{Sink: startHoneycombSink(&sinks.HoneycombSink{}, mockHoneycomb)}
 
 	jsonPayload := `[{
 				"traceId":     "350565b6a90d4c8c",
@@ -62,12 +96,7 @@ func TestMissingJSONTimestampHandlingV1(t *testing.T) {
 func TestMissingJSONTimestampHandlingV2(t *testing.T) {
 	mockHoneycomb := &libhoney.MockOutput{}
 	assert := assert.New(t)
-	libhoney.Init(libhoney.Config{
-		WriteKey: "test",
-		Dataset:  "test",
-		Output:   mockHoneycomb,
-	})
-	a := &App{Sink: &sinks.HoneycombSink{}}
+	a := &App{Sink: startHoneycombSink(&sinks.HoneycombSink{}, mockHoneycomb)}
 
 	jsonPayload := `[{
 				"traceId":     "350565b6a90d4c8c",
@@ -84,12 +113,7 @@ func TestMissingJSONTimestampHandlingV2(t *testing.T) {
 func TestMissingThriftTimestampHandling(t *testing.T) {
 	mockHoneycomb := &libhoney.MockOutput{}
 	assert := assert.New(t)
-	libhoney.Init(libhoney.Config{
-		WriteKey: "test",
-		Dataset:  "test",
-		Output:   mockHoneycomb,
-	})
-	a := &App{Sink: &sinks.HoneycombSink{}}
+	a := &App{Sink: startHoneycombSink(&sinks.HoneycombSink{}, mockHoneycomb)}
 
 	thriftPayload := serializeThriftSpans([]*zipkincore.Span{
 		&zipkincore.Span{
@@ -125,6 +149,18 @@ func TestThriftDecoding(t *testing.T) {
 				HostIPv4:     "10.129.211.111",
 				ServiceName:  "poodle",
 			},
+			Annotations: []*types.Annotation{
+				&types.Annotation{
+					Timestamp: 1506629717286440,
+					Value:     "cs",
+					Host:      &types.Endpoint{Ipv4: "10.129.211.111", ServiceName: "poodle"},
+				},
+				&types.Annotation{
+					Timestamp: 1506629717288596,
+					Value:     "cr",
+					Host:      &types.Endpoint{Ipv4: "10.129.211.111", ServiceName: "poodle"},
+				},
+			},
 			BinaryAnnotations: map[string]interface{}{
 				"component": "gRPC",
 			},
@@ -236,6 +272,242 @@ func TestThriftRootSpans(t *testing.T) {
 	}, ms.spans[0])
 }
 
+func TestStreamingJSONDecoding(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i := 0; i < 2500; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `{"traceId": "%x", "id": "%x", "name": "query", "binaryAnnotations": [{"key": "db", "value": "spans"}]}`, i/10, i)
+	}
+	buf.WriteString("]")
+
+	// Spans are handed to the Sink in chunks.
+	ms := &MockSink{}
+	a := &App{Sink: ms}
+	w := handleV1(a, buf.Bytes(), "application/json")
+	assert.Equal(http.StatusAccepted, w.Code)
+	assert.Equal(2500, len(ms.spans))
+	assert.Equal(3, ms.sends)
+	assert.Equal("9c3", ms.spans[2499].ID)
+
+	// Nothing is handed to the Sink before the whole request has been
+	// decoded and checked.
+	ms.spans = nil
+	a.MaxSpansPerRequest = 2499
+	w = handleV1(a, buf.Bytes(), "application/json")
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	a.MaxSpansPerRequest = 0
+	a.MaxTagValueLength = 3
+	w = handleV1(a, buf.Bytes(), "application/json")
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	a.MaxTagValueLength = 0
+	truncated := buf.Bytes()[:buf.Len()-1]
+	w = handleV1(a, truncated, "application/json")
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Empty(ms.spans)
+
+	for _, payload := range []string{"[]", "null"} {
+		w = handleV1(a, []byte(payload), "application/json")
+		assert.Equal(http.StatusAccepted, w.Code, payload)
+	}
+	for _, payload := range []string{"", "{}", `[{"traceId": "1"}`, `[{"traceId": "1"}}`, `[1]`} {
+		w = handleV1(a, []byte(payload), "application/json")
+		assert.Equal(http.StatusBadRequest, w.Code, payload)
+	}
+	assert.Empty(ms.spans)
+
+	// Requests that are mirrored are read in full.
+	m := newMockDownstream()
+	defer m.server.Close()
+	url, _ := url.Parse(m.server.URL)
+	mirror := &Mirror{DownstreamURL: url}
+	assert.NoError(mirror.Start())
+	a.Mirrors = []*Mirror{mirror}
+	a.MaxSpansPerRequest = 2499
+	w = handleV1(a, buf.Bytes(), "application/json")
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	assert.Empty(ms.spans)
+	assert.NoError(mirror.Stop())
+}
+
+// failingSink fails to take spans from its failAfter+1th send on.
+type failingSink struct {
+	failAfter int
+	sends     int
+}
+
+func (fs *failingSink) Send(spans []*types.Span) error {
+	fs.sends++
+	if fs.sends > fs.failAfter {
+		return errors.New("queue full")
+	}
+	return nil
+}
+
+func (fs *failingSink) Start() error { return nil }
+func (fs *failingSink) Stop() error  { return nil }
+
+// TestPartialSend checks that clients are only asked to retry when the Sink
+// took none of their spans.
+func TestPartialSend(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i := 0; i < sinkChunkSize+1; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `{"traceId": "1", "id": "%x"}`, i)
+	}
+	buf.WriteString("]")
+
+	for _, handle := range []func(*App, []byte, string) *httptest.ResponseRecorder{handleV1, handleV2} {
+		sink := &failingSink{}
+		a := &App{Sink: sink}
+		w := handle(a, buf.Bytes(), "application/json")
+		assert.Equal(http.StatusServiceUnavailable, w.Code)
+		assert.Equal("5", w.Header().Get("Retry-After"))
+		assert.Equal(2, sink.sends)
+
+		sink = &failingSink{failAfter: 1}
+		a = &App{Sink: sink}
+		w = handle(a, buf.Bytes(), "application/json")
+		assert.Equal(http.StatusInternalServerError, w.Code)
+		assert.Equal("", w.Header().Get("Retry-After"))
+		assert.Equal(2, sink.sends)
+	}
+}
+
+func TestRequestDecompression(t *testing.T) {
+	assert := assert.New(t)
+	data, err := ioutil.ReadFile("testdata/payload_0.thrift")
+	assert.NoError(err)
+
+	compress := func(newWriter func(io.Writer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	bodies := map[string][]byte{
+		"gzip":    compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }),
+		"deflate": compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }),
+		"zstd":    zstdCompress(data, 3),
+		"snappy":  snappy.Encode(nil, data),
+	}
+	rawDeflate := compress(func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	})
+	framedSnappy := compress(func(w io.Writer) io.WriteCloser { return snappy.NewBufferedWriter(w) })
+
+	for _, tc := range []struct {
+		encoding string
+		body     []byte
+	}{
+		{"gzip", bodies["gzip"]},
+		{"deflate", bodies["deflate"]},
+		{"deflate", rawDeflate},
+		{"zstd", bodies["zstd"]},
+		{"snappy", bodies["snappy"]},
+		{"snappy", framedSnappy},
+		{"ZSTD", bodies["zstd"]},
+	} {
+		ms := &MockSink{}
+		a := &App{Sink: ms}
+		w := handleEncodedV1(a, tc.body, tc.encoding, "application/x-thrift")
+		assert.Equal(http.StatusAccepted, w.Code, tc.encoding)
+		assert.Equal(8, len(ms.spans), tc.encoding)
+	}
+
+	a := &App{Sink: &MockSink{}}
+	w := handleEncodedV1(a, data, "br", "application/x-thrift")
+	assert.Equal(http.StatusUnsupportedMediaType, w.Code)
+	for encoding, body := range bodies {
+		w = handleEncodedV1(a, body[:len(body)/2], encoding, "application/x-thrift")
+		assert.Equal(http.StatusBadRequest, w.Code, encoding)
+	}
+
+	// Bodies that decompress to more than MaxDecompressedSize are rejected
+	// without decompressing them in full.
+	a.MaxDecompressedSize = int64(len(data) - 1)
+	for encoding, body := range bodies {
+		w = handleEncodedV1(a, body, encoding, "application/x-thrift")
+		assert.Equal(http.StatusRequestEntityTooLarge, w.Code, encoding)
+	}
+	a.MaxDecompressedSize = int64(len(data))
+	for encoding, body := range bodies {
+		w = handleEncodedV1(a, body, encoding, "application/x-thrift")
+		assert.Equal(http.StatusAccepted, w.Code, encoding)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	assert := assert.New(t)
+	data, err := ioutil.ReadFile("testdata/payload_0.thrift")
+	assert.NoError(err)
+
+	// Bodies larger than MaxBodySize are rejected whether or not they say how
+	// large they are up front.
+	a := &App{Sink: &MockSink{}, MaxBodySize: int64(len(data) - 1)}
+	for _, contentLength := range []int64{int64(len(data)), -1} {
+		r := httptest.NewRequest("POST", V1Endpoint, bytes.NewReader(data))
+		r.Header.Add("Content-Type", "application/x-thrift")
+		r.ContentLength = contentLength
+		w := httptest.NewRecorder()
+		a.limitWrap(a.decompressWrap(a.handleSpansV1))(w, r)
+		assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+		assert.Equal("request body too large", w.Body.String())
+	}
+	a.MaxBodySize = int64(len(data))
+	w := handleEncodedV1(a, data, "identity", "application/x-thrift")
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	a = &App{Sink: &MockSink{}, MaxSpansPerRequest: 7}
+	w = handleV1(a, data, "application/x-thrift")
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal("request has more than the limit of 7 spans", w.Body.String())
+	a.MaxSpansPerRequest = 8
+	w = handleV1(a, data, "application/x-thrift")
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	payload := []byte(`[{"traceId": "1", "id": "1", "name": "query", "binaryAnnotations": [
+		{"key": "sql", "value": "select"},
+		{"key": "db", "value": "spans"}
+	]}]`)
+	for _, tc := range []struct {
+		app  *App
+		code int
+	}{
+		{&App{MaxTagsPerSpan: 1}, http.StatusRequestEntityTooLarge},
+		{&App{MaxTagsPerSpan: 2}, http.StatusAccepted},
+		{&App{MaxTagValueLength: 5}, http.StatusRequestEntityTooLarge},
+		{&App{MaxTagValueLength: 6}, http.StatusAccepted},
+	} {
+		ms := &MockSink{}
+		tc.app.Sink = ms
+		w = handleV1(tc.app, payload, "application/json")
+		assert.Equal(tc.code, w.Code, "%+v", tc.app)
+		assert.Equal(tc.code == http.StatusAccepted, len(ms.spans) == 1)
+	}
+
+	// Lists that claim to be much larger than the request are rejected
+	// without allocating space for them.
+	a = &App{Sink: &MockSink{}}
+	for _, body := range [][]byte{
+		{byte(thrift.STRUCT), 0x7f, 0xff, 0xff, 0xff},
+		// One span, whose annotations field is a list of 2^31-1 structs.
+		{byte(thrift.STRUCT), 0, 0, 0, 1, byte(thrift.LIST), 0, 6, byte(thrift.STRUCT), 0x7f, 0xff, 0xff, 0xff},
+	} {
+		w = handleV1(a, body, "application/x-thrift")
+		assert.Equal(http.StatusBadRequest, w.Code)
+	}
+}
+
 // TestMirroring tests the mirroring of unmodified request data to a downstream
 // service.
 func TestMirroring(t *testing.T) {
@@ -253,8 +525,8 @@ func TestMirroring(t *testing.T) {
 	mirror.Start()
 
 	a := &App{
-		Sink:   ms,
-		Mirror: mirror,
+		Sink:    ms,
+		Mirrors: []*Mirror{mirror},
 	}
 	a.Start()
 	defer a.Stop()
@@ -275,6 +547,205 @@ func TestMirroring(t *testing.T) {
 	assert.Equal(m.payloads[0].ContentType, "application/x-thrift")
 }
 
+// TestMirrorShutdown tests that stopping the mirror sends queued payloads, and
+// reports those it couldn't send before the deadline.
+func TestMirrorShutdown(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	url, err := url.Parse(server.URL)
+	assert.NoError(err)
+	mirror := &Mirror{
+		DownstreamURL:  url,
+		MaxConcurrency: 1,
+	}
+	mirror.Start()
+	for i := 0; i < 3; i++ {
+		assert.NoError(mirror.Send(payload{Endpoint: V1Endpoint, Body: []byte("{}")}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = mirror.Shutdown(ctx)
+	assert.Error(err)
+	assert.Contains(err.Error(), "3 payloads weren't sent downstream")
+	assert.Error(mirror.Send(payload{Endpoint: V1Endpoint, Body: []byte("{}")}))
+}
+
+// TestMirrorDiskBuffer tests that payloads buffered on disk while the
+// downstream host is failing are sent once a new mirror is started.
+func TestMirrorDiskBuffer(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "buffer")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	url, err := url.Parse(failing.URL)
+	assert.NoError(err)
+	mirror := &Mirror{DownstreamURL: url, BufferDir: dir}
+	assert.NoError(mirror.Start())
+	for _, body := range []string{"first", "second"} {
+		assert.NoError(mirror.Send(payload{Endpoint: V1Endpoint, ContentType: "application/json", Body: []byte(body)}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = mirror.Shutdown(ctx)
+	assert.Error(err)
+	assert.Contains(err.Error(), "2 payloads weren't sent downstream, and remain in the disk buffer")
+
+	m := newMockDownstream()
+	defer m.server.Close()
+	url, err = url.Parse(m.server.URL)
+	assert.NoError(err)
+	mirror = &Mirror{DownstreamURL: url, BufferDir: dir, MaxConcurrency: 1}
+	assert.NoError(mirror.Start())
+	assert.NoError(mirror.Stop())
+	assert.Equal(2, len(m.payloads))
+	assert.Equal([]byte("first"), m.payloads[0].Body)
+	assert.Equal([]byte("second"), m.payloads[1].Body)
+	assert.Equal("application/json", m.payloads[1].ContentType)
+}
+
+// TestMirrorDiskBufferConcurrency tests that payloads in the disk buffer are
+// sent up to MaxConcurrency at a time.
+func TestMirrorDiskBufferConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "buffer")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	inFlight, maxInFlight, received := 0, 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		received++
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	url, err := url.Parse(server.URL)
+	assert.NoError(err)
+
+	mirror := &Mirror{DownstreamURL: url, BufferDir: dir, MaxConcurrency: 4}
+	assert.NoError(mirror.Start())
+	for i := 0; i < 8; i++ {
+		assert.NoError(mirror.Send(payload{Endpoint: V1Endpoint, Body: []byte("{}")}))
+	}
+	assert.NoError(mirror.Stop())
+	assert.Equal(8, received)
+	assert.True(maxInFlight > 1 && maxInFlight <= 4, "%d requests in flight", maxInFlight)
+}
+
+// countingDownstream returns a server that responds to the first len(codes)
+// requests with the given status codes, and with a 202 after that, and a
+// function returning the number of requests it has received.
+func countingDownstream(codes ...int) (*httptest.Server, func() int) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		code := http.StatusAccepted
+		if requests < len(codes) {
+			code = codes[requests]
+		}
+		requests++
+		w.WriteHeader(code)
+	}))
+	return server, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+// TestMirrorRetries tests that payloads are retried after temporary errors,
+// but not after other errors.
+func TestMirrorRetries(t *testing.T) {
+	assert := assert.New(t)
+	server, requests := countingDownstream(http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadRequest)
+	defer server.Close()
+	url, err := url.Parse(server.URL)
+	assert.NoError(err)
+	mirror := &Mirror{
+		DownstreamURL:  url,
+		MaxConcurrency: 1,
+		MaxRetries:     3,
+		MinBackoff:     time.Millisecond,
+	}
+	mirror.Start()
+	assert.NoError(mirror.Send(payload{Endpoint: V1Endpoint, Body: []byte("{}")}))
+	mirror.Stop()
+	assert.Equal(3, requests())
+}
+
+// TestMirrorCircuitBreaker tests that the mirror stops sending to a
+// downstream host that keeps failing.
+func TestMirrorCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	codes := make([]int, 100)
+	for i := range codes {
+		codes[i] = http.StatusInternalServerError
+	}
+	server, requests := countingDownstream(codes...)
+	defer server.Close()
+	url, err := url.Parse(server.URL)
+	assert.NoError(err)
+	mirror := &Mirror{
+		DownstreamURL:    url,
+		MaxConcurrency:   1,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+	}
+	mirror.Start()
+	for i := 0; i < 5; i++ {
+		assert.NoError(mirror.Send(payload{Endpoint: V1Endpoint, Body: []byte("{}")}))
+	}
+	mirror.Stop()
+	assert.Equal(2, requests())
+}
+
+func TestBreaker(t *testing.T) {
+	assert := assert.New(t)
+	b := &breaker{threshold: 2, cooldown: 10 * time.Millisecond}
+	assert.True(b.allow())
+	b.record(false)
+	assert.True(b.allow())
+	b.record(false)
+	assert.False(b.allow())
+
+	// After the cooldown, a single probe is allowed through.
+	time.Sleep(20 * time.Millisecond)
+	assert.True(b.allow())
+	assert.False(b.allow())
+	b.record(false)
+	assert.False(b.allow())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(b.allow())
+	b.record(true)
+	assert.True(b.allow())
+	assert.True(b.allow())
+}
+
 // TestMirroringV2 tests the mirroring of unmodified request data to a downstream
 // service for a Zipkin API V2 JSON payload.
 func TestMirroringV2(t *testing.T) {
@@ -292,8 +763,8 @@ func TestMirroringV2(t *testing.T) {
 	mirror.Start()
 
 	a := &App{
-		Sink:   ms,
-		Mirror: mirror,
+		Sink:    ms,
+		Mirrors: []*Mirror{mirror},
 	}
 	a.Start()
 	defer a.Stop()
@@ -314,6 +785,287 @@ func TestMirroringV2(t *testing.T) {
 	assert.Equal(m.payloads[0].ContentType, "application/json")
 }
 
+// TestMirrorFilters tests that each mirror only receives the requests that
+// match its filters.
+func TestMirrorFilters(t *testing.T) {
+	assert := assert.New(t)
+	all := newMockDownstream()
+	defer all.server.Close()
+	checkout := newMockDownstream()
+	defer checkout.server.Close()
+	var headers []string
+	v1Only := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get("X-Team"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer v1Only.Close()
+
+	allURL, _ := url.Parse(all.server.URL)
+	checkoutURL, _ := url.Parse(checkout.server.URL)
+	v1OnlyURL, _ := url.Parse(v1Only.URL)
+	mirrors := []*Mirror{
+		{Name: "all", DownstreamURL: allURL},
+		{Name: "checkout", DownstreamURL: checkoutURL, Services: []string{"checkout"}},
+		{Name: "v1", DownstreamURL: v1OnlyURL, Endpoints: []string{V1Endpoint}, Headers: map[string]string{"X-Team": "tracing"}},
+	}
+	for _, m := range mirrors {
+		assert.NoError(m.Start())
+	}
+	a := &App{Sink: &MockSink{}, Mirrors: mirrors}
+
+	span := func(service string) []byte {
+		return []byte(`[{"traceId": "1", "id": "1", "name": "get", "localEndpoint": {"serviceName": "` + service + `"}}]`)
+	}
+	assert.Equal(http.StatusAccepted, handleV2(a, span("checkout"), "application/json").Code)
+	assert.Equal(http.StatusAccepted, handleV2(a, span("search"), "application/json").Code)
+	// Requests that can't be decoded only go to mirrors without a service
+	// filter.
+	assert.Equal(http.StatusBadRequest, handleV1(a, []byte("{}"), "text/plain").Code)
+	for _, m := range mirrors {
+		assert.NoError(m.Stop())
+	}
+
+	assert.Equal(3, len(all.payloads))
+	if assert.Equal(1, len(checkout.payloads)) {
+		assert.Equal(span("checkout"), checkout.payloads[0].Body)
+	}
+	assert.Equal([]string{"tracing"}, headers)
+}
+
+// TestMirrorTLSAndAuth tests that the mirror trusts its CA file, sends
+// credentials read from files, and reuses connections.
+func TestMirrorTLSAndAuth(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		mu            sync.Mutex
+		authorization []string
+		connections   int
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authorization = append(authorization, r.Header.Get("Authorization")+" "+r.Header.Get("X-Team"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			connections++
+			mu.Unlock()
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "mirror")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	assert.NoError(ioutil.WriteFile(caFile, cert, 0600))
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600))
+
+	url, _ := url.Parse(server.URL)
+	mirror := &Mirror{
+		DownstreamURL:   url,
+		MaxConcurrency:  1,
+		CAFile:          caFile,
+		BearerTokenFile: tokenFile,
+		Headers:         map[string]string{"X-Team": "tracing"},
+	}
+	assert.NoError(mirror.Start())
+	for i := 0; i < 3; i++ {
+		assert.NoError(mirror.Send(payload{Endpoint: V1Endpoint, Body: []byte("{}")}))
+	}
+	assert.NoError(mirror.Stop())
+	mu.Lock()
+	assert.Equal([]string{"Bearer secret tracing", "Bearer secret tracing", "Bearer secret tracing"}, authorization)
+	assert.Equal(1, connections)
+	mu.Unlock()
+
+	mirror = &Mirror{DownstreamURL: url, BasicAuthUser: "proxy", BasicAuthPasswordFile: tokenFile}
+	assert.NoError(mirror.Start())
+	auth, err := mirror.readAuthorization()
+	assert.NoError(err)
+	assert.Equal("Basic cHJveHk6c2VjcmV0", auth)
+	assert.NoError(mirror.Stop())
+
+	// Without the CA file, the server's certificate isn't trusted.
+	mirror = &Mirror{DownstreamURL: url}
+	assert.NoError(mirror.Start())
+	assert.Error(mirror.send(context.Background(), payload{Endpoint: V1Endpoint}))
+	assert.NoError(mirror.Stop())
+
+	assert.Error((&Mirror{DownstreamURL: url, CAFile: tokenFile}).Start())
+	assert.Error((&Mirror{DownstreamURL: url, CertFile: caFile}).Start())
+}
+
+type tagProcessor struct{}
+
+func (tagProcessor) Process(s *types.Span) {
+	s.BinaryAnnotations["processed"] = true
+}
+
+// TestMirrorFormats tests that mirrors re-encode spans in their format after
+// they've been processed.
+func TestMirrorFormats(t *testing.T) {
+	assert := assert.New(t)
+	data, err := ioutil.ReadFile("testdata/payload_0.thrift")
+	assert.NoError(err)
+	original, err := v1.DecodeThrift(bytes.NewReader(data))
+	assert.NoError(err)
+
+	var mirrors []*Mirror
+	downstreams := make(map[string]*mockDownstream)
+	for _, format := range []string{FormatV1JSON, FormatV2JSON, FormatV2Proto} {
+		m := newMockDownstream()
+		defer m.server.Close()
+		downstreams[format] = m
+		url, _ := url.Parse(m.server.URL)
+		mirror := &Mirror{Name: format, DownstreamURL: url, Format: format}
+		assert.NoError(mirror.Start())
+		mirrors = append(mirrors, mirror)
+	}
+	a := &App{Sink: &MockSink{}, Mirrors: mirrors, Processor: tagProcessor{}}
+	assert.Equal(http.StatusAccepted, handleV1(a, data, "application/x-thrift").Code)
+	assert.Equal(http.StatusBadRequest, handleV1(a, []byte("bogus"), "application/x-thrift").Code)
+	for _, m := range mirrors {
+		assert.NoError(m.Stop())
+	}
+
+	check := func(spans []*types.Span, err error) {
+		assert.NoError(err)
+		if !assert.Equal(len(original), len(spans)) {
+			return
+		}
+		for i, s := range spans {
+			assert.Equal(original[i].TraceID, s.TraceID)
+			assert.Equal(original[i].ID, s.ID)
+			assert.Equal(original[i].Name, s.Name)
+			assert.Equal(original[i].ServiceName, s.ServiceName)
+			assert.Equal(original[i].DurationMs, s.DurationMs)
+			assert.Equal(original[i].Timestamp, s.Timestamp)
+			assert.Contains([]interface{}{true, "true"}, s.BinaryAnnotations["processed"])
+		}
+	}
+	if p := downstreams[FormatV1JSON].payloads; assert.Equal(1, len(p)) {
+		assert.Equal(V1Endpoint, p[0].Endpoint)
+		assert.Equal("application/json", p[0].ContentType)
+		check(v1.DecodeJSON(bytes.NewReader(p[0].Body)))
+	}
+	if p := downstreams[FormatV2JSON].payloads; assert.Equal(1, len(p)) {
+		assert.Equal(V2Endpoint, p[0].Endpoint)
+		assert.Equal("application/json", p[0].ContentType)
+		check(v2.DecodeJSON(bytes.NewReader(p[0].Body)))
+	}
+	if p := downstreams[FormatV2Proto].payloads; assert.Equal(1, len(p)) {
+		assert.Equal(V2Endpoint, p[0].Endpoint)
+		assert.Equal("application/x-protobuf", p[0].ContentType)
+		assert.NotEmpty(p[0].Body)
+	}
+
+	body, err := v2.EncodeProto([]*types.Span{{
+		CoreSpanMetadata: types.CoreSpanMetadata{TraceID: "1", ID: "2", Name: "a"},
+	}})
+	assert.NoError(err)
+	assert.Equal([]byte{
+		0x0a, 0x17, // spans
+		0x0a, 0x08, 0, 0, 0, 0, 0, 0, 0, 1, // trace_id
+		0x1a, 0x08, 0, 0, 0, 0, 0, 0, 0, 2, // id
+		0x2a, 0x01, 'a', // name
+	}, body)
+}
+
+func TestMirrorCompression(t *testing.T) {
+	assert := assert.New(t)
+	data, err := ioutil.ReadFile("testdata/payload_0.thrift")
+	assert.NoError(err)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(data)
+	zw.Close()
+
+	var mirrors []*Mirror
+	downstreams := make(map[string]*mockDownstream)
+	for _, mirror := range []*Mirror{
+		{Name: "none"},
+		{Name: "gzip", Compression: CompressionGzip},
+		{Name: "zstd", Compression: CompressionZstd, CompressionLevel: 9},
+		{Name: "v2_json_gzip", Format: FormatV2JSON, Compression: CompressionGzip, CompressionLevel: 1},
+	} {
+		m := newMockDownstream()
+		defer m.server.Close()
+		downstreams[mirror.Name] = m
+		mirror.DownstreamURL, _ = url.Parse(m.server.URL)
+		// Send payloads one at a time, so that they arrive in order.
+		mirror.MaxConcurrency = 1
+		assert.NoError(mirror.Start())
+		mirrors = append(mirrors, mirror)
+	}
+	a := &App{Sink: &MockSink{}, Mirrors: mirrors}
+	assert.Equal(http.StatusAccepted, handleGzippedV1(a, data, "application/x-thrift").Code)
+	assert.Equal(http.StatusAccepted, handleV1(a, data, "application/x-thrift").Code)
+	zstdBody := zstdCompress(data, 1)
+	assert.Equal(http.StatusAccepted, handleEncodedV1(a, zstdBody, "zstd", "application/x-thrift").Code)
+	for _, m := range mirrors {
+		assert.NoError(m.Stop())
+	}
+
+	// Verbatim bodies are sent uncompressed, or as received if they were
+	// compressed the same way.
+	if p := downstreams["none"].payloads; assert.Equal(3, len(p)) {
+		for _, payload := range p {
+			assert.Equal("", payload.ContentEncoding)
+			assert.Equal(data, payload.Body)
+		}
+	}
+	if p := downstreams["gzip"].payloads; assert.Equal(3, len(p)) {
+		assert.Equal("gzip", p[0].ContentEncoding)
+		assert.Equal(gzipped.Bytes(), p[0].Body)
+		assert.Equal("gzip", p[1].ContentEncoding)
+		r, err := gzip.NewReader(bytes.NewReader(p[1].Body))
+		assert.NoError(err)
+		body, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(data, body)
+	}
+	if p := downstreams["zstd"].payloads; assert.Equal(3, len(p)) {
+		for _, payload := range p {
+			assert.Equal("zstd", payload.ContentEncoding)
+			assert.Equal("application/x-thrift", payload.ContentType)
+			body, err := zstdDecompress(payload.Body)
+			assert.NoError(err)
+			assert.Equal(data, body)
+		}
+		assert.Equal(zstdBody, p[2].Body)
+	}
+	if p := downstreams["v2_json_gzip"].payloads; assert.Equal(3, len(p)) {
+		assert.Equal("gzip", p[0].ContentEncoding)
+		r, err := gzip.NewReader(bytes.NewReader(p[0].Body))
+		assert.NoError(err)
+		spans, err := v2.DecodeJSON(r)
+		assert.NoError(err)
+		assert.NotEmpty(spans)
+	}
+
+	// Compressed bodies are only kept as received if a mirror can use them.
+	a = &App{Mirrors: []*Mirror{{Compression: CompressionGzip}, {Format: FormatV2JSON, Compression: CompressionZstd}}}
+	assert.True(a.passthrough(CompressionGzip))
+	assert.False(a.passthrough(CompressionZstd))
+	assert.False(a.passthrough("deflate"))
+	assert.False((&App{}).passthrough(CompressionGzip))
+
+	for _, mirror := range []*Mirror{
+		{Compression: "brotli"},
+		{Compression: CompressionGzip, CompressionLevel: 10},
+		{Compression: CompressionZstd, CompressionLevel: -1},
+	} {
+		mirror.DownstreamURL, _ = url.Parse("http://localhost:9411")
+		assert.Error(mirror.Start())
+	}
+}
+
 // Test that we still forward span data even when the "mirror" (e.g., a real
 // Zipkin installation that should also receive the Zipkin data) is
 // unavailable.
@@ -324,8 +1076,8 @@ func TestMirroringWhenDestinationUnavailable(t *testing.T) {
 	mirror.Start()
 	defer mirror.Stop()
 	a := &App{
-		Sink:   &MockSink{},
-		Mirror: mirror,
+		Sink:    &MockSink{},
+		Mirrors: []*Mirror{mirror},
 	}
 	a.Start()
 	defer a.Stop()
@@ -343,12 +1095,7 @@ func TestMirroringWhenDestinationUnavailable(t *testing.T) {
 func TestHoneycombOutputV1(t *testing.T) {
 	mockHoneycomb := &libhoney.MockOutput{}
 	assert := assert.New(t)
-	libhoney.Init(libhoney.Config{
-		WriteKey: "test",
-		Dataset:  "test",
-		Output:   mockHoneycomb,
-	})
-	a := &App{Sink: &sinks.HoneycombSink{}}
+	a := &App{Sink: startHoneycombSink(&sinks.HoneycombSink{}, mockHoneycomb)}
 
 	jsonPayload := `[{
 				"traceId":     "350565b6a90d4c8c",
@@ -397,12 +1144,7 @@ func TestHoneycombOutputV1(t *testing.T) {
 func TestHoneycombOutputV2(t *testing.T) {
 	mockHoneycomb := &libhoney.MockOutput{}
 	assert := assert.New(t)
-	libhoney.Init(libhoney.Config{
-		WriteKey: "test",
-		Dataset:  "test",
-		Output:   mockHoneycomb,
-	})
-	a := &App{Sink: &sinks.HoneycombSink{}}
+	a := &App{Sink: startHoneycombSink(&sinks.HoneycombSink{}, mockHoneycomb)}
 
 	jsonPayload := `[{
 				"traceId":     "350565b6a90d4c8c",
@@ -488,15 +1230,8 @@ func TestHoneycombSinkTagHandlingV1(t *testing.T) {
 	err := json.Unmarshal([]byte(sampleSpanJSON), &sampleSpan)
 	assert.NoError(err)
 
-	sink := &sinks.HoneycombSink{DropFields: []string{"keyToDrop"}}
-	sink.Start()
-
 	mockHoneycomb := &libhoney.MockOutput{}
-	libhoney.Init(libhoney.Config{
-		WriteKey: "test",
-		Dataset:  "test",
-		Output:   mockHoneycomb,
-	})
+	sink := startHoneycombSink(&sinks.HoneycombSink{DropFields: []string{"keyToDrop"}}, mockHoneycomb)
 
 	a := &App{Sink: sink}
 
@@ -523,7 +1258,7 @@ func TestHoneycombSinkTagHandlingV1(t *testing.T) {
 	assert.NoError(err)
 	w = handleGzippedV1(a, payload, "application/json")
 	assert.Equal(w.Code, http.StatusAccepted)
-	libhoney.Close()
+	sink.Stop()
 	assert.Equal(mockHoneycomb.Events()[1].Dataset, "write-traces")
 	assert.Equal(mockHoneycomb.Events()[1].SampleRate, uint(1))
 }
@@ -553,15 +1288,8 @@ func TestHoneycombSinkTagHandlingV2(t *testing.T) {
 	err := json.Unmarshal([]byte(sampleSpanJSON), &sampleSpan)
 	assert.NoError(err)
 
-	sink := &sinks.HoneycombSink{DropFields: []string{"keyToDrop"}}
-	sink.Start()
-
 	mockHoneycomb := &libhoney.MockOutput{}
-	libhoney.Init(libhoney.Config{
-		WriteKey: "test",
-		Dataset:  "test",
-		Output:   mockHoneycomb,
-	})
+	sink := startHoneycombSink(&sinks.HoneycombSink{DropFields: []string{"keyToDrop"}}, mockHoneycomb)
 
 	a := &App{Sink: sink}
 
@@ -590,7 +1318,7 @@ func TestHoneycombSinkTagHandlingV2(t *testing.T) {
 	assert.NoError(err)
 	w = handleGzippedV2(a, payload, "application/json")
 	assert.Equal(w.Code, http.StatusAccepted)
-	libhoney.Close()
+	sink.Stop()
 	assert.Equal(mockHoneycomb.Events()[1].Dataset, "write-traces")
 	assert.Equal(mockHoneycomb.Events()[1].SampleRate, uint(1))
 }
@@ -600,11 +1328,6 @@ func TestSampling(t *testing.T) {
 	assert := assert.New(t)
 
 	mockHoneycomb := &libhoney.MockOutput{}
-	libhoney.Init(libhoney.Config{
-		WriteKey: "test",
-		Dataset:  "test",
-		Output:   mockHoneycomb,
-	})
 
 	downstream := newMockDownstream()
 	defer downstream.server.Close()
@@ -616,8 +1339,8 @@ func TestSampling(t *testing.T) {
 	mirror.Start()
 
 	a := &App{
-		Sink:   &sinks.HoneycombSink{SampleRate: 10},
-		Mirror: mirror,
+		Sink:    startHoneycombSink(&sinks.HoneycombSink{SampleRate: 10}, mockHoneycomb),
+		Mirrors: []*Mirror{mirror},
 	}
 
 	// Construct 30 traces of 10 spans each.
@@ -654,6 +1377,286 @@ func TestSampling(t *testing.T) {
 	}
 }
 
+// Test that per-service sample rates and datasets override the defaults, and
+// can be changed while the sink is running.
+func TestServiceSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	mockHoneycomb := &libhoney.MockOutput{}
+	sink := startHoneycombSink(&sinks.HoneycombSink{
+		SampleRate:         10,
+		ServiceSampleRates: map[string]uint{"checkout": 1},
+		ServiceDatasets:    map[string]string{"checkout": "checkout-traces"},
+	}, mockHoneycomb)
+	a := &App{Sink: sink}
+
+	sendTraces := func(service string) {
+		for traceID := int64(0); traceID < 10; traceID++ {
+			span := &zipkincore.Span{
+				TraceID: traceID,
+				ID:      1,
+				Name:    "someSpan",
+				Annotations: []*zipkincore.Annotation{{
+					Value: "sr",
+					Host:  &zipkincore.Endpoint{ServiceName: service},
+				}},
+			}
+			w := handleGzippedV1(a, serializeThriftSpans([]*zipkincore.Span{span}), "application/x-thrift")
+			assert.Equal(w.Code, http.StatusAccepted)
+		}
+	}
+
+	sendTraces("checkout")
+	sendTraces("search")
+	events := mockHoneycomb.Events()
+	assert.Equal(11, len(events))
+	for _, ev := range events[:10] {
+		assert.Equal("checkout-traces", ev.Dataset)
+		assert.Equal(uint(1), ev.SampleRate)
+	}
+	assert.Equal("test", events[10].Dataset)
+	assert.Equal(uint(10), events[10].SampleRate)
+
+	settings := sink.Settings()
+	settings.ServiceSampleRates = map[string]uint{"search": 1}
+	sink.SetSettings(settings)
+	sendTraces("search")
+	assert.Equal(21, len(mockHoneycomb.Events()))
+}
+
+// metricValue returns the current value of a series in the default registry,
+// e.g. `proxy_requests_total{endpoint="/api/v2/spans",code="202"}`, or 0 if
+// it hasn't been recorded yet. The registry is shared by every test, so tests
+// compare values from before and after what they check.
+func metricValue(series string) float64 {
+	w := httptest.NewRecorder()
+	metrics.DefaultRegistry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			value, _ := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			return value
+		}
+	}
+	return 0
+}
+
+// TestHoneycombSinkMetrics checks that Honeycomb metrics are labelled with the
+// name of the sink, so that several sinks can be told apart.
+func TestHoneycombSinkMetrics(t *testing.T) {
+	assert := assert.New(t)
+	events := `proxy_honeycomb_events_total{sink="eu"}`
+	sampled := `proxy_spans_sampled_out_total{sink="eu"}`
+	before := map[string]float64{events: metricValue(events), sampled: metricValue(sampled)}
+
+	hs := startHoneycombSink(&sinks.HoneycombSink{Name: "eu", ServiceSampleRates: map[string]uint{"noisy": 1 << 30}}, &libhoney.MockOutput{})
+	defer hs.Stop()
+	a := &App{Sink: hs}
+	w := handleV2(a, []byte(`[{"traceId": "1", "id": "1", "localEndpoint": {"serviceName": "checkout"}},
+		{"traceId": "2", "id": "2", "localEndpoint": {"serviceName": "noisy"}}]`), "application/json")
+	assert.Equal(http.StatusAccepted, w.Code)
+	assert.Equal(before[events]+1, metricValue(events))
+	assert.Equal(before[sampled]+1, metricValue(sampled))
+}
+
+// TestSelfInstrumentation checks that the proxy's internal metrics are updated
+// as spans are received.
+func TestSelfInstrumentation(t *testing.T) {
+	assert := assert.New(t)
+	a := &App{Sink: &MockSink{}}
+	requests := `proxy_requests_total{endpoint="/api/v2/spans",code="202"}`
+	received := `proxy_spans_received_total{endpoint="/api/v2/spans",content_type="application/json"}`
+	decodeErrors := `proxy_decode_errors_total{endpoint="/api/v2/spans",content_type="application/json"}`
+	before := map[string]float64{}
+	for _, series := range []string{requests, received, decodeErrors} {
+		before[series] = metricValue(series)
+	}
+
+	r := httptest.NewRequest("POST", V2Endpoint, bytes.NewReader([]byte(`[{"traceId": "1", "id": "1"}, {"traceId": "1", "id": "2"}]`)))
+	r.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	instrumentWrap(V2Endpoint, a.handleSpansV2)(w, r)
+	assert.Equal(http.StatusAccepted, w.Code)
+	w = handleV2(a, []byte("{"), "application/json")
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	assert.Equal(1.0, metricValue(requests)-before[requests])
+	assert.Equal(2.0, metricValue(received)-before[received])
+	assert.Equal(1.0, metricValue(decodeErrors)-before[decodeErrors])
+}
+
+type mockReadySink struct {
+	MockSink
+	err error
+}
+
+func (ms *mockReadySink) Ready() error { return ms.err }
+
+func TestHealthEndpoints(t *testing.T) {
+	assert := assert.New(t)
+	sink := &mockReadySink{err: errors.New("sink still starting")}
+	url, _ := url.Parse("http://localhost:9")
+	mirror := &Mirror{DownstreamURL: url, BufSize: 2, MaxConcurrency: 1, MaxBufferFill: 0.5}
+	a := &App{Sink: sink, Mirrors: []*Mirror{mirror}}
+
+	check := func(hf http.HandlerFunc, code int, body string) {
+		w := httptest.NewRecorder()
+		hf(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(code, w.Code)
+		assert.Equal(body, w.Body.String())
+	}
+
+	check(a.handleHealthz, http.StatusOK, "ok")
+	check(a.handleReadyz, http.StatusServiceUnavailable, "sink still starting")
+	sink.err = nil
+	check(a.handleReadyz, http.StatusServiceUnavailable, "mirror not started")
+
+	// Fill the mirror's queue without any workers to drain it.
+	mirror.payloads = make(chan payload, mirror.BufSize)
+	check(a.handleReadyz, http.StatusOK, "ok")
+	mirror.Send(payload{})
+	check(a.handleReadyz, http.StatusServiceUnavailable, "mirror queue has 1 of 2 payloads")
+	check(a.handleHealthz, http.StatusOK, "ok")
+}
+
+type mockQueueSink struct {
+	MockSink
+	fill       float64
+	bufferFill float64
+	err        error
+}
+
+func (ms *mockQueueSink) QueueFill() float64 { return ms.fill }
+
+func (ms *mockQueueSink) BufferFill() float64 { return ms.bufferFill }
+
+func (ms *mockQueueSink) Send(spans []*types.Span) error {
+	if ms.err != nil {
+		return ms.err
+	}
+	return ms.MockSink.Send(spans)
+}
+
+func TestBackpressure(t *testing.T) {
+	assert := assert.New(t)
+	sink := &mockQueueSink{}
+	mirror := &Mirror{BufSize: 10}
+	mirror.payloads = make(chan payload, mirror.BufSize)
+	a := &App{
+		Sink:                 sink,
+		Mirrors:              []*Mirror{mirror},
+		ThrottleQueueFill:    0.5,
+		UnavailableQueueFill: 0.9,
+		RetryAfter:           1500 * time.Millisecond,
+	}
+
+	for _, tc := range []struct {
+		sinkFill, bufferFill float64
+		mirrored             int
+		code                 int
+	}{
+		{0, 0, 0, http.StatusAccepted},
+		{0.4, 0, 4, http.StatusAccepted},
+		{0.5, 0, 0, http.StatusTooManyRequests},
+		{0.95, 0, 0, http.StatusServiceUnavailable},
+		// Without mirror or buffer thresholds, a full mirror queue or disk
+		// buffer doesn't hold up requests; the mirror drops payloads
+		// instead.
+		{0.2, 0, 6, http.StatusAccepted},
+		{0.2, 0, 10, http.StatusAccepted},
+		{0.2, 1, 0, http.StatusAccepted},
+	} {
+		sink.fill, sink.bufferFill = tc.sinkFill, tc.bufferFill
+		for len(mirror.payloads) > 0 {
+			<-mirror.payloads
+		}
+		for i := 0; i < tc.mirrored; i++ {
+			mirror.Send(payload{})
+		}
+		r := httptest.NewRequest("POST", V2Endpoint, bytes.NewReader([]byte(`[{"traceId": "1", "id": "1"}]`)))
+		r.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		a.backpressureWrap(a.handleSpansV2)(w, r)
+		assert.Equal(tc.code, w.Code, "%+v", tc)
+		if tc.code == http.StatusAccepted {
+			assert.Equal("", w.Header().Get("Retry-After"))
+		} else {
+			assert.Equal("2", w.Header().Get("Retry-After"))
+		}
+	}
+
+	// Mirror queues and disk buffers count once they have thresholds, and the
+	// fullest queue decides the status.
+	a.MirrorThrottleQueueFill, a.MirrorUnavailableQueueFill = 0.5, 0.9
+	a.ThrottleBufferFill, a.UnavailableBufferFill = 0.6, 0.8
+	for _, tc := range []struct {
+		sinkFill, bufferFill float64
+		mirrored             int
+		code                 int
+		message              string
+	}{
+		{0, 0, 4, http.StatusAccepted, ""},
+		{0, 0, 6, http.StatusTooManyRequests, "mirror queue is 60% full"},
+		{0, 0, 9, http.StatusServiceUnavailable, "mirror queue is 90% full"},
+		{0, 0.7, 0, http.StatusTooManyRequests, "disk buffer is 70% full"},
+		{0, 0.8, 0, http.StatusServiceUnavailable, "disk buffer is 80% full"},
+		{0.5, 0.8, 0, http.StatusServiceUnavailable, "disk buffer is 80% full"},
+	} {
+		sink.fill, sink.bufferFill = tc.sinkFill, tc.bufferFill
+		for len(mirror.payloads) > 0 {
+			<-mirror.payloads
+		}
+		for i := 0; i < tc.mirrored; i++ {
+			mirror.Send(payload{})
+		}
+		r := httptest.NewRequest("POST", V2Endpoint, bytes.NewReader([]byte(`[{"traceId": "1", "id": "1"}]`)))
+		r.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		a.backpressureWrap(a.handleSpansV2)(w, r)
+		assert.Equal(tc.code, w.Code, "%+v", tc)
+		if tc.message != "" {
+			assert.Equal(tc.message, w.Body.String())
+		}
+	}
+	a.MirrorThrottleQueueFill, a.MirrorUnavailableQueueFill = 0, 0
+	a.ThrottleBufferFill, a.UnavailableBufferFill = 0, 0
+	sink.bufferFill = 0
+
+	// Spans that the Sink fails to take should be retried too, and aren't
+	// mirrored, so that the retry doesn't mirror them twice.
+	sink.fill = 0
+	sink.err = errors.New("sink stopped")
+	for len(mirror.payloads) > 0 {
+		<-mirror.payloads
+	}
+	w := handleV2(a, []byte(`[{"traceId": "1", "id": "1"}]`), "application/json")
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal("2", w.Header().Get("Retry-After"))
+	assert.Equal(0, len(mirror.payloads))
+}
+
+func TestSinkErrors(t *testing.T) {
+	assert := assert.New(t)
+	required, bestEffort := &mockQueueSink{}, &mockQueueSink{}
+	sink := &sinks.CompositeSink{}
+	sink.Add("required", required)
+	sink.AddBestEffort("best_effort", bestEffort)
+	a := &App{Sink: sink}
+	payload := []byte(`[{"traceId": "1", "id": "1"}, {"traceId": "1", "id": "2"}]`)
+	bestEffortErrors := metricValue(`proxy_sink_errors_total{sink="best_effort"}`)
+	requiredErrors := metricValue(`proxy_sink_errors_total{sink="required"}`)
+
+	assert.Equal(http.StatusAccepted, handleV2(a, payload, "application/json").Code)
+	// Requests are accepted if only best-effort sinks fail.
+	bestEffort.err = errors.New("stdout closed")
+	assert.Equal(http.StatusAccepted, handleV2(a, payload, "application/json").Code)
+	required.err = &sinks.SendError{Accepted: 1, Failed: 1, Err: errors.New("queue overflow")}
+	assert.Equal(http.StatusServiceUnavailable, handleV2(a, payload, "application/json").Code)
+	assert.Equal(4, len(required.spans))
+
+	assert.Equal(2.0, metricValue(`proxy_sink_errors_total{sink="best_effort"}`)-bestEffortErrors)
+	assert.Equal(1.0, metricValue(`proxy_sink_errors_total{sink="required"}`)-requiredErrors)
+}
+
 type mockDownstream struct {
 	server   *httptest.Server
 	payloads []payload
@@ -673,9 +1676,10 @@ func newMockDownstream() *mockDownstream {
 			data, _ := ioutil.ReadAll(r.Body)
 			m.Lock()
 			m.payloads = append(m.payloads, payload{
-				Endpoint:    r.URL.Path,
-				ContentType: r.Header.Get("Content-Type"),
-				Body:        data,
+				Endpoint:        r.URL.Path,
+				ContentType:     r.Header.Get("Content-Type"),
+				ContentEncoding: r.Header.Get("Content-Encoding"),
+				Body:            data,
 			})
 			m.Unlock()
 			w.WriteHeader(http.StatusAccepted)
@@ -699,6 +1703,15 @@ func handleV2(a *App, payload []byte, contentType string) *httptest.ResponseReco
 	return w
 }
 
+func handleEncodedV1(a *App, payload []byte, encoding, contentType string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", V1Endpoint, bytes.NewReader(payload))
+	r.Header.Add("Content-Encoding", encoding)
+	r.Header.Add("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	a.limitWrap(a.decompressWrap(a.handleSpansV1))(w, r)
+	return w
+}
+
 func handleGzippedV1(a *App, payload []byte, contentType string) *httptest.ResponseRecorder {
 	var compressedPayload bytes.Buffer
 	zw := gzip.NewWriter(&compressedPayload)
@@ -709,7 +1722,7 @@ func handleGzippedV1(a *App, payload []byte, contentType string) *httptest.Respo
 	r.Header.Add("Content-Encoding", "gzip")
 	r.Header.Add("Content-Type", contentType)
 	w := httptest.NewRecorder()
-	ungzipWrap(a.handleSpansV1)(w, r)
+	a.decompressWrap(a.handleSpansV1)(w, r)
 	return w
 }
 
@@ -723,7 +1736,7 @@ func handleGzippedV2(a *App, payload []byte, contentType string) *httptest.Respo
 	r.Header.Add("Content-Encoding", "gzip")
 	r.Header.Add("Content-Type", contentType)
 	w := httptest.NewRecorder()
-	ungzipWrap(a.handleSpansV2)(w, r)
+	a.decompressWrap(a.handleSpansV2)(w, r)
 	return w
 }
 
@@ -737,3 +1750,110 @@ func serializeThriftSpans(spans []*zipkincore.Span) []byte {
 	p.WriteListEnd()
 	return t.Buffer.Bytes()
 }
+
+func TestDestination(t *testing.T) {
+	assert := assert.New(t)
+	sink := &MockSink{}
+	a := &App{
+		Sink:             sink,
+		AllowedWriteKeys: []string{"team1"},
+		AllowedDatasets:  []string{"traces", "payments"},
+	}
+
+	for _, tc := range []struct {
+		path              string
+		writeKey, dataset string
+		code              int
+		// wantWriteKey and wantDataset are what the span is sent with.
+		wantWriteKey, wantDataset string
+	}{
+		{V2Endpoint, "", "", http.StatusAccepted, "", ""},
+		{V2Endpoint, "team1", "traces", http.StatusAccepted, "team1", "traces"},
+		{V2Endpoint + "/payments", "", "traces", http.StatusAccepted, "", "payments"},
+		{V2Endpoint, "team2", "", http.StatusForbidden, "", ""},
+		{V2Endpoint, "", "secrets", http.StatusForbidden, "", ""},
+		{V2Endpoint + "/secrets", "", "", http.StatusForbidden, "", ""},
+		{V2Endpoint + "/a/b", "", "", http.StatusNotFound, "", ""},
+	} {
+		sink.spans = nil
+		r := httptest.NewRequest("POST", tc.path, bytes.NewReader([]byte(`[{"traceId": "1", "id": "1"}]`)))
+		r.Header.Add("Content-Type", "application/json")
+		if tc.writeKey != "" {
+			r.Header.Add(WriteKeyHeader, tc.writeKey)
+		}
+		if tc.dataset != "" {
+			r.Header.Add(DatasetHeader, tc.dataset)
+		}
+		w := httptest.NewRecorder()
+		a.destinationWrap(V2Endpoint, a.handleSpansV2)(w, r)
+		assert.Equal(tc.code, w.Code, "%+v", tc)
+		if tc.code == http.StatusAccepted && assert.Equal(1, len(sink.spans)) {
+			assert.Equal(tc.wantWriteKey, sink.spans[0].WriteKey, "%+v", tc)
+			assert.Equal(tc.wantDataset, sink.spans[0].Dataset, "%+v", tc)
+		}
+	}
+
+	// Spans can't get around AllowedDatasets with a honeycomb.dataset tag,
+	// whether or not the request is mirrored.
+	mirror := &Mirror{BufSize: 10}
+	mirror.payloads = make(chan payload, mirror.BufSize)
+	for _, mirrors := range [][]*Mirror{nil, {mirror}} {
+		a.Mirrors = mirrors
+		for _, tc := range []struct {
+			dataset string
+			code    int
+		}{
+			{"payments", http.StatusAccepted},
+			{"secrets", http.StatusForbidden},
+		} {
+			sink.spans = nil
+			payload := fmt.Sprintf(`[{"traceId": "1", "id": "1", "tags": {"honeycomb.dataset": %q}}]`, tc.dataset)
+			r := httptest.NewRequest("POST", V2Endpoint, bytes.NewReader([]byte(payload)))
+			r.Header.Add("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			a.destinationWrap(V2Endpoint, a.handleSpansV2)(w, r)
+			assert.Equal(tc.code, w.Code, "%+v", tc)
+			if tc.code == http.StatusForbidden {
+				assert.Equal(0, len(sink.spans))
+				assert.Equal("dataset secrets not allowed", w.Body.String())
+			}
+		}
+	}
+	assert.Equal(1, len(mirror.payloads))
+
+	// Without allowlists, the headers are ignored, and datasets can't be
+	// given in the path.
+	a = &App{Sink: sink}
+	sink.spans = nil
+	r := httptest.NewRequest("POST", V2Endpoint, bytes.NewReader([]byte(`[{"traceId": "1", "id": "1"}]`)))
+	r.Header.Add("Content-Type", "application/json")
+	r.Header.Add(WriteKeyHeader, "team2")
+	r.Header.Add(DatasetHeader, "secrets")
+	w := httptest.NewRecorder()
+	a.destinationWrap(V2Endpoint, a.handleSpansV2)(w, r)
+	assert.Equal(http.StatusAccepted, w.Code)
+	assert.Equal("", sink.spans[0].WriteKey)
+	assert.Equal("", sink.spans[0].Dataset)
+
+	r = httptest.NewRequest("POST", V2Endpoint+"/traces", bytes.NewReader([]byte(`[]`)))
+	w = httptest.NewRecorder()
+	a.destinationWrap(V2Endpoint, a.handleSpansV2)(w, r)
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	// The Honeycomb sink sends spans with the write key and dataset the
+	// client asked for.
+	mockHoneycomb := &libhoney.MockOutput{}
+	hs := startHoneycombSink(&sinks.HoneycombSink{}, mockHoneycomb)
+	defer hs.Stop()
+	a = &App{Sink: hs, AllowedWriteKeys: []string{"*"}, AllowedDatasets: []string{"*"}}
+	r = httptest.NewRequest("POST", V2Endpoint+"/payments", bytes.NewReader([]byte(`[{"traceId": "1", "id": "1"}]`)))
+	r.Header.Add("Content-Type", "application/json")
+	r.Header.Add(WriteKeyHeader, "team2")
+	w = httptest.NewRecorder()
+	a.destinationWrap(V2Endpoint, a.handleSpansV2)(w, r)
+	assert.Equal(http.StatusAccepted, w.Code)
+	if assert.Equal(1, len(mockHoneycomb.Events())) {
+		assert.Equal("team2", mockHoneycomb.Events()[0].WriteKey)
+		assert.Equal("payments", mockHoneycomb.Events()[0].Dataset)
+	}
+}
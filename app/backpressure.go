@@ -0,0 +1,86 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/sinks"
+)
+
+// DefaultRetryAfter is how long clients are asked to wait before retrying a
+// request that was rejected because the proxy is overloaded.
+const DefaultRetryAfter = 5 * time.Second
+
+// backpressureWrap wraps a handleFunc, and rejects requests while the proxy
+// is too far behind to take more spans: with a 503 while any of the Sink's
+// queue, the Mirrors' queues or the disk buffers is at least as full as its
+// Unavailable threshold, or else with a 429 while any is at least as full as
+// its Throttle threshold. Either way, clients are asked to retry after
+// RetryAfter. Each threshold is opt-in; by default a slow Mirror only drops
+// payloads, rather than holding up spans for the Sink.
+func (a *App) backpressureWrap(hf func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, queue, fill := a.overloaded()
+		if status == 0 {
+			hf(w, r)
+			return
+		}
+		message := fmt.Sprintf("%s is %.0f%% full", queue, 100*fill)
+		logrus.WithField("endpoint", r.URL.Path).WithField("status", status).Debug(message)
+		requestsThrottled.Inc(r.URL.Path, queue)
+		a.retryLater(w, status, message)
+	}
+}
+
+// overloaded returns the status to reject a request with, and the queue that
+// crossed its threshold and how full it is, or a status of 0 if the request
+// can be handled.
+func (a *App) overloaded() (int, string, float64) {
+	var sinkQueue, mirrorQueue, buffer float64
+	if qr, ok := a.Sink.(sinks.QueueReporter); ok {
+		sinkQueue = qr.QueueFill()
+	}
+	if br, ok := a.Sink.(sinks.BufferReporter); ok {
+		buffer = br.BufferFill()
+	}
+	for _, m := range a.Mirrors {
+		mirrorQueue = math.Max(mirrorQueue, m.QueueFill())
+		buffer = math.Max(buffer, m.BufferFill())
+	}
+	checks := []struct {
+		queue                 string
+		fill                  float64
+		throttle, unavailable float64
+	}{
+		{"sink queue", sinkQueue, a.ThrottleQueueFill, a.UnavailableQueueFill},
+		{"mirror queue", mirrorQueue, a.MirrorThrottleQueueFill, a.MirrorUnavailableQueueFill},
+		{"disk buffer", buffer, a.ThrottleBufferFill, a.UnavailableBufferFill},
+	}
+	for _, c := range checks {
+		if c.unavailable > 0 && c.fill >= c.unavailable {
+			return http.StatusServiceUnavailable, c.queue, c.fill
+		}
+	}
+	for _, c := range checks {
+		if c.throttle > 0 && c.fill >= c.throttle {
+			return http.StatusTooManyRequests, c.queue, c.fill
+		}
+	}
+	return 0, "", 0
+}
+
+// retryLater responds with status, and a Retry-After header that asks the
+// client to retry after the App's RetryAfter.
+func (a *App) retryLater(w http.ResponseWriter, status int, message string) {
+	retryAfter := a.RetryAfter
+	if retryAfter == 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(status)
+	w.Write([]byte(message))
+}
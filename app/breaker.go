@@ -0,0 +1,72 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// breaker is a circuit breaker. Once threshold consecutive attempts have
+// failed, it opens and rejects attempts for cooldown, and then lets a single
+// attempt through to find out whether the destination has recovered. A
+// successful attempt closes it again. It never opens if threshold is 0. name
+// identifies the destination in logs and metrics.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether an attempt may be made now.
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the outcome of an attempt allowed by allow.
+func (b *breaker) record(success bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.failures >= b.threshold
+	b.probing = false
+	if success {
+		b.failures = 0
+		if wasOpen {
+			mirrorCircuitOpen.Set(0, b.name)
+			logrus.WithField("mirror", b.name).Info("Downstream recovered, resuming mirroring")
+		}
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		if !wasOpen {
+			mirrorCircuitOpen.Set(1, b.name)
+			logrus.WithFields(logrus.Fields{
+				"mirror":   b.name,
+				"failures": b.failures,
+				"cooldown": b.cooldown,
+			}).Error("Downstream appears to be down, pausing mirroring")
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+)
+
+// Compressions that a Mirror can send requests with.
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// zstdMaxLevel is the highest zstd compression level. Levels are those of the
+// zstd command line tool, and are mapped onto the encoder's own levels.
+const zstdMaxLevel = 22
+
+// CheckCompression returns an error if compression isn't a known
+// compression, or level isn't valid for it. A level of 0 means the default.
+func CheckCompression(compression string, level int) error {
+	var maxLevel int
+	switch compression {
+	case CompressionNone:
+		return nil
+	case CompressionGzip:
+		maxLevel = gzip.BestCompression
+	case CompressionZstd:
+		maxLevel = zstdMaxLevel
+	default:
+		return fmt.Errorf("unknown compression %s. Must be gzip or zstd", compression)
+	}
+	if level < 0 || level > maxLevel {
+		return fmt.Errorf("invalid %s compression level %d. Must be between 0 (the default) and %d", compression, level, maxLevel)
+	}
+	return nil
+}
+
+// compress compresses a payload with the Mirror's Compression. If the Mirror
+// forwards request bodies verbatim, and the request was received compressed
+// the same way, the body is forwarded as it was received instead.
+func (m *Mirror) compress(p payload) (payload, error) {
+	if m.Compression == CompressionNone {
+		return p, nil
+	}
+	if m.Format == FormatOriginal && p.received != nil && p.received.encoding == m.Compression {
+		p.Body = p.received.body.Bytes()
+	} else if m.Compression == CompressionGzip {
+		level := m.CompressionLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			return p, err
+		}
+		w.Write(p.Body)
+		if err := w.Close(); err != nil {
+			return p, err
+		}
+		p.Body = buf.Bytes()
+	} else {
+		p.Body = m.zstdEncoder.EncodeAll(p.Body, nil)
+	}
+	p.ContentEncoding = m.Compression
+	p.received = nil
+	return p, nil
+}
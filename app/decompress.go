@@ -0,0 +1,250 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultMaxDecompressedSize is the default limit on the size of a request
+// body after it's decompressed.
+const DefaultMaxDecompressedSize = 64 << 20
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// snappyStreamHeader starts a stream in the snappy framing format. Bodies that
+// don't start with it are taken to be a single snappy block.
+const snappyStreamHeader = "\xff\x06\x00\x00sNaPpY"
+
+type contextKey int
+
+const receivedBodyKey contextKey = 0
+
+// encodedBody is a request body as it was received, before it was
+// decompressed.
+type encodedBody struct {
+	encoding string
+	body     bytes.Buffer
+}
+
+// receivedBody returns the compressed body of a request that was decompressed
+// by decompressWrap, if it was compressed in a way that a Mirror can send.
+func receivedBody(r *http.Request) *encodedBody {
+	b, _ := r.Context().Value(receivedBodyKey).(*encodedBody)
+	return b
+}
+
+// decompressWrap wraps a handleFunc and transparently decompresses the body of
+// the request if it's compressed with gzip, deflate, zstd or snappy. The body
+// is decompressed as it's read, and reading it fails once more than the App's
+// MaxDecompressedSize has been read. Requests with other encodings are
+// rejected. Bodies compressed the way a Mirror that forwards them verbatim
+// compresses its requests are also kept as received, in the request's
+// context, so that it can send them on as they are.
+func (a *App) decompressWrap(hf func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" {
+			hf(w, r)
+			return
+		}
+		maxSize := a.MaxDecompressedSize
+		if maxSize == 0 {
+			maxSize = DefaultMaxDecompressedSize
+		}
+
+		var body io.Reader = r.Body
+		var received *encodedBody
+		if a.passthrough(encoding) {
+			received = &encodedBody{encoding: encoding}
+			body = io.TeeReader(body, &received.body)
+		}
+		decompressed, err := newDecompressor(encoding, body, maxSize)
+		if le, ok := err.(limitError); ok {
+			if le == errDecompressedTooLarge {
+				decompressErrors.Inc(encoding, "too_large")
+			}
+			rejectOverLimit(w, r.URL.Path, le)
+			return
+		}
+		switch err {
+		case nil:
+		case errUnsupportedEncoding:
+			logrus.WithField("encoding", encoding).Info("unsupported content encoding")
+			decompressErrors.Inc("other", "unsupported")
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte("unsupported content encoding"))
+			return
+		default:
+			logrus.WithError(err).WithField("encoding", encoding).Info("error decompressing span data")
+			decompressErrors.Inc(encoding, "invalid")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("error decompressing span data"))
+			return
+		}
+
+		if c, ok := decompressed.(io.Closer); ok {
+			defer c.Close()
+		}
+		r.Body = readCloser{
+			Reader: &decompressingReader{
+				r:        &limitedReader{r: decompressed, remaining: maxSize, err: errDecompressedTooLarge},
+				encoding: encoding,
+			},
+			Closer: r.Body,
+		}
+		if received != nil {
+			r = r.WithContext(context.WithValue(r.Context(), receivedBodyKey, received))
+		}
+		hf(w, r)
+	}
+}
+
+// passthrough reports whether any of the App's Mirrors can send request bodies
+// compressed with encoding as they were received.
+func (a *App) passthrough(encoding string) bool {
+	for _, m := range a.Mirrors {
+		if m.Format == FormatOriginal && m.Compression != "" && m.Compression == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// newDecompressor returns a reader that decompresses body. It fails if the
+// encoding is unsupported, or if the body can't be decompressed at all.
+func newDecompressor(encoding string, body io.Reader, maxSize int64) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		// Strictly, deflate means zlib-wrapped data, but some clients send
+		// raw deflate data instead.
+		br := bufio.NewReader(body)
+		if header, err := br.Peek(2); err == nil && isZlibHeader(header) {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "zstd":
+		// The decoder needs no more memory than the body may take up once
+		// it's decompressed, and decodes in the calling goroutine.
+		d, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		if err != nil {
+			return nil, zstdError(err)
+		}
+		return zstdReader{d}, nil
+	case "snappy", "x-snappy-framed":
+		br := bufio.NewReader(body)
+		if header, err := br.Peek(len(snappyStreamHeader)); err == nil && string(header) == snappyStreamHeader {
+			return snappy.NewReader(br), nil
+		}
+		// A single block has to be decompressed all at once, but it says
+		// how large it is first.
+		block, err := ioutil.ReadAll(io.LimitReader(br, maxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		size, err := snappy.DecodedLen(block)
+		if err != nil {
+			return nil, err
+		}
+		if int64(size) > maxSize {
+			return nil, errDecompressedTooLarge
+		}
+		decoded, err := snappy.Decode(nil, block)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(decoded), nil
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
+// isZlibHeader reports whether header is the start of a zlib stream, rather
+// than raw deflate data.
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0F == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// zstdReader reads a zstd stream, and treats frames that can't be decoded
+// within the size limit as exceeding it.
+type zstdReader struct {
+	d *zstd.Decoder
+}
+
+func (zr zstdReader) Read(p []byte) (int, error) {
+	n, err := zr.d.Read(p)
+	return n, zstdError(err)
+}
+
+func (zr zstdReader) Close() error {
+	zr.d.Close()
+	return nil
+}
+
+func zstdError(err error) error {
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return errDecompressedTooLarge
+	}
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decompressingReader reads a decompressed request body, and marks errors
+// other than exceeding a limit as decompression errors.
+type decompressingReader struct {
+	r        io.Reader
+	encoding string
+}
+
+// decompressError is an error decompressing a request body.
+type decompressError struct {
+	err error
+}
+
+func (e decompressError) Error() string {
+	return "error decompressing request body: " + e.err.Error()
+}
+
+func (dr *decompressingReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	switch err.(type) {
+	case nil:
+	case limitError:
+		if err == errDecompressedTooLarge {
+			decompressErrors.Inc(dr.encoding, "too_large")
+		}
+	default:
+		if err != io.EOF {
+			decompressErrors.Inc(dr.encoding, "invalid")
+			err = decompressError{err}
+		}
+	}
+	return n, err
+}
+
+// readErrorResponse returns the status code and message to respond with when
+// a request body can't be read.
+func readErrorResponse(err error) (int, string) {
+	if _, ok := err.(decompressError); ok {
+		return http.StatusBadRequest, "error decompressing span data"
+	}
+	return http.StatusInternalServerError, "error reading request"
+}
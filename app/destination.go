@@ -0,0 +1,123 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// Headers that clients can use to choose the Honeycomb write key and dataset
+// for the spans in a request.
+const (
+	WriteKeyHeader = "X-Honeycomb-Team"
+	DatasetHeader  = "X-Honeycomb-Dataset"
+)
+
+const destinationKey contextKey = 1
+
+// datasetTag is the span tag that the Honeycomb sink sends a span to the
+// dataset of, over the one the client asked for.
+const datasetTag = "honeycomb.dataset"
+
+// destination is the Honeycomb write key and dataset a client asked for the
+// spans in a request to be sent with.
+type destination struct {
+	writeKey string
+	dataset  string
+}
+
+// destinationWrap wraps a handleFunc for endpoint, and checks the write key
+// and dataset the client asked for against the App's AllowedWriteKeys and
+// AllowedDatasets. The dataset can be given in the path as well as in a
+// header, e.g. /api/v2/spans/mydataset; the path is then rewritten to
+// endpoint, so that the handlers and metrics don't see the dataset. Requests
+// that ask for a write key or dataset that isn't allowed are rejected with a
+// 403. Headers for a setting that has no allowlist are ignored.
+func (a *App) destinationWrap(endpoint string, hf func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var dest destination
+		if len(a.AllowedWriteKeys) > 0 {
+			dest.writeKey = r.Header.Get(WriteKeyHeader)
+		}
+		if len(a.AllowedDatasets) > 0 {
+			dest.dataset = r.Header.Get(DatasetHeader)
+		}
+		if r.URL.Path != endpoint {
+			dataset := strings.TrimPrefix(r.URL.Path, endpoint+"/")
+			if len(a.AllowedDatasets) == 0 || dataset == "" || strings.Contains(dataset, "/") {
+				http.NotFound(w, r)
+				return
+			}
+			dest.dataset = dataset
+			r.URL.Path = endpoint
+		}
+
+		if dest.writeKey != "" && !allowed(a.AllowedWriteKeys, dest.writeKey) {
+			// Don't log the write key itself, since it's a secret.
+			forbid(w, endpoint, "write_key", "write key not allowed")
+			return
+		}
+		if dest.dataset != "" && !allowed(a.AllowedDatasets, dest.dataset) {
+			forbid(w, endpoint, "dataset", "dataset "+dest.dataset+" not allowed")
+			return
+		}
+		if dest != (destination{}) {
+			r = r.WithContext(context.WithValue(r.Context(), destinationKey, dest))
+		}
+		hf(w, r)
+	}
+}
+
+// allowed reports whether value is in allowlist, or allowlist contains "*".
+func allowed(allowlist []string, value string) bool {
+	for _, a := range allowlist {
+		if a == value || a == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// forbid responds to a request that asked for a write key or dataset that
+// isn't allowed.
+func forbid(w http.ResponseWriter, endpoint, setting, message string) {
+	logrus.WithField("endpoint", endpoint).Info(message)
+	requestsForbidden.Inc(endpoint, setting)
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(message))
+}
+
+// datasetError is returned for a span whose honeycomb.dataset tag names a
+// dataset that isn't in the App's AllowedDatasets.
+type datasetError string
+
+func (e datasetError) Error() string {
+	return "dataset " + string(e) + " not allowed"
+}
+
+// setDestination sets the write key and dataset that the client asked for on
+// each of a request's spans. If the App has AllowedDatasets, it first checks
+// the datasets that spans' honeycomb.dataset tags ask for too, since they take
+// precedence, and returns a datasetError without setting anything if one
+// isn't allowed.
+func (a *App) setDestination(r *http.Request, spans []*types.Span) error {
+	if len(a.AllowedDatasets) > 0 {
+		for _, s := range spans {
+			if ds, ok := s.BinaryAnnotations[datasetTag].(string); ok && !allowed(a.AllowedDatasets, ds) {
+				return datasetError(ds)
+			}
+		}
+	}
+	dest, ok := r.Context().Value(destinationKey).(destination)
+	if !ok {
+		return nil
+	}
+	for _, s := range spans {
+		s.WriteKey = dest.writeKey
+		s.Dataset = dest.dataset
+	}
+	return nil
+}
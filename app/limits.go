@@ -0,0 +1,122 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// DefaultMaxBodySize is the default limit on the size of a request body as
+// it's received, before it's decompressed.
+const DefaultMaxBodySize = 16 << 20
+
+// limitError is the error for a request that exceeds one of the App's limits.
+// It's responded to with a 413.
+type limitError struct {
+	// limit names the limit for metrics.
+	limit   string
+	message string
+}
+
+func (e limitError) Error() string {
+	return e.message
+}
+
+var (
+	errBodyTooLarge         = limitError{"body_size", "request body too large"}
+	errDecompressedTooLarge = limitError{"decompressed_size", "decompressed request body too large"}
+)
+
+// limitWrap wraps a handleFunc, and limits the size of the request body to the
+// App's MaxBodySize. Requests that say they're larger are rejected straight
+// away, and reading the body fails with errBodyTooLarge once more than
+// MaxBodySize has been read.
+func (a *App) limitWrap(hf func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		maxSize := a.MaxBodySize
+		if maxSize == 0 {
+			maxSize = DefaultMaxBodySize
+		}
+		if r.ContentLength > maxSize {
+			rejectOverLimit(w, r.URL.Path, errBodyTooLarge)
+			return
+		}
+		r.Body = readCloser{
+			Reader: &limitedReader{r: r.Body, remaining: maxSize, err: errBodyTooLarge},
+			Closer: r.Body,
+		}
+		hf(w, r)
+	}
+}
+
+// limitedReader fails with err once more than remaining bytes have been read
+// from r.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.remaining <= 0 {
+		// Check whether there's anything more to read.
+		var b [1]byte
+		if n, err := io.ReadFull(lr.r, b[:]); n > 0 {
+			return 0, lr.err
+		} else if err != io.EOF {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > lr.remaining {
+		p = p[:lr.remaining]
+	}
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	return n, err
+}
+
+// checkLimits returns a limitError if a request has more spans than the App's
+// MaxSpansPerRequest, or a span has more tags than MaxTagsPerSpan or a tag
+// value longer than MaxTagValueLength. Limits of 0 aren't enforced.
+func (a *App) checkLimits(spans []*types.Span) error {
+	if a.MaxSpansPerRequest > 0 && len(spans) > a.MaxSpansPerRequest {
+		return errTooManySpans(a.MaxSpansPerRequest)
+	}
+	for _, s := range spans {
+		if a.MaxTagsPerSpan > 0 && len(s.BinaryAnnotations) > a.MaxTagsPerSpan {
+			return limitError{"tags", fmt.Sprintf("span %s has %d tags, more than the limit of %d", s.ID, len(s.BinaryAnnotations), a.MaxTagsPerSpan)}
+		}
+		if a.MaxTagValueLength <= 0 {
+			continue
+		}
+		for k, v := range s.BinaryAnnotations {
+			var n int
+			switch v := v.(type) {
+			case string:
+				n = len(v)
+			case []byte:
+				n = len(v)
+			}
+			if n > a.MaxTagValueLength {
+				return limitError{"tag_value_length", fmt.Sprintf("tag %s of span %s is %d bytes long, more than the limit of %d", k, s.ID, n, a.MaxTagValueLength)}
+			}
+		}
+	}
+	return nil
+}
+
+func errTooManySpans(max int) limitError {
+	return limitError{"spans", fmt.Sprintf("request has more than the limit of %d spans", max)}
+}
+
+// rejectOverLimit responds to a request that exceeds one of the App's limits.
+func rejectOverLimit(w http.ResponseWriter, endpoint string, err limitError) {
+	logrus.WithField("endpoint", endpoint).WithField("limit", err.limit).Info(err.message)
+	requestsOverLimit.Inc(endpoint, err.limit)
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte(err.message))
+}
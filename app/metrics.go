@@ -0,0 +1,64 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/metrics"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_requests_total",
+		"Number of requests received, by endpoint and response status code.", "endpoint", "code")
+	requestDuration = metrics.NewHistogramVec(metrics.DefaultRegistry, "proxy_request_duration_seconds",
+		"Time taken to handle requests, by endpoint.", nil, "endpoint")
+	spansReceived = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_spans_received_total",
+		"Number of spans decoded, by endpoint and content type.", "endpoint", "content_type")
+	decodeErrors = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_decode_errors_total",
+		"Number of requests whose body couldn't be read or decoded, by endpoint and content type.", "endpoint", "content_type")
+	decompressErrors = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_decompress_errors_total",
+		"Number of requests whose body couldn't be decompressed, by content encoding and reason.", "encoding", "reason")
+	requestsOverLimit = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_requests_over_limit_total",
+		"Number of requests rejected for exceeding a size limit, by endpoint and limit.", "endpoint", "limit")
+	requestsThrottled = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_requests_throttled_total",
+		"Number of requests rejected because a queue or disk buffer was too full, by endpoint and queue.", "endpoint", "queue")
+	requestsForbidden = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_requests_forbidden_total",
+		"Number of requests rejected for asking for a write key or dataset that isn't allowed, by endpoint and setting.", "endpoint", "setting")
+	sinkErrors = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_sink_errors_total",
+		"Number of times a sink failed to take some of a request's spans, by sink.", "sink")
+	mirrorDropped = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_mirror_dropped_total",
+		"Number of payloads dropped without sending, by mirror and reason.", "mirror", "reason")
+	mirrorResponses = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_mirror_responses_total",
+		"Number of downstream responses to mirrored payloads, by mirror and status code.", "mirror", "code")
+	mirrorDuration = metrics.NewHistogramVec(metrics.DefaultRegistry, "proxy_mirror_request_duration_seconds",
+		"Time taken to send mirrored payloads downstream, by mirror.", nil, "mirror")
+	mirrorRetries = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_mirror_retries_total",
+		"Number of times sending a payload downstream was retried, by mirror.", "mirror")
+	mirrorCircuitOpen = metrics.NewGaugeVec(metrics.DefaultRegistry, "proxy_mirror_circuit_open",
+		"1 while a mirror has stopped sending to its downstream host because it appears to be down, otherwise 0.", "mirror")
+)
+
+// statusRecorder is an http.ResponseWriter that remembers the status code
+// written to it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentWrap wraps a handleFunc, and records the number of requests and
+// the time taken to handle them.
+func instrumentWrap(endpoint string, hf func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		hf(sr, r)
+		requestsTotal.Inc(endpoint, strconv.Itoa(sr.status))
+		requestDuration.Observe(time.Since(start).Seconds(), endpoint)
+	}
+}
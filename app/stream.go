@@ -0,0 +1,84 @@
+package app
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// sinkChunkSize is the most spans that are handed to the Sink at once.
+const sinkChunkSize = 1000
+
+// mirrored reports whether any of the Mirrors might send on a request to
+// endpoint. Mirrors need the whole request body, and all of its spans to
+// filter or re-encode them, so such requests are read in full.
+func (a *App) mirrored(endpoint string) bool {
+	for _, m := range a.Mirrors {
+		if len(m.Endpoints) == 0 || contains(m.Endpoints, endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamJSON handles a JSON request that no Mirror wants. It decodes the body
+// with decode as it's read, so that the body itself is never held in memory,
+// and fails as soon as there are more than MaxSpansPerRequest spans. The spans
+// are only handed to the Sink once the whole body has been decoded and has
+// passed every check, so that a rejected request leaves nothing sent.
+func (a *App) streamJSON(w http.ResponseWriter, r *http.Request, endpoint string, decode func(io.Reader, func(*types.Span) error) error) {
+	contentType := r.Header.Get("Content-Type")
+	body := &errorReader{r: r.Body}
+	spans, err := a.decodeJSON(decode, body)
+	if le, ok := err.(limitError); ok {
+		rejectOverLimit(w, endpoint, le)
+		return
+	} else if body.err != nil {
+		logrus.WithError(body.err).Info("Error reading request body")
+		decodeErrors.Inc(endpoint, contentType)
+		status, message := readErrorResponse(body.err)
+		w.WriteHeader(status)
+		w.Write([]byte(message))
+		return
+	} else if err != nil {
+		logrus.WithError(err).WithField("type", contentType).Info("error unmarshaling spans")
+		decodeErrors.Inc(endpoint, contentType)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("error unmarshaling span data"))
+		return
+	}
+	spansReceived.Add(float64(len(spans)), endpoint, contentType)
+	if le, ok := a.checkLimits(spans).(limitError); ok {
+		rejectOverLimit(w, endpoint, le)
+		return
+	}
+
+	if err := a.setDestination(r, spans); err != nil {
+		forbid(w, endpoint, "dataset", err.Error())
+		return
+	}
+	a.process(spans)
+	if err := a.send(spans); err != nil {
+		a.sendFailed(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// errorReader records the first error other than io.EOF from reading r, so
+// that errors reading a request body can be told apart from errors decoding
+// it.
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (er *errorReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if err != nil && err != io.EOF && er.err == nil {
+		er.err = err
+	}
+	return n, err
+}
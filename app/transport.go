@@ -0,0 +1,85 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxDiscardedResponse is how much of a downstream response body is read and
+// discarded so that its connection can be reused. Connections with longer
+// responses are closed instead.
+const maxDiscardedResponse = 64 << 10
+
+// newClient returns the HTTP client shared by the Mirror's workers.
+func (m *Mirror) newClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if m.CAFile != "" {
+		pem, err := ioutil.ReadFile(m.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", m.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if m.CertFile != "" || m.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(m.CertFile, m.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   m.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   m.ConnectTimeout,
+		MaxIdleConns:          m.MaxConcurrency,
+		MaxIdleConnsPerHost:   m.MaxConcurrency,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{Transport: transport, Timeout: m.RequestTimeout}, nil
+}
+
+// readAuthorization returns the Authorization header to send downstream, if
+// any.
+func (m *Mirror) readAuthorization() (string, error) {
+	if m.BearerTokenFile != "" && m.BasicAuthUser != "" {
+		return "", errors.New("only one of a bearer token and basic auth can be used")
+	}
+	if m.BearerTokenFile != "" {
+		token, err := ioutil.ReadFile(m.BearerTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading bearer token file: %v", err)
+		}
+		return "Bearer " + strings.TrimSpace(string(token)), nil
+	}
+	if m.BasicAuthUser != "" {
+		var password []byte
+		if m.BasicAuthPasswordFile != "" {
+			var err error
+			if password, err = ioutil.ReadFile(m.BasicAuthPasswordFile); err != nil {
+				return "", fmt.Errorf("error reading basic auth password file: %v", err)
+			}
+		}
+		credentials := m.BasicAuthUser + ":" + strings.TrimRight(string(password), "\r\n")
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)), nil
+	}
+	return "", nil
+}
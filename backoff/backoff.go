@@ -0,0 +1,20 @@
+// Package backoff computes delays between attempts to retry an operation.
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Jittered returns the delay before the next attempt after the given number
+// of consecutive failures: min doubled once per failure, capped at max, and
+// then scaled by a random factor between 0.5 and 1, so that many clients don't
+// retry in lockstep.
+func Jittered(failures uint, min, max time.Duration) time.Duration {
+	delay := max
+	// Compare without shifting min, which could overflow.
+	if min <= max>>failures {
+		delay = min << failures
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
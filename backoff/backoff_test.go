@@ -0,0 +1,28 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJittered(t *testing.T) {
+	assert := assert.New(t)
+	for failures := uint(0); failures < 100; failures++ {
+		d := Jittered(failures, time.Second, time.Minute)
+		expected := time.Minute
+		if failures < 6 {
+			expected = time.Second << failures
+		}
+		assert.True(d >= expected/2 && d <= expected, "%d failures: %v", failures, d)
+	}
+
+	// Doubling a large min for many failures would overflow.
+	for _, failures := range []uint{31, 40, 63, 64, 1000} {
+		d := Jittered(failures, 5*time.Second, 10*time.Second)
+		assert.True(d >= 5*time.Second && d <= 10*time.Second, "%d failures: %v", failures, d)
+		d = Jittered(failures, time.Hour, 2*time.Hour)
+		assert.True(d >= time.Hour && d <= 2*time.Hour, "%d failures: %v", failures, d)
+	}
+}
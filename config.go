@@ -0,0 +1,584 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/app"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/processors"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/sinks"
+)
+
+// Config is the complete configuration of the proxy. It's built from
+// command-line flags, and then from a TOML file if --config is set. Values in
+// the file take precedence over flags.
+type Config struct {
+	Debug           bool             `toml:"debug"`
+	ShutdownTimeout duration         `toml:"shutdown_timeout"`
+	Listeners       ListenersConfig  `toml:"listeners"`
+	Buffer          BufferConfig     `toml:"buffer"`
+	Sinks           SinksConfig      `toml:"sinks"`
+	Processors      ProcessorsConfig `toml:"processors"`
+}
+
+type ListenersConfig struct {
+	Port          string `toml:"port"`
+	AdminPort     string `toml:"admin_port"`
+	AdminToken    string `toml:"admin_token"`
+	AdminAuditLog string `toml:"admin_audit_log"`
+
+	MaxBodySize         int64 `toml:"max_body_size"`
+	MaxDecompressedSize int64 `toml:"max_decompressed_size"`
+	MaxSpansPerRequest  int   `toml:"max_spans_per_request"`
+	MaxTagsPerSpan      int   `toml:"max_tags_per_span"`
+	MaxTagValueLength   int   `toml:"max_tag_value_length"`
+
+	ThrottleQueueFill          float64  `toml:"throttle_queue_fill"`
+	UnavailableQueueFill       float64  `toml:"unavailable_queue_fill"`
+	MirrorThrottleQueueFill    float64  `toml:"mirror_throttle_queue_fill"`
+	MirrorUnavailableQueueFill float64  `toml:"mirror_unavailable_queue_fill"`
+	ThrottleBufferFill         float64  `toml:"throttle_buffer_fill"`
+	UnavailableBufferFill      float64  `toml:"unavailable_buffer_fill"`
+	RetryAfter                 duration `toml:"retry_after"`
+
+	AllowedWriteKeys []string `toml:"allowed_writekeys"`
+	AllowedDatasets  []string `toml:"allowed_datasets"`
+}
+
+type BufferConfig struct {
+	Dir     string `toml:"dir"`
+	MaxSize int64  `toml:"max_size"`
+}
+
+type SinksConfig struct {
+	Honeycomb    HoneycombConfig    `toml:"honeycomb"`
+	Stdout       StdoutConfig       `toml:"stdout"`
+	Mirror       MirrorConfig       `toml:"mirror"`
+	TraceSummary TraceSummaryConfig `toml:"trace_summary"`
+	Dependencies DependenciesConfig `toml:"dependencies"`
+}
+
+// HoneycombConfig configures the default Honeycomb sink, named "honeycomb",
+// and any further Honeycomb sinks that every span is also sent to.
+type HoneycombConfig struct {
+	HoneycombSinkConfig
+
+	Destinations []HoneycombDestinationConfig `toml:"destinations"`
+}
+
+// HoneycombDestinationConfig is a named Honeycomb sink, in addition to the
+// default one. It doesn't share any settings with the default sink.
+type HoneycombDestinationConfig struct {
+	Name string `toml:"name"`
+
+	HoneycombSinkConfig
+}
+
+// HoneycombSinkConfig is the configuration of a single Honeycomb sink.
+type HoneycombSinkConfig struct {
+	Writekey           string            `toml:"writekey"`
+	Dataset            string            `toml:"dataset"`
+	APIHost            string            `toml:"api_host"`
+	SampleRate         uint              `toml:"samplerate"`
+	DropFields         []string          `toml:"drop_fields"`
+	ServiceDatasets    map[string]string `toml:"service_datasets"`
+	ServiceSampleRates map[string]uint   `toml:"service_samplerates"`
+	ReadyMaxErrorRate  float64           `toml:"ready_max_error_rate"`
+
+	// Routes have no flag; they're set in the config file or the admin API.
+	Routes []sinks.Route `toml:"routes"`
+
+	BestEffort bool `toml:"best_effort"`
+
+	MaxBatchSize         uint     `toml:"max_batch_size"`
+	BatchTimeout         duration `toml:"batch_timeout"`
+	MaxConcurrentBatches uint     `toml:"max_concurrent_batches"`
+	PendingWorkCapacity  uint     `toml:"pending_work_capacity"`
+
+	Queue SinkQueueConfig `toml:"queue"`
+}
+
+// sinks returns all the Honeycomb sinks to send spans to, starting with the
+// default one, which is named "honeycomb".
+func (hc HoneycombConfig) sinks() []HoneycombDestinationConfig {
+	dests := []HoneycombDestinationConfig{{Name: "honeycomb", HoneycombSinkConfig: hc.HoneycombSinkConfig}}
+	return append(dests, hc.Destinations...)
+}
+
+// settings returns the settings of the sink that can be changed while it's
+// running.
+func (hc HoneycombSinkConfig) settings() sinks.HoneycombSettings {
+	return sinks.HoneycombSettings{
+		Dataset:            hc.Dataset,
+		SampleRate:         hc.SampleRate,
+		DropFields:         hc.DropFields,
+		ServiceDatasets:    hc.ServiceDatasets,
+		ServiceSampleRates: hc.ServiceSampleRates,
+		Routes:             hc.Routes,
+	}
+}
+
+type StdoutConfig struct {
+	Enabled bool            `toml:"enabled"`
+	Queue   SinkQueueConfig `toml:"queue"`
+}
+
+// SinkQueueConfig configures the queue that spans wait in before they're sent
+// to a sink.
+type SinkQueueConfig struct {
+	Size         int      `toml:"size"`
+	Workers      int      `toml:"workers"`
+	Overflow     string   `toml:"overflow"`
+	BlockTimeout duration `toml:"block_timeout"`
+}
+
+// sinkOptions returns the sinks.SinkOptions for a sink with this queue.
+func (qc SinkQueueConfig) sinkOptions(required bool) sinks.SinkOptions {
+	return sinks.SinkOptions{
+		Required:     required,
+		QueueSize:    qc.Size,
+		Workers:      qc.Workers,
+		Overflow:     qc.Overflow,
+		BlockTimeout: qc.BlockTimeout.Duration,
+	}
+}
+
+type MirrorConfig struct {
+	Downstream         string   `toml:"downstream"`
+	Format             string   `toml:"format"`
+	ReadyMaxBufferFill float64  `toml:"ready_max_buffer_fill"`
+	MaxRetries         int      `toml:"max_retries"`
+	MinBackoff         duration `toml:"min_backoff"`
+	MaxBackoff         duration `toml:"max_backoff"`
+	Timeout            duration `toml:"timeout"`
+	BreakerThreshold   int      `toml:"breaker_threshold"`
+	BreakerCooldown    duration `toml:"breaker_cooldown"`
+
+	// MirrorClientConfig applies to Downstream only.
+	MirrorClientConfig
+
+	Destinations []MirrorDestinationConfig `toml:"destinations"`
+}
+
+// MirrorDestinationConfig is a downstream host to mirror requests to, in
+// addition to Downstream. It shares the other MirrorConfig settings, except
+// for MirrorClientConfig.
+type MirrorDestinationConfig struct {
+	Name        string   `toml:"name"`
+	Downstream  string   `toml:"downstream"`
+	Format      string   `toml:"format"`
+	Services    []string `toml:"services"`
+	Endpoints   []string `toml:"endpoints"`
+	Concurrency int      `toml:"concurrency"`
+	QueueSize   int      `toml:"queue_size"`
+
+	MirrorClientConfig
+
+	// legacy is set for the destination given by MirrorConfig.Downstream.
+	legacy bool
+}
+
+// MirrorClientConfig is how to connect and authenticate to a downstream host,
+// and how to compress requests to it.
+type MirrorClientConfig struct {
+	Headers               map[string]string `toml:"headers"`
+	BearerTokenFile       string            `toml:"bearer_token_file"`
+	BasicAuthUser         string            `toml:"basic_auth_user"`
+	BasicAuthPasswordFile string            `toml:"basic_auth_password_file"`
+	CAFile                string            `toml:"ca_file"`
+	CertFile              string            `toml:"cert_file"`
+	KeyFile               string            `toml:"key_file"`
+	ConnectTimeout        duration          `toml:"connect_timeout"`
+	RequestTimeout        duration          `toml:"request_timeout"`
+	Compression           string            `toml:"compression"`
+	CompressionLevel      int               `toml:"compression_level"`
+}
+
+// destinations returns all the hosts to mirror requests to, including
+// Downstream, which is named "downstream".
+func (mc MirrorConfig) destinations() []MirrorDestinationConfig {
+	var dests []MirrorDestinationConfig
+	if mc.Downstream != "" {
+		dests = append(dests, MirrorDestinationConfig{
+			Name:               "downstream",
+			Downstream:         mc.Downstream,
+			Format:             mc.Format,
+			MirrorClientConfig: mc.MirrorClientConfig,
+			legacy:             true,
+		})
+	}
+	return append(dests, mc.Destinations...)
+}
+
+type TraceSummaryConfig struct {
+	Enabled bool     `toml:"enabled"`
+	Timeout duration `toml:"timeout"`
+	MaxWait duration `toml:"max_wait"`
+}
+
+type DependenciesConfig struct {
+	Enabled  bool     `toml:"enabled"`
+	Dataset  string   `toml:"dataset"`
+	Interval duration `toml:"interval"`
+	Window   int      `toml:"window"`
+
+	Queue SinkQueueConfig `toml:"queue"`
+}
+
+type ProcessorsConfig struct {
+	PathTemplating      PathTemplatingConfig      `toml:"path_templating" json:"path_templating"`
+	ErrorClassification ErrorClassificationConfig `toml:"error_classification" json:"error_classification"`
+	REDMetrics          REDMetricsConfig          `toml:"red_metrics" json:"red_metrics"`
+}
+
+type PathTemplatingConfig struct {
+	Enabled      bool     `toml:"enabled" json:"enabled"`
+	Templates    []string `toml:"templates" json:"templates"`
+	KeepOriginal bool     `toml:"keep_original" json:"keep_original"`
+}
+
+type ErrorClassificationConfig struct {
+	Enabled         bool     `toml:"enabled" json:"enabled"`
+	Rules           []string `toml:"rules" json:"rules"`
+	ErrorTag        string   `toml:"error_tag" json:"error_tag"`
+	MinHTTPStatus   int64    `toml:"min_http_status" json:"min_http_status"`
+	AnnotationMatch string   `toml:"annotation_match" json:"annotation_match"`
+}
+
+type REDMetricsConfig struct {
+	Enabled   bool      `toml:"enabled" json:"enabled"`
+	Buckets   []float64 `toml:"buckets" json:"buckets"`
+	MaxSeries int       `toml:"max_series" json:"max_series"`
+}
+
+// duration is a time.Duration that can be decoded from a TOML string such as
+// "5s".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// configFromOptions returns the configuration described by command-line flags.
+func configFromOptions(options *Options) *Config {
+	return &Config{
+		Debug:           options.Debug,
+		ShutdownTimeout: duration{options.ShutdownTimeout},
+		Listeners: ListenersConfig{
+			Port:          options.Port,
+			AdminPort:     options.AdminPort,
+			AdminToken:    options.AdminToken,
+			AdminAuditLog: options.AdminAuditLog,
+
+			MaxBodySize:         options.MaxBodySize,
+			MaxDecompressedSize: options.MaxDecompressedSize,
+			MaxSpansPerRequest:  options.MaxSpansPerRequest,
+			MaxTagsPerSpan:      options.MaxTagsPerSpan,
+			MaxTagValueLength:   options.MaxTagValueLength,
+
+			ThrottleQueueFill:          options.ThrottleQueueFill,
+			UnavailableQueueFill:       options.UnavailableQueueFill,
+			MirrorThrottleQueueFill:    options.MirrorThrottleQueueFill,
+			MirrorUnavailableQueueFill: options.MirrorUnavailableQueueFill,
+			ThrottleBufferFill:         options.ThrottleBufferFill,
+			UnavailableBufferFill:      options.UnavailableBufferFill,
+			RetryAfter:                 duration{options.RetryAfter},
+
+			AllowedWriteKeys: copyStrings(options.AllowedWriteKeys),
+			AllowedDatasets:  copyStrings(options.AllowedDatasets),
+		},
+		Buffer: BufferConfig{
+			Dir:     options.BufferDir,
+			MaxSize: options.BufferMaxSize,
+		},
+		Sinks: SinksConfig{
+			Honeycomb: HoneycombConfig{HoneycombSinkConfig: HoneycombSinkConfig{
+				Writekey:           options.Writekey,
+				Dataset:            options.Dataset,
+				APIHost:            options.APIHost,
+				SampleRate:         options.SampleRate,
+				DropFields:         copyStrings(options.DropFields),
+				ServiceDatasets:    copyStringMap(options.ServiceDatasets),
+				ServiceSampleRates: copySampleRates(options.ServiceSampleRates),
+				ReadyMaxErrorRate:  options.ReadyMaxErrorRate,
+
+				BestEffort: options.HoneycombBestEffort,
+
+				MaxBatchSize:         options.HoneycombMaxBatchSize,
+				BatchTimeout:         duration{options.HoneycombBatchTimeout},
+				MaxConcurrentBatches: options.HoneycombMaxConcurrentBatches,
+				PendingWorkCapacity:  options.HoneycombPendingWorkCapacity,
+
+				Queue: sinkQueueFromOptions(options),
+			}},
+			Stdout: StdoutConfig{
+				Enabled: options.Debug,
+				Queue:   sinkQueueFromOptions(options),
+			},
+			Mirror: MirrorConfig{
+				Downstream:         options.Downstream,
+				Format:             options.DownstreamFormat,
+				ReadyMaxBufferFill: options.ReadyMaxBufferFill,
+				MaxRetries:         options.MirrorMaxRetries,
+				MinBackoff:         duration{options.MirrorMinBackoff},
+				MaxBackoff:         duration{options.MirrorMaxBackoff},
+				Timeout:            duration{options.MirrorTimeout},
+				BreakerThreshold:   options.MirrorBreakerThreshold,
+				BreakerCooldown:    duration{options.MirrorBreakerCooldown},
+				MirrorClientConfig: MirrorClientConfig{
+					Headers:               copyStringMap(options.DownstreamHeaders),
+					BearerTokenFile:       options.DownstreamBearerTokenFile,
+					BasicAuthUser:         options.DownstreamBasicAuthUser,
+					BasicAuthPasswordFile: options.DownstreamBasicAuthPasswordFile,
+					CAFile:                options.DownstreamCAFile,
+					CertFile:              options.DownstreamCertFile,
+					KeyFile:               options.DownstreamKeyFile,
+					ConnectTimeout:        duration{options.DownstreamConnectTimeout},
+					RequestTimeout:        duration{options.DownstreamRequestTimeout},
+					Compression:           options.DownstreamCompression,
+					CompressionLevel:      options.DownstreamCompressionLevel,
+				},
+			},
+			TraceSummary: TraceSummaryConfig{
+				Enabled: options.TraceSummary,
+				Timeout: duration{options.TraceSummaryTimeout},
+				MaxWait: duration{options.TraceSummaryMaxWait},
+			},
+			Dependencies: DependenciesConfig{
+				Enabled:  options.Dependencies,
+				Dataset:  options.DependenciesDataset,
+				Interval: duration{options.DependenciesInterval},
+				Window:   options.DependenciesWindow,
+
+				Queue: sinkQueueFromOptions(options),
+			},
+		},
+		Processors: ProcessorsConfig{
+			PathTemplating: PathTemplatingConfig{
+				Enabled:      options.TemplatePaths,
+				Templates:    copyStrings(options.PathTemplates),
+				KeepOriginal: options.KeepOriginalPaths,
+			},
+			ErrorClassification: ErrorClassificationConfig{
+				Enabled:         options.ClassifyErrors,
+				Rules:           copyStrings(options.ErrorRules),
+				ErrorTag:        options.ErrorTag,
+				MinHTTPStatus:   options.ErrorMinHTTPStatus,
+				AnnotationMatch: options.ErrorAnnotationMatch,
+			},
+			REDMetrics: REDMetricsConfig{
+				Enabled:   options.REDMetrics,
+				Buckets:   append([]float64(nil), options.REDBuckets...),
+				MaxSeries: options.REDMaxSeries,
+			},
+		},
+	}
+}
+
+// sinkQueueFromOptions returns the queue configuration that each sink starts
+// with, before the config file is read.
+func sinkQueueFromOptions(options *Options) SinkQueueConfig {
+	return SinkQueueConfig{
+		Size:         options.SinkQueueSize,
+		Workers:      options.SinkWorkers,
+		Overflow:     options.SinkQueueOverflow,
+		BlockTimeout: duration{options.SinkQueueBlockTimeout},
+	}
+}
+
+// copyStrings, copyStringMap and copySampleRates copy slices and maps, so that
+// decoding a config file over them doesn't modify the originals.
+func copyStrings(s []string) []string {
+	return append([]string(nil), s...)
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copySampleRates(m map[string]uint) map[string]uint {
+	c := make(map[string]uint, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// loadConfig reads the TOML file at path over the configuration described by
+// command-line flags, and validates the result. Keys in the file that don't
+// correspond to any setting are an error, so that typos aren't silently
+// ignored.
+func loadConfig(path string, options *Options) (*Config, error) {
+	cfg := configFromOptions(options)
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return nil, fmt.Errorf("unknown settings in %s: %s", path, strings.Join(keys, ", "))
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validName matches mirror and Honeycomb sink names that are safe to use in
+// file names and metric labels.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Validate checks that the configuration is complete and consistent.
+func (c *Config) Validate() error {
+	if !c.Debug && c.Sinks.Honeycomb.Writekey == "" {
+		return errors.New("no writekey provided")
+	}
+	if !c.Debug && c.Sinks.Honeycomb.Dataset == "" {
+		return errors.New("no dataset provided")
+	}
+	names := make(map[string]bool)
+	for _, dest := range c.Sinks.Mirror.destinations() {
+		if !validName.MatchString(dest.Name) {
+			return fmt.Errorf("invalid mirror name %q. Must only contain letters, digits, - and _", dest.Name)
+		}
+		if names[dest.Name] {
+			return fmt.Errorf("duplicate mirror name %s", dest.Name)
+		}
+		names[dest.Name] = true
+		downstreamURL, err := url.Parse(dest.Downstream)
+		if err != nil {
+			return fmt.Errorf("invalid downstream url %s", dest.Downstream)
+		}
+		if scheme := downstreamURL.Scheme; scheme != "http" && scheme != "https" {
+			return fmt.Errorf("invalid downstream url %s. Must be prefixed with http:// or https://", dest.Downstream)
+		}
+		switch dest.Format {
+		case app.FormatOriginal, app.FormatV1JSON, app.FormatV2JSON, app.FormatV2Proto:
+		default:
+			return fmt.Errorf("invalid format %s for mirror %s. Must be v1_json, v2_json or v2_proto", dest.Format, dest.Name)
+		}
+		if dest.Concurrency < 0 || dest.QueueSize < 0 {
+			return fmt.Errorf("mirror %s concurrency and queue size must not be negative", dest.Name)
+		}
+		if dest.BearerTokenFile != "" && dest.BasicAuthUser != "" {
+			return fmt.Errorf("mirror %s can't use both a bearer token and basic auth", dest.Name)
+		}
+		if (dest.CertFile == "") != (dest.KeyFile == "") {
+			return fmt.Errorf("mirror %s needs both a client certificate and key", dest.Name)
+		}
+		if dest.ConnectTimeout.Duration < 0 || dest.RequestTimeout.Duration < 0 {
+			return fmt.Errorf("mirror %s timeouts must not be negative", dest.Name)
+		}
+		if err := app.CheckCompression(dest.Compression, dest.CompressionLevel); err != nil {
+			return fmt.Errorf("mirror %s: %v", dest.Name, err)
+		}
+	}
+	if l := c.Listeners; l.MaxBodySize < 0 || l.MaxDecompressedSize < 0 || l.MaxSpansPerRequest < 0 ||
+		l.MaxTagsPerSpan < 0 || l.MaxTagValueLength < 0 {
+		return errors.New("request limits must not be negative")
+	}
+	l := c.Listeners
+	for _, fill := range []float64{l.ThrottleQueueFill, l.UnavailableQueueFill, l.MirrorThrottleQueueFill,
+		l.MirrorUnavailableQueueFill, l.ThrottleBufferFill, l.UnavailableBufferFill} {
+		if fill < 0 || fill > 1 {
+			return errors.New("queue and buffer fill thresholds must be between 0 and 1")
+		}
+	}
+	if l.RetryAfter.Duration < 0 {
+		return errors.New("retry after must not be negative")
+	}
+	if c.Buffer.Dir != "" && c.Buffer.MaxSize <= 0 {
+		return errors.New("buffer max size must be positive")
+	}
+	if mc := c.Sinks.Mirror; mc.MaxRetries < 0 || mc.BreakerThreshold < 0 || mc.MinBackoff.Duration < 0 ||
+		mc.MaxBackoff.Duration < mc.MinBackoff.Duration || mc.Timeout.Duration < 0 || mc.BreakerCooldown.Duration < 0 {
+		return errors.New("invalid mirror retry settings")
+	}
+	if err := c.validateHoneycombSinks(); err != nil {
+		return err
+	}
+	if c.ShutdownTimeout.Duration < 0 {
+		return errors.New("shutdown timeout must not be negative")
+	}
+	if ts := c.Sinks.TraceSummary; ts.Enabled && (ts.Timeout.Duration <= 0 || ts.MaxWait.Duration <= 0) {
+		return errors.New("trace summary timeouts must be positive")
+	}
+	if ds := c.Sinks.Dependencies; ds.Enabled && (ds.Interval.Duration <= 0 || ds.Window <= 0) {
+		return errors.New("dependencies interval and window must be positive")
+	}
+	queues := []struct {
+		sink  string
+		queue SinkQueueConfig
+	}{
+		{"stdout", c.Sinks.Stdout.Queue},
+		{"dependencies", c.Sinks.Dependencies.Queue},
+	}
+	for _, q := range queues {
+		if err := sinks.CheckSinkOptions(q.queue.sinkOptions(false)); err != nil {
+			return fmt.Errorf("invalid %s sink queue: %v", q.sink, err)
+		}
+	}
+	if c.Processors.ErrorClassification.Enabled {
+		if err := c.errorClassifier().Validate(); err != nil {
+			return fmt.Errorf("invalid error classification options: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateHoneycombSinks checks the settings of each Honeycomb sink. Sinks
+// other than the default one need a name that no other sink has, and a write
+// key and dataset even in debug mode.
+func (c *Config) validateHoneycombSinks() error {
+	names := map[string]bool{"stdout": true, "dependencies": true}
+	for i, hc := range c.Sinks.Honeycomb.sinks() {
+		if i > 0 {
+			if !validName.MatchString(hc.Name) {
+				return fmt.Errorf("invalid honeycomb sink name %q. Must only contain letters, digits, - and _", hc.Name)
+			}
+			if names[hc.Name] {
+				return fmt.Errorf("duplicate sink name %s", hc.Name)
+			}
+			if hc.Writekey == "" || hc.Dataset == "" {
+				return fmt.Errorf("honeycomb sink %s needs a writekey and dataset", hc.Name)
+			}
+		}
+		names[hc.Name] = true
+		if err := sinks.CheckRoutes(hc.Routes); err != nil {
+			return fmt.Errorf("honeycomb sink %s: %v", hc.Name, err)
+		}
+		if hc.BatchTimeout.Duration < 0 {
+			return fmt.Errorf("honeycomb sink %s batch timeout must not be negative", hc.Name)
+		}
+		if err := sinks.CheckSinkOptions(hc.Queue.sinkOptions(false)); err != nil {
+			return fmt.Errorf("invalid %s sink queue: %v", hc.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) errorClassifier() *processors.ErrorClassifier {
+	ec := c.Processors.ErrorClassification
+	return &processors.ErrorClassifier{
+		Rules:           ec.Rules,
+		ErrorTag:        ec.ErrorTag,
+		MinHTTPStatus:   ec.MinHTTPStatus,
+		AnnotationMatch: ec.AnnotationMatch,
+	}
+}
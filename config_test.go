@@ -0,0 +1,302 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/sinks"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+	options := &Options{
+		Writekey:   "flagkey",
+		Dataset:    "flagdataset",
+		Port:       ":9411",
+		DropFields: []string{"flagfield"},
+
+		SinkQueueSize:     100,
+		SinkQueueOverflow: "drop_newest",
+
+		TraceSummaryMaxWait: time.Minute,
+	}
+
+	path := writeConfig(t, `
+[listeners]
+admin_port = ":9412"
+max_decompressed_size = 1048576
+max_spans_per_request = 5000
+throttle_queue_fill = 0.5
+mirror_throttle_queue_fill = 0.7
+retry_after = "30s"
+allowed_datasets = ["traces", "payments"]
+
+[sinks.honeycomb]
+dataset = "filedataset"
+drop_fields = ["filefield"]
+best_effort = true
+
+[[sinks.honeycomb.routes]]
+match = "service=payments*"
+dataset = "payments-traces"
+samplerate = 1
+
+[sinks.stdout.queue]
+size = 10
+overflow = "drop_oldest"
+
+[sinks.trace_summary]
+enabled = true
+timeout = "10s"
+`)
+	defer os.Remove(path)
+
+	cfg, err := loadConfig(path, options)
+	assert.NoError(err)
+	// Settings in the file override flags; others keep their flag values.
+	assert.Equal("flagkey", cfg.Sinks.Honeycomb.Writekey)
+	assert.Equal("filedataset", cfg.Sinks.Honeycomb.Dataset)
+	assert.Equal([]string{"filefield"}, cfg.Sinks.Honeycomb.DropFields)
+	assert.Equal([]string{"flagfield"}, options.DropFields)
+	assert.True(cfg.Sinks.Honeycomb.BestEffort)
+	assert.Equal([]sinks.Route{{Match: "service=payments*", Dataset: "payments-traces", SampleRate: 1}}, cfg.Sinks.Honeycomb.Routes)
+	assert.Equal(SinkQueueConfig{Size: 100, Overflow: "drop_newest"}, cfg.Sinks.Honeycomb.Queue)
+	assert.Equal(SinkQueueConfig{Size: 10, Overflow: "drop_oldest"}, cfg.Sinks.Stdout.Queue)
+	assert.Equal(":9411", cfg.Listeners.Port)
+	assert.Equal(":9412", cfg.Listeners.AdminPort)
+	assert.Equal(int64(1048576), cfg.Listeners.MaxDecompressedSize)
+	assert.Equal(5000, cfg.Listeners.MaxSpansPerRequest)
+	assert.Equal(0.5, cfg.Listeners.ThrottleQueueFill)
+	assert.Equal(0.7, cfg.Listeners.MirrorThrottleQueueFill)
+	assert.Equal(30*time.Second, cfg.Listeners.RetryAfter.Duration)
+	assert.Equal([]string{"traces", "payments"}, cfg.Listeners.AllowedDatasets)
+	assert.True(cfg.Sinks.TraceSummary.Enabled)
+	assert.Equal(10*time.Second, cfg.Sinks.TraceSummary.Timeout.Duration)
+}
+
+func TestLoadMirrorDestinations(t *testing.T) {
+	assert := assert.New(t)
+	options := &Options{
+		Writekey:              "key",
+		Dataset:               "traces",
+		Downstream:            "http://zipkin:9411",
+		DownstreamHeaders:     map[string]string{"X-Scope-OrgID": "tracing"},
+		DownstreamCompression: "gzip",
+	}
+
+	path := writeConfig(t, `
+[[sinks.mirror.destinations]]
+name = "staging"
+downstream = "https://staging.example.com"
+services = ["checkout"]
+format = "v2_proto"
+headers = { X-Team = "tracing" }
+bearer_token_file = "/etc/proxy/token"
+connect_timeout = "5s"
+compression = "zstd"
+compression_level = 9
+concurrency = 10
+`)
+	defer os.Remove(path)
+
+	cfg, err := loadConfig(path, options)
+	assert.NoError(err)
+	assert.Equal([]MirrorDestinationConfig{
+		{
+			Name:       "downstream",
+			Downstream: "http://zipkin:9411",
+			MirrorClientConfig: MirrorClientConfig{
+				Headers:     map[string]string{"X-Scope-OrgID": "tracing"},
+				Compression: "gzip",
+			},
+			legacy: true,
+		},
+		{
+			Name:        "staging",
+			Downstream:  "https://staging.example.com",
+			Format:      "v2_proto",
+			Services:    []string{"checkout"},
+			Concurrency: 10,
+			MirrorClientConfig: MirrorClientConfig{
+				Headers:          map[string]string{"X-Team": "tracing"},
+				BearerTokenFile:  "/etc/proxy/token",
+				ConnectTimeout:   duration{5 * time.Second},
+				Compression:      "zstd",
+				CompressionLevel: 9,
+			},
+		},
+	}, cfg.Sinks.Mirror.destinations())
+}
+
+func TestLoadInvalidConfig(t *testing.T) {
+	assert := assert.New(t)
+	options := &Options{Writekey: "flagkey", Dataset: "flagdataset"}
+
+	for _, contents := range []string{
+		"[sinks.honeycomb]\ndatset = \"typo\"\n",
+		"[sinks.mirror]\ndownstream = \"zipkin:9411\"\n",
+		"[processors.error_classification]\nenabled = true\nrules = [\"bogus\"]\n",
+		"[sinks.honeycomb]\nwritekey = \"\"\n",
+		"[listeners]\nmax_decompressed_size = -1\n",
+		"[listeners]\nmax_tags_per_span = -1\n",
+		"[listeners]\nunavailable_queue_fill = 1.5\n",
+		"[listeners]\nthrottle_buffer_fill = -0.1\n",
+		"[sinks.stdout.queue]\noverflow = \"drop_all\"\n",
+		"[sinks.honeycomb]\nbatch_timeout = \"-1s\"\n",
+		"[[sinks.honeycomb.routes]]\nmatch = \"service\"\ndataset = \"a\"\n",
+		"[sinks.dependencies.queue]\nsize = -1\n",
+		"[sinks.trace_summary]\nenabled = true\ntimeout = \"0s\"\n",
+		"[sinks.dependencies]\nenabled = true\ninterval = \"0s\"\nwindow = 10\n",
+		"[[sinks.mirror.destinations]]\nname = \"a/b\"\ndownstream = \"http://zipkin:9411\"\n",
+		"[sinks.mirror]\ndownstream = \"http://zipkin:9411\"\nformat = \"v3_json\"\n",
+		"[sinks.mirror]\ndownstream = \"http://zipkin:9411\"\ncert_file = \"client.pem\"\n",
+		"[sinks.mirror]\ndownstream = \"http://zipkin:9411\"\ncompression = \"br\"\n",
+		"[sinks.mirror]\ndownstream = \"http://zipkin:9411\"\ncompression = \"gzip\"\ncompression_level = 12\n",
+		"[sinks.mirror]\ndownstream = \"http://zipkin:9411\"\n[[sinks.mirror.destinations]]\nname = \"downstream\"\ndownstream = \"http://staging:9411\"\n",
+		"[[sinks.honeycomb.destinations]]\nname = \"eu\"\ndataset = \"traces\"\n",
+		"[[sinks.honeycomb.destinations]]\nname = \"honeycomb\"\nwritekey = \"key\"\ndataset = \"traces\"\n",
+		"[[sinks.honeycomb.destinations]]\nname = \"stdout\"\nwritekey = \"key\"\ndataset = \"traces\"\n",
+		"[[sinks.honeycomb.destinations]]\nname = \"e u\"\nwritekey = \"key\"\ndataset = \"traces\"\n",
+		"[[sinks.honeycomb.destinations]]\nname = \"eu\"\nwritekey = \"key\"\ndataset = \"traces\"\nbatch_timeout = \"-1s\"\n",
+		"not toml",
+	} {
+		path := writeConfig(t, contents)
+		_, err := loadConfig(path, options)
+		assert.Error(err, contents)
+		os.Remove(path)
+	}
+}
+
+// TestMirrorBufferDirs checks that the --downstream destination keeps the disk
+// buffer it had before there could be several destinations.
+func TestMirrorBufferDirs(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "buffer")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{
+		Buffer: BufferConfig{Dir: dir},
+		Sinks: SinksConfig{Mirror: MirrorConfig{
+			Downstream:   "http://zipkin:9411",
+			Destinations: []MirrorDestinationConfig{{Name: "staging", Downstream: "http://staging:9411"}},
+		}},
+	}
+	mirrors, err := startMirrors(cfg)
+	assert.NoError(err)
+	assert.Equal(2, len(mirrors))
+	assert.Equal(filepath.Join(dir, "mirror"), mirrors[0].BufferDir)
+	assert.Equal("mirror", mirrors[0].BufferName)
+	assert.Equal(filepath.Join(dir, "mirrors", "staging"), mirrors[1].BufferDir)
+	assert.Equal("mirror-staging", mirrors[1].BufferName)
+	for _, m := range mirrors {
+		assert.NoError(m.Stop())
+	}
+}
+
+func TestLoadHoneycombSinks(t *testing.T) {
+	assert := assert.New(t)
+	options := &Options{Writekey: "flagkey", Dataset: "flagdataset"}
+
+	path := writeConfig(t, `
+[[sinks.honeycomb.destinations]]
+name = "eu"
+writekey = "eukey"
+dataset = "eu-traces"
+api_host = "https://api.eu1.honeycomb.io/"
+samplerate = 5
+best_effort = true
+
+[sinks.honeycomb.destinations.queue]
+size = 100
+`)
+	defer os.Remove(path)
+
+	cfg, err := loadConfig(path, options)
+	assert.NoError(err)
+	hcs := cfg.Sinks.Honeycomb.sinks()
+	if assert.Equal(2, len(hcs)) {
+		assert.Equal("honeycomb", hcs[0].Name)
+		assert.Equal("flagkey", hcs[0].Writekey)
+		assert.Equal(HoneycombDestinationConfig{
+			Name: "eu",
+			HoneycombSinkConfig: HoneycombSinkConfig{
+				Writekey:   "eukey",
+				Dataset:    "eu-traces",
+				APIHost:    "https://api.eu1.honeycomb.io/",
+				SampleRate: 5,
+				BestEffort: true,
+				Queue:      SinkQueueConfig{Size: 100},
+			},
+		}, hcs[1])
+	}
+}
+
+// TestHoneycombBufferDirs checks that each Honeycomb sink has its own disk
+// buffer, and that the default sink keeps the one it had before there could be
+// several sinks.
+func TestHoneycombBufferDirs(t *testing.T) {
+	assert := assert.New(t)
+	cfg := &Config{
+		Buffer: BufferConfig{Dir: "/var/lib/proxy"},
+		Sinks: SinksConfig{Honeycomb: HoneycombConfig{
+			Destinations: []HoneycombDestinationConfig{{Name: "eu"}, {Name: "us"}},
+		}},
+	}
+	honeycombSinks := newHoneycombSinks(cfg)
+	if assert.Equal(3, len(honeycombSinks)) {
+		assert.Equal("honeycomb", honeycombSinks[0].Name)
+		assert.Equal(filepath.Join("/var/lib/proxy", "honeycomb"), honeycombSinks[0].BufferDir)
+		assert.Equal("eu", honeycombSinks[1].Name)
+		assert.Equal(filepath.Join("/var/lib/proxy", "honeycomb-sinks", "eu"), honeycombSinks[1].BufferDir)
+		assert.Equal(filepath.Join("/var/lib/proxy", "honeycomb-sinks", "us"), honeycombSinks[2].BufferDir)
+	}
+}
+
+// TestReloadHoneycombSinks checks that reloading changes the settings of named
+// Honeycomb sinks that can be changed while they run, and that adding,
+// removing or otherwise changing them needs a restart.
+func TestReloadHoneycombSinks(t *testing.T) {
+	assert := assert.New(t)
+	p := newTestProxy()
+	eu := &sinks.HoneycombSink{Name: "eu"}
+	p.honeycombs["eu"] = eu
+	cfg := *p.cfg
+	cfg.Sinks.Honeycomb.Destinations = []HoneycombDestinationConfig{
+		{Name: "eu", HoneycombSinkConfig: HoneycombSinkConfig{Writekey: "eukey", Dataset: "eu-traces"}},
+	}
+	p.apply(&cfg)
+	assert.Equal("eu-traces", eu.Settings().Dataset)
+
+	withDest := func(dest HoneycombDestinationConfig) *Config {
+		c := cfg
+		c.Sinks.Honeycomb.Destinations = []HoneycombDestinationConfig{dest}
+		return &c
+	}
+	changed := withDest(HoneycombDestinationConfig{Name: "eu", HoneycombSinkConfig: HoneycombSinkConfig{Writekey: "eukey", Dataset: "eu-spans", SampleRate: 10}})
+	assert.Empty(p.restartRequired(changed))
+	p.apply(changed)
+	assert.Equal("eu-spans", eu.Settings().Dataset)
+	assert.Equal(uint(10), eu.Settings().SampleRate)
+
+	assert.Equal([]string{"sinks.honeycomb.destinations.eu"},
+		p.restartRequired(withDest(HoneycombDestinationConfig{Name: "eu", HoneycombSinkConfig: HoneycombSinkConfig{Writekey: "newkey", Dataset: "eu-spans"}})))
+	assert.Equal([]string{"sinks.honeycomb.destinations.us", "sinks.honeycomb.destinations.eu"},
+		p.restartRequired(withDest(HoneycombDestinationConfig{Name: "us", HoneycombSinkConfig: HoneycombSinkConfig{Writekey: "uskey", Dataset: "us-traces"}})))
+}
@@ -0,0 +1,14 @@
+package diskqueue
+
+import "github.com/honeycombio/honeycomb-opentracing-proxy/metrics"
+
+var (
+	queueRecords = metrics.NewGaugeVec(metrics.DefaultRegistry, "proxy_disk_queue_records",
+		"Number of records waiting in a disk queue, by queue.", "queue")
+	queueBytes = metrics.NewGaugeVec(metrics.DefaultRegistry, "proxy_disk_queue_bytes",
+		"Size of the records waiting in a disk queue, by queue.", "queue")
+	queueDropped = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_disk_queue_dropped_total",
+		"Number of records not added to a disk queue because it was full, by queue.", "queue")
+	replayErrors = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_disk_queue_replay_errors_total",
+		"Number of failed attempts to deliver records from a disk queue, by queue.", "queue")
+)
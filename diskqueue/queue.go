@@ -0,0 +1,413 @@
+// Package diskqueue implements a durable first-in, first-out queue of
+// records, stored in append-only segment files, so that data waiting to be
+// sent survives outages of its destination and restarts of the process.
+package diskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrFull   = errors.New("disk queue full")
+	ErrClosed = errors.New("disk queue closed")
+)
+
+const (
+	// Each record is stored as its length and CRC-32 checksum, followed by
+	// its data.
+	headerSize = 8
+
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+
+	defaultSegmentSize = 8 << 20
+	defaultMaxSize     = 1 << 30
+)
+
+// Queue is a queue of records stored in segment files in Dir. New records are
+// appended to the newest segment, and a new segment is started once it
+// reaches SegmentSize bytes. Segments are deleted once all their records have
+// been popped. Push fails with ErrFull if the unpopped records would take up
+// more than MaxSize bytes.
+//
+// The position of the oldest unpopped record is saved after every Pop, so
+// reopening a queue resumes where it left off. Records aren't synced to disk
+// as they're pushed, so a crash of the whole machine, rather than the process,
+// can lose the most recent ones.
+type Queue struct {
+	Dir         string
+	Name        string
+	SegmentSize int64
+	MaxSize     int64
+
+	mu       sync.Mutex
+	segments []*segment // oldest first
+	writer   *os.File   // the newest segment
+	readOff  int64      // offset of the oldest record in segments[0]
+	count    int
+	size     int64
+	notify   chan struct{}
+	closed   bool
+}
+
+type segment struct {
+	seq  int64
+	size int64
+}
+
+// Open opens the queue, creating Dir if necessary, and recovers any records
+// left in it.
+func (q *Queue) Open() error {
+	if q.SegmentSize == 0 {
+		q.SegmentSize = defaultSegmentSize
+	}
+	if q.MaxSize == 0 {
+		q.MaxSize = defaultMaxSize
+	}
+	if q.Name == "" {
+		q.Name = filepath.Base(q.Dir)
+	}
+	q.notify = make(chan struct{}, 1)
+	if err := os.MkdirAll(q.Dir, 0700); err != nil {
+		return err
+	}
+
+	seqs, err := q.listSegments()
+	if err != nil {
+		return err
+	}
+	cursorSeq, cursorOff := q.readCursor()
+	for _, seq := range seqs {
+		if seq < cursorSeq {
+			if err := os.Remove(q.segmentPath(seq)); err != nil {
+				return err
+			}
+			continue
+		}
+		start := int64(0)
+		if seq == cursorSeq {
+			start = cursorOff
+			q.readOff = cursorOff
+		}
+		s, count, size, err := q.scanSegment(seq, start)
+		if err != nil {
+			return err
+		}
+		if seq == cursorSeq && q.readOff > s.size {
+			q.readOff = s.size
+		}
+		q.segments = append(q.segments, s)
+		q.count += count
+		q.size += size
+	}
+
+	if len(q.segments) == 0 {
+		q.readOff = 0
+		err = q.newSegment(cursorSeq + 1)
+	} else {
+		last := q.segments[len(q.segments)-1]
+		q.writer, err = os.OpenFile(q.segmentPath(last.seq), os.O_WRONLY|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	queueRecords.Set(float64(q.count), q.Name)
+	queueBytes.Set(float64(q.size), q.Name)
+	return nil
+}
+
+// Close closes the queue. Records that haven't been popped remain on disk.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	return q.writer.Close()
+}
+
+// Push appends a record to the queue.
+func (q *Queue) Push(record []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	recordSize := int64(headerSize + len(record))
+	if q.size+recordSize > q.MaxSize {
+		queueDropped.Inc(q.Name)
+		return ErrFull
+	}
+
+	last := q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+recordSize > q.SegmentSize {
+		if err := q.writer.Close(); err != nil {
+			return err
+		}
+		if err := q.newSegment(last.seq + 1); err != nil {
+			return err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+
+	buf := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(record))
+	copy(buf[headerSize:], record)
+	if _, err := q.writer.Write(buf); err != nil {
+		return err
+	}
+	last.size += recordSize
+	q.count++
+	q.size += recordSize
+	queueRecords.Set(float64(q.count), q.Name)
+	queueBytes.Set(float64(q.size), q.Name)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek returns up to max of the oldest records in the queue, without removing
+// them.
+func (q *Queue) Peek(max int) ([][]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, ErrClosed
+	}
+
+	var records [][]byte
+	off := q.readOff
+	for _, s := range q.segments {
+		if len(records) >= max {
+			break
+		}
+		if off >= s.size {
+			off = 0
+			continue
+		}
+		f, err := os.Open(q.segmentPath(s.seq))
+		if err != nil {
+			return nil, err
+		}
+		for len(records) < max && off < s.size {
+			record, err := readRecord(f, off)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			records = append(records, record)
+			off += int64(headerSize + len(record))
+		}
+		f.Close()
+		off = 0
+	}
+	return records, nil
+}
+
+// Pop removes the n oldest records from the queue.
+func (q *Queue) Pop(n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+
+	for ; n > 0 && q.count > 0; n-- {
+		for q.readOff >= q.segments[0].size {
+			if err := q.removeHead(); err != nil {
+				return err
+			}
+		}
+		s := q.segments[0]
+		f, err := os.Open(q.segmentPath(s.seq))
+		if err != nil {
+			return err
+		}
+		var header [headerSize]byte
+		_, err = f.ReadAt(header[:], q.readOff)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		recordSize := int64(headerSize + binary.BigEndian.Uint32(header[0:4]))
+		q.readOff += recordSize
+		q.count--
+		q.size -= recordSize
+	}
+	if q.readOff >= q.segments[0].size && len(q.segments) > 1 {
+		if err := q.removeHead(); err != nil {
+			return err
+		}
+	}
+	queueRecords.Set(float64(q.count), q.Name)
+	queueBytes.Set(float64(q.size), q.Name)
+	return q.writeCursor()
+}
+
+// Len returns the number of records in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// Size returns the number of bytes taken up by the records in the queue.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// Notify returns a channel that receives a value after records are pushed.
+func (q *Queue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+// removeHead deletes the oldest segment, which must have been read entirely.
+// The newest segment is never removed.
+func (q *Queue) removeHead() error {
+	if len(q.segments) == 1 {
+		return errors.New("disk queue corrupt: read past the newest segment")
+	}
+	if err := os.Remove(q.segmentPath(q.segments[0].seq)); err != nil {
+		return err
+	}
+	q.segments = q.segments[1:]
+	q.readOff = 0
+	return nil
+}
+
+func (q *Queue) newSegment(seq int64) error {
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	q.writer = f
+	q.segments = append(q.segments, &segment{seq: seq})
+	return nil
+}
+
+func (q *Queue) segmentPath(seq int64) string {
+	return filepath.Join(q.Dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// listSegments returns the sequence numbers of the segment files in Dir, in
+// order.
+func (q *Queue) listSegments() ([]int64, error) {
+	infos, err := ioutil.ReadDir(q.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int64
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// scanSegment counts the records in a segment from offset start. If the
+// segment ends with an incomplete or corrupt record, e.g. because the process
+// was killed while writing it, the segment is truncated to drop it.
+func (q *Queue) scanSegment(seq, start int64) (*segment, int, int64, error) {
+	path := q.segmentPath(seq)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	var count int
+	off := start
+	if off > info.Size() {
+		off = info.Size()
+		start = off
+	}
+	for off < info.Size() {
+		record, err := readRecord(f, off)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"segment": path,
+				"offset":  off,
+				"error":   err,
+			}).Info("Discarding incomplete records at the end of disk queue segment")
+			if err := os.Truncate(path, off); err != nil {
+				return nil, 0, 0, err
+			}
+			break
+		}
+		count++
+		off += int64(headerSize + len(record))
+	}
+	return &segment{seq: seq, size: off}, count, off - start, nil
+}
+
+func readRecord(r io.ReaderAt, off int64) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := r.ReadAt(header[:], off); err != nil {
+		return nil, err
+	}
+	record := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := r.ReadAt(record, off+headerSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return record, nil
+}
+
+// readCursor returns the position of the oldest unpopped record, as saved by
+// writeCursor.
+func (q *Queue) readCursor() (seq, off int64) {
+	data, err := ioutil.ReadFile(filepath.Join(q.Dir, cursorFile))
+	if err != nil {
+		return 0, 0
+	}
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &off); err != nil {
+		return 0, 0
+	}
+	return seq, off
+}
+
+// writeCursor saves the position of the oldest unpopped record. The file is
+// replaced atomically, so it's never seen half-written.
+func (q *Queue) writeCursor() error {
+	path := filepath.Join(q.Dir, cursorFile)
+	tmp := path + ".tmp"
+	data := fmt.Sprintf("%d %d\n", q.segments[0].seq, q.readOff)
+	if err := ioutil.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,160 @@
+package diskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func push(assert *assert.Assertions, q *Queue, from, to int) {
+	for i := from; i < to; i++ {
+		assert.NoError(q.Push([]byte(fmt.Sprintf("record %d", i))))
+	}
+}
+
+func peek(assert *assert.Assertions, q *Queue, max int) []string {
+	records, err := q.Peek(max)
+	assert.NoError(err)
+	var s []string
+	for _, r := range records {
+		s = append(s, string(r))
+	}
+	return s
+}
+
+func TestQueue(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Small segments, so that records span several of them.
+	q := &Queue{Dir: dir, SegmentSize: 40}
+	assert.NoError(q.Open())
+	push(assert, q, 0, 10)
+	assert.Equal(10, q.Len())
+	assert.Equal(int64(10*(headerSize+8)), q.Size())
+	assert.Equal([]string{"record 0", "record 1", "record 2"}, peek(assert, q, 3))
+
+	assert.NoError(q.Pop(3))
+	assert.Equal(7, q.Len())
+	assert.Equal([]string{"record 3", "record 4"}, peek(assert, q, 2))
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	assert.Equal(4, len(segments), "fully popped segments are removed")
+
+	// Reopening the queue resumes after the last popped record.
+	assert.NoError(q.Close())
+	assert.Equal(ErrClosed, q.Push([]byte("closed")))
+	q = &Queue{Dir: dir, SegmentSize: 40}
+	assert.NoError(q.Open())
+	assert.Equal(7, q.Len())
+	assert.Equal([]string{"record 3", "record 4"}, peek(assert, q, 2))
+
+	assert.NoError(q.Pop(7))
+	assert.Equal(0, q.Len())
+	assert.Empty(peek(assert, q, 10))
+	push(assert, q, 10, 11)
+	assert.Equal([]string{"record 10"}, peek(assert, q, 10))
+	assert.NoError(q.Close())
+}
+
+func TestQueueRecovery(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := &Queue{Dir: dir}
+	assert.NoError(q.Open())
+	push(assert, q, 0, 3)
+	assert.NoError(q.Close())
+
+	// Simulate a process killed while writing a record.
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	assert.Equal(1, len(segments))
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(err)
+	f.Write([]byte{0, 0, 0, 100, 1, 2})
+	f.Close()
+
+	q = &Queue{Dir: dir}
+	assert.NoError(q.Open())
+	assert.Equal(3, q.Len())
+	push(assert, q, 3, 4)
+	assert.Equal([]string{"record 0", "record 1", "record 2", "record 3"}, peek(assert, q, 10))
+	assert.NoError(q.Close())
+}
+
+func TestQueueFull(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := &Queue{Dir: dir, MaxSize: 2 * (headerSize + 8)}
+	assert.NoError(q.Open())
+	push(assert, q, 0, 2)
+	assert.Equal(ErrFull, q.Push([]byte("record 2")))
+	assert.NoError(q.Pop(1))
+	assert.NoError(q.Push([]byte("record 2")))
+	assert.NoError(q.Close())
+}
+
+func TestReplayer(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := &Queue{Dir: dir}
+	assert.NoError(q.Open())
+	defer q.Close()
+
+	var mu sync.Mutex
+	var delivered []string
+	attempts := 0
+	r := &Replayer{
+		Queue:      q,
+		BatchSize:  2,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		Deliver: func(records [][]byte) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			// Fail every other attempt, after handling one record.
+			if attempts%2 == 0 {
+				delivered = append(delivered, string(records[0]))
+				return 1, errors.New("downstream unavailable")
+			}
+			for _, record := range records {
+				delivered = append(delivered, string(record))
+			}
+			return len(records), nil
+		},
+	}
+	r.Start()
+	push(assert, q, 0, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(r.Drain(ctx))
+	assert.Equal(0, q.Len())
+	var expected []string
+	for i := 0; i < 10; i++ {
+		expected = append(expected, fmt.Sprintf("record %d", i))
+	}
+	assert.Equal(expected, delivered)
+}
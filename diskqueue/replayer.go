@@ -0,0 +1,116 @@
+package diskqueue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/backoff"
+)
+
+// Replayer delivers the records in a Queue, in order. Deliver is called with
+// up to BatchSize of the oldest records, and returns how many of them it
+// handled, which are then removed from the queue. If Deliver returns an error,
+// the remaining records are retried after a delay that starts at MinBackoff
+// and doubles after each consecutive failure, up to MaxBackoff, with random
+// jitter so that many proxies don't retry in lockstep.
+type Replayer struct {
+	Queue      *Queue
+	Deliver    func(records [][]byte) (int, error)
+	BatchSize  int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func (r *Replayer) Start() error {
+	if r.BatchSize == 0 {
+		r.BatchSize = 1
+	}
+	if r.MinBackoff == 0 {
+		r.MinBackoff = 100 * time.Millisecond
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = time.Minute
+	}
+	r.done = make(chan struct{})
+	r.wg.Add(1)
+	go r.run()
+	return nil
+}
+
+// Stop stops delivering records once the current attempt, if any, finishes.
+// Records that haven't been delivered remain in the queue.
+func (r *Replayer) Stop() error {
+	r.stopOnce.Do(func() { close(r.done) })
+	r.wg.Wait()
+	return nil
+}
+
+// Drain waits until the queue is empty, or until ctx is done, and then stops
+// the Replayer.
+func (r *Replayer) Drain(ctx context.Context) error {
+	defer r.Stop()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for r.Queue.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (r *Replayer) run() {
+	defer r.wg.Done()
+	var failures uint
+	for {
+		records, err := r.Queue.Peek(r.BatchSize)
+		if err != nil {
+			logrus.WithError(err).WithField("queue", r.Queue.Name).Error("Error reading from disk queue")
+		}
+		if len(records) == 0 {
+			select {
+			case <-r.done:
+				return
+			case <-r.Queue.Notify():
+				continue
+			case <-time.After(r.MaxBackoff):
+				// Check again in case an error reading the queue was
+				// temporary.
+				continue
+			}
+		}
+
+		n, err := r.Deliver(records)
+		if n > 0 {
+			if popErr := r.Queue.Pop(n); popErr != nil {
+				logrus.WithError(popErr).WithField("queue", r.Queue.Name).Error("Error removing records from disk queue")
+			}
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		replayErrors.Inc(r.Queue.Name)
+		delay := backoff.Jittered(failures, r.MinBackoff, r.MaxBackoff)
+		failures++
+		logrus.WithFields(logrus.Fields{
+			"queue": r.Queue.Name,
+			"error": err,
+			"retry": delay,
+		}).Info("Error delivering records from disk queue")
+		select {
+		case <-r.done:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
@@ -1,21 +1,36 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/honeycombio/honeycomb-opentracing-proxy/app"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/metrics"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/processors"
 	"github.com/honeycombio/honeycomb-opentracing-proxy/sinks"
 	flag "github.com/jessevdk/go-flags"
 )
 
 type Options struct {
+	Config      string        `long:"config" short:"c" description:"Path to a TOML config file. Settings in the file override flags. The file is reloaded on SIGHUP."`
+	ConfigWatch time.Duration `long:"config_watch" description:"Check the config file for changes this often, and reload it when it changes. Disabled if not set."`
+
+	BufferDir     string `long:"buffer_dir" description:"Directory to queue events for Honeycomb and payloads for the downstream mirror in, so that they survive outages and restarts. Data is queued in memory if this is not set."`
+	BufferMaxSize int64  `long:"buffer_max_size" description:"When --buffer_dir is set, the most bytes to queue on disk for each of Honeycomb and the downstream mirror. Newer data is dropped once this is reached." default:"1073741824"`
+
+	ShutdownTimeout time.Duration `long:"shutdown_timeout" description:"On SIGINT or SIGTERM, the longest time to wait for requests to finish and for queued spans to be sent before exiting" default:"25s"`
+
 	Writekey   string   `long:"writekey" short:"k" description:"Team write key"`
 	Dataset    string   `long:"dataset" short:"d" description:"Name of the dataset to send events to"`
 	Port       string   `long:"port" short:"p" description:"Port to listen on" default:":9411"`
@@ -24,6 +39,88 @@ type Options struct {
 	Downstream string   `long:"downstream" description:"A host to forward span data along to (e.g., https://zipkin.example.com:9411). Use this to send data to Honeycomb and another Zipkin-compatible backend."`
 	DropFields []string `long:"drop_field" description:"Drop any span tags with this name instead of sending them to Honeycomb. You can specify this multiple times."`
 	SampleRate uint     `long:"samplerate" description:"Only forward a sampled subset of traces to Honeycomb. Passing --samplerate=10 will forward 1 out of 10 traces."`
+
+	ServiceDatasets    map[string]string `long:"service_dataset" description:"Send spans from a service to a different dataset, e.g. --service_dataset=checkout:checkout-traces. You can specify this multiple times."`
+	ServiceSampleRates map[string]uint   `long:"service_samplerate" description:"Sample spans from a service at a different rate, e.g. --service_samplerate=checkout:1. You can specify this multiple times."`
+
+	MaxBodySize         int64 `long:"max_body_size" description:"Reject requests whose body is larger than this many bytes as received" default:"16777216"`
+	MaxDecompressedSize int64 `long:"max_decompressed_size" description:"Reject requests compressed with gzip, deflate, zstd or snappy whose body is larger than this many bytes once decompressed" default:"67108864"`
+	MaxSpansPerRequest  int   `long:"max_spans_per_request" description:"Reject requests with more than this many spans. By default, there's no limit."`
+	MaxTagsPerSpan      int   `long:"max_tags_per_span" description:"Reject requests with a span that has more than this many tags. By default, there's no limit."`
+	MaxTagValueLength   int   `long:"max_tag_value_length" description:"Reject requests with a tag value longer than this many bytes. By default, there's no limit."`
+
+	ThrottleQueueFill          float64       `long:"throttle_queue_fill" description:"Reject requests with a 429 while a sink's queue is more than this fraction full, e.g. 0.8. By default, requests aren't throttled."`
+	UnavailableQueueFill       float64       `long:"unavailable_queue_fill" description:"Reject requests with a 503 while a sink's queue is more than this fraction full, e.g. 0.95. By default, requests aren't rejected."`
+	MirrorThrottleQueueFill    float64       `long:"mirror_throttle_queue_fill" description:"Reject requests with a 429 while a downstream mirror's queue is more than this fraction full. By default, a full mirror queue only drops payloads."`
+	MirrorUnavailableQueueFill float64       `long:"mirror_unavailable_queue_fill" description:"Reject requests with a 503 while a downstream mirror's queue is more than this fraction full. By default, a full mirror queue only drops payloads."`
+	ThrottleBufferFill         float64       `long:"throttle_buffer_fill" description:"Reject requests with a 429 while the Honeycomb or a mirror's disk buffer is more than this fraction full. By default, requests aren't throttled."`
+	UnavailableBufferFill      float64       `long:"unavailable_buffer_fill" description:"Reject requests with a 503 while the Honeycomb or a mirror's disk buffer is more than this fraction full. By default, requests aren't rejected."`
+	RetryAfter                 time.Duration `long:"retry_after" description:"How long to ask clients to wait, with the Retry-After header, before retrying requests rejected with a 429 or 503" default:"5s"`
+
+	AllowedWriteKeys []string `long:"allowed_writekey" description:"A Honeycomb write key that clients may send their spans with, using the X-Honeycomb-Team header. Use * to allow any. You can specify this multiple times. The header is ignored if this is not set."`
+	AllowedDatasets  []string `long:"allowed_dataset" description:"A Honeycomb dataset that clients may send their spans to, using the X-Honeycomb-Dataset header or a path such as /api/v2/spans/mydataset. Use * to allow any. You can specify this multiple times. The header is ignored if this is not set."`
+
+	DownstreamFormat                string            `long:"downstream_format" description:"Re-encode spans before sending them to --downstream, after templating and error classification. One of v1_json, v2_json or v2_proto. By default, requests are forwarded as received." choice:"v1_json" choice:"v2_json" choice:"v2_proto"`
+	DownstreamHeaders               map[string]string `long:"downstream_header" description:"A header to add to requests to --downstream, e.g. --downstream_header=X-Scope-OrgID:tracing. You can specify this multiple times."`
+	DownstreamBearerTokenFile       string            `long:"downstream_bearer_token_file" description:"Authenticate to --downstream with the bearer token in this file"`
+	DownstreamBasicAuthUser         string            `long:"downstream_basic_auth_user" description:"Authenticate to --downstream with HTTP basic auth as this user"`
+	DownstreamBasicAuthPasswordFile string            `long:"downstream_basic_auth_password_file" description:"File containing the password for --downstream_basic_auth_user"`
+	DownstreamCAFile                string            `long:"downstream_ca_file" description:"PEM file of certificate authorities to trust for --downstream, instead of the system's"`
+	DownstreamCertFile              string            `long:"downstream_cert_file" description:"PEM client certificate to present to --downstream"`
+	DownstreamKeyFile               string            `long:"downstream_key_file" description:"PEM key for --downstream_cert_file"`
+	DownstreamConnectTimeout        time.Duration     `long:"downstream_connect_timeout" description:"Timeout for connecting to --downstream, including the TLS handshake" default:"10s"`
+	DownstreamRequestTimeout        time.Duration     `long:"downstream_request_timeout" description:"Timeout for each attempt to send a payload to --downstream. Set to 0 to only limit attempts by --mirror_timeout." default:"0s"`
+	DownstreamCompression           string            `long:"downstream_compression" description:"Compress requests to --downstream. Use zstd only if the downstream host supports it. Requests received compressed the same way are forwarded as received, unless --downstream_format is set." choice:"gzip" choice:"zstd"`
+	DownstreamCompressionLevel      int               `long:"downstream_compression_level" description:"Level for --downstream_compression: 1 to 9 for gzip, or 1 to 22 for zstd. Higher levels compress better but use more CPU. 0 means the default level." default:"0"`
+
+	MirrorMaxRetries       int           `long:"mirror_max_retries" description:"Retry sending a payload downstream this many times after network errors and 429 or 5xx responses" default:"3"`
+	MirrorMinBackoff       time.Duration `long:"mirror_min_backoff" description:"Delay before the first retry of a downstream payload. Later retries wait exponentially longer, with random jitter." default:"100ms"`
+	MirrorMaxBackoff       time.Duration `long:"mirror_max_backoff" description:"Longest delay between retries of a downstream payload" default:"10s"`
+	MirrorTimeout          time.Duration `long:"mirror_timeout" description:"Give up sending a payload downstream after this long, including retries" default:"30s"`
+	MirrorBreakerThreshold int           `long:"mirror_breaker_threshold" description:"After this many consecutive failed attempts, assume the downstream is down and stop sending to it for --mirror_breaker_cooldown. Set to 0 to disable." default:"10"`
+	MirrorBreakerCooldown  time.Duration `long:"mirror_breaker_cooldown" description:"How long to stop sending downstream once --mirror_breaker_threshold is reached" default:"30s"`
+
+	ReadyMaxErrorRate  float64 `long:"ready_max_error_rate" description:"Report not ready on /readyz while more than this fraction of recent Honeycomb API requests have failed. Set to 0 to disable." default:"0.5"`
+	ReadyMaxBufferFill float64 `long:"ready_max_buffer_fill" description:"Report not ready on /readyz while the downstream mirror's queue is more than this fraction full. Set to 0 to disable." default:"0.9"`
+
+	HoneycombBestEffort bool `long:"honeycomb_best_effort" description:"Accept requests even if their spans can't be sent to Honeycomb, rather than responding with a 503"`
+
+	HoneycombMaxBatchSize         uint          `long:"honeycomb_max_batch_size" description:"Most events to send to Honeycomb in one request" default:"50"`
+	HoneycombBatchTimeout         time.Duration `long:"honeycomb_batch_timeout" description:"Longest time to wait for a batch of events for Honeycomb to fill before sending it" default:"100ms"`
+	HoneycombMaxConcurrentBatches uint          `long:"honeycomb_max_concurrent_batches" description:"Most requests to Honeycomb to have in flight at once" default:"80"`
+	HoneycombPendingWorkCapacity  uint          `long:"honeycomb_pending_work_capacity" description:"Most events for Honeycomb to hold while they wait to be batched. Newer events are dropped once this is reached." default:"10000"`
+
+	SinkQueueSize         int           `long:"sink_queue_size" description:"Number of requests' spans that can wait to be sent to each sink, so that a slow sink doesn't hold up requests or the other sinks. By default, spans are sent to sinks before responding to each request, so that errors can be reported to clients."`
+	SinkWorkers           int           `long:"sink_workers" description:"Number of goroutines sending queued spans to each sink" default:"1"`
+	SinkQueueOverflow     string        `long:"sink_queue_overflow" description:"What to do with spans when a sink's queue is full: drop the new spans, drop the oldest queued spans, or block the request for up to --sink_queue_block_timeout" choice:"drop_newest" choice:"drop_oldest" choice:"block" default:"drop_newest"`
+	SinkQueueBlockTimeout time.Duration `long:"sink_queue_block_timeout" description:"When --sink_queue_overflow=block, the longest time to wait for room in a sink's queue before dropping the new spans" default:"1s"`
+
+	TemplatePaths     bool     `long:"template_paths" description:"Replace IDs, UUIDs and hex strings in span names and http.url/http.path tags with an {id} placeholder"`
+	PathTemplates     []string `long:"path_template" description:"A route template such as /users/{user}/orders/{order} to use for matching paths when --template_paths is set. You can specify this multiple times."`
+	KeepOriginalPaths bool     `long:"keep_original_paths" description:"When --template_paths is set, keep the untemplated value in a separate field with an .original suffix"`
+
+	ClassifyErrors       bool     `long:"classify_errors" description:"Set a normalized boolean error field, and an error.reason field, on each span. This overwrites any error tag the client set."`
+	ErrorRules           []string `long:"error_rule" description:"An error detection rule to apply when --classify_errors is set: tag, http_status, grpc_status or annotation. You can specify this multiple times. Defaults to all rules."`
+	ErrorTag             string   `long:"error_tag" description:"Span tag that marks a span as failed when it is true" default:"error"`
+	ErrorMinHTTPStatus   int64    `long:"error_min_http_status" description:"Lowest http.status_code value that marks a span as failed" default:"500"`
+	ErrorAnnotationMatch string   `long:"error_annotation_match" description:"Text that marks a span as failed when an annotation contains it" default:"error"`
+
+	TraceSummary        bool          `long:"trace_summary" description:"Buffer spans by trace, and annotate root spans with trace.span_count, trace.service_count, trace.error_count, trace.duration_ms and trace.depth fields"`
+	TraceSummaryTimeout time.Duration `long:"trace_summary_timeout" description:"When --trace_summary is set, send a trace once its root span has arrived and no new spans have arrived for this long" default:"5s"`
+	TraceSummaryMaxWait time.Duration `long:"trace_summary_max_wait" description:"When --trace_summary is set, the longest time to buffer any trace" default:"1m"`
+
+	AdminPort     string `long:"admin_port" description:"Port to serve admin endpoints such as /metrics and /dependencies on. Admin endpoints are disabled if this is not set."`
+	AdminToken    string `long:"admin_token" description:"Bearer token required to use the /settings admin endpoint. The endpoint is disabled if this is not set."`
+	AdminAuditLog string `long:"admin_audit_log" description:"File to append a record of each change made through the /settings admin endpoint to. Changes are logged to stderr if this is not set."`
+
+	Dependencies         bool          `long:"dependencies" description:"Build a service dependency graph from parent/child span relationships, served as JSON at /dependencies on the admin port"`
+	DependenciesDataset  string        `long:"dependencies_dataset" description:"When --dependencies is set, send periodic summary events for each service-to-service edge to this dataset"`
+	DependenciesInterval time.Duration `long:"dependencies_interval" description:"When --dependencies is set, how often to send summary events" default:"1m"`
+	DependenciesWindow   int           `long:"dependencies_window" description:"When --dependencies is set, the number of intervals to include in /dependencies" default:"10"`
+
+	REDMetrics   bool      `long:"red_metrics" description:"Compute request rate, error rate and latency metrics per service and operation from every span, served at /metrics on the admin port"`
+	REDBuckets   []float64 `long:"red_bucket" description:"When --red_metrics is set, an upper bound in seconds for a latency histogram bucket. You can specify this multiple times."`
+	REDMaxSeries int       `long:"red_max_series" description:"When --red_metrics is set, the maximum number of service and operation pairs to track. Additional pairs are recorded as \"other\"." default:"1000"`
 }
 
 func main() {
@@ -32,75 +129,296 @@ func main() {
 		fmt.Println("Error parsing options:", err)
 		os.Exit(1)
 	}
-	if !options.Debug && options.Writekey == "" {
-		fmt.Println("No writekey provided")
-		os.Exit(1)
+	cfg := configFromOptions(options)
+	if options.Config != "" {
+		cfg, err = loadConfig(options.Config, options)
+	} else {
+		err = cfg.Validate()
 	}
-	if !options.Debug && options.Dataset == "" {
-		fmt.Println("No dataset provided")
+	if err != nil {
+		fmt.Println("Invalid configuration:", err)
 		os.Exit(1)
 	}
 
+	honeycombSinks := newHoneycombSinks(cfg)
 	sink := &sinks.CompositeSink{}
-	sink.Add(
-		&sinks.HoneycombSink{
-			Writekey:   options.Writekey,
-			Dataset:    options.Dataset,
-			APIHost:    options.APIHost,
-			DropFields: options.DropFields,
-			SampleRate: options.SampleRate,
-		},
-	)
-	if options.Debug {
-		sink.Add(&sinks.StdoutSink{})
-		logrus.SetLevel(logrus.DebugLevel)
-	}
-
-	sink.Start()
-	defer sink.Stop()
-
-	var mirror *app.Mirror
-	if options.Downstream != "" {
-		downstreamURL, err := url.Parse(options.Downstream)
-		if err != nil {
-			fmt.Printf("Invalid downstream url %s\n", options.Downstream)
-			os.Exit(1)
+	for i, hc := range cfg.Sinks.Honeycomb.sinks() {
+		var s sinks.Sink = honeycombSinks[i]
+		if ts := cfg.Sinks.TraceSummary; ts.Enabled {
+			s = &sinks.TraceSummarySink{
+				Sink:    honeycombSinks[i],
+				Timeout: ts.Timeout.Duration,
+				MaxWait: ts.MaxWait.Duration,
+			}
 		}
-
-		scheme := downstreamURL.Scheme
-		isHTTP := scheme == "http" || scheme == "https"
-		if !isHTTP {
-			fmt.Printf("Invalid downstream url %s. Must be prefixed with http:// or https://\n", options.Downstream)
-			os.Exit(1)
+		sink.AddWithOptions(hc.Name, s, hc.Queue.sinkOptions(!hc.BestEffort))
+	}
+	adminHandlers := make(map[string]http.Handler)
+	if deps := cfg.Sinks.Dependencies; deps.Enabled {
+		dependencySink := &sinks.DependencySink{
+			Dataset:   deps.Dataset,
+			Honeycomb: honeycombSinks[0],
+			Interval:  deps.Interval.Duration,
+			Intervals: deps.Window,
 		}
+		sink.AddWithOptions("dependencies", dependencySink, deps.Queue.sinkOptions(false))
+		adminHandlers["/dependencies"] = dependencySink
+	}
+	// The stdout sink is always added so that it can be turned on and off by
+	// reloading the config file.
+	stdoutSink := &sinks.StdoutSink{}
+	sink.AddWithOptions("stdout", stdoutSink, cfg.Sinks.Stdout.Queue.sinkOptions(false))
 
-		mirror = &app.Mirror{
-			DownstreamURL: downstreamURL,
+	if err := sink.Start(); err != nil {
+		fmt.Printf("Error starting sinks: %v\n", err)
+		os.Exit(1)
+	}
+
+	mirrors, err := startMirrors(cfg)
+	if err != nil {
+		fmt.Printf("Error starting mirror: %v\n", err)
+		os.Exit(1)
+	}
+
+	p := &proxy{
+		options:    options,
+		honeycombs: make(map[string]*sinks.HoneycombSink),
+		stdout:     stdoutSink,
+		processor:  &processors.CompositeProcessor{},
+	}
+	for _, hs := range honeycombSinks {
+		p.honeycombs[hs.Name] = hs
+	}
+	p.apply(cfg)
+	adminHandlers["/metrics"] = metrics.DefaultRegistry
+	if cfg.Listeners.AdminToken != "" {
+		audit := logrus.StandardLogger()
+		if path := cfg.Listeners.AdminAuditLog; path != "" {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				fmt.Printf("Error opening audit log: %v\n", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			audit = logrus.New()
+			audit.Out = f
+			audit.Formatter = &logrus.JSONFormatter{}
+		}
+		adminHandlers["/settings"] = &settingsHandler{
+			Proxy: p,
+			Token: cfg.Listeners.AdminToken,
+			Audit: audit,
 		}
-		mirror.Start()
-		defer mirror.Stop()
 	}
 
 	a := &app.App{
-		Port:   options.Port,
-		Sink:   sink,
-		Mirror: mirror,
+		Port:      cfg.Listeners.Port,
+		Sink:      sink,
+		Mirrors:   mirrors,
+		Processor: p.processor,
+
+		AdminPort:     cfg.Listeners.AdminPort,
+		AdminHandlers: adminHandlers,
+
+		MaxBodySize:         cfg.Listeners.MaxBodySize,
+		MaxDecompressedSize: cfg.Listeners.MaxDecompressedSize,
+		MaxSpansPerRequest:  cfg.Listeners.MaxSpansPerRequest,
+		MaxTagsPerSpan:      cfg.Listeners.MaxTagsPerSpan,
+		MaxTagValueLength:   cfg.Listeners.MaxTagValueLength,
+
+		ThrottleQueueFill:          cfg.Listeners.ThrottleQueueFill,
+		UnavailableQueueFill:       cfg.Listeners.UnavailableQueueFill,
+		MirrorThrottleQueueFill:    cfg.Listeners.MirrorThrottleQueueFill,
+		MirrorUnavailableQueueFill: cfg.Listeners.MirrorUnavailableQueueFill,
+		ThrottleBufferFill:         cfg.Listeners.ThrottleBufferFill,
+		UnavailableBufferFill:      cfg.Listeners.UnavailableBufferFill,
+		RetryAfter:                 cfg.Listeners.RetryAfter.Duration,
+
+		AllowedWriteKeys: cfg.Listeners.AllowedWriteKeys,
+		AllowedDatasets:  cfg.Listeners.AllowedDatasets,
 	}
 	err = a.Start()
 	if err != nil {
 		fmt.Printf("Error starting app: %v\n", err)
 		os.Exit(1)
 	}
-	defer a.Stop()
-	waitForSignal()
+	waitForSignal(p)
+
+	p.mu.Lock()
+	timeout := p.cfg.ShutdownTimeout.Duration
+	p.mu.Unlock()
+	shutdown(a, sink, honeycombSinks, mirrors, timeout)
+}
+
+// newHoneycombSinks returns a HoneycombSink for each of the Honeycomb sinks in
+// cfg, starting with the default one.
+func newHoneycombSinks(cfg *Config) []*sinks.HoneycombSink {
+	var honeycombSinks []*sinks.HoneycombSink
+	for i, hc := range cfg.Sinks.Honeycomb.sinks() {
+		hs := &sinks.HoneycombSink{
+			Name:               hc.Name,
+			Writekey:           hc.Writekey,
+			Dataset:            hc.Dataset,
+			APIHost:            hc.APIHost,
+			DropFields:         hc.DropFields,
+			SampleRate:         hc.SampleRate,
+			ServiceDatasets:    hc.ServiceDatasets,
+			ServiceSampleRates: hc.ServiceSampleRates,
+			Routes:             hc.Routes,
+			MaxErrorRate:       hc.ReadyMaxErrorRate,
+
+			MaxBatchSize:         hc.MaxBatchSize,
+			BatchTimeout:         hc.BatchTimeout.Duration,
+			MaxConcurrentBatches: hc.MaxConcurrentBatches,
+			PendingWorkCapacity:  hc.PendingWorkCapacity,
+		}
+		if cfg.Buffer.Dir != "" {
+			hs.BufferDir = filepath.Join(cfg.Buffer.Dir, "honeycomb-sinks", hc.Name)
+			if i == 0 {
+				// Keep the buffer from before there could be several
+				// sinks, so that events in it are still sent.
+				hs.BufferDir = filepath.Join(cfg.Buffer.Dir, "honeycomb")
+			}
+			hs.BufferMaxSize = cfg.Buffer.MaxSize
+		}
+		honeycombSinks = append(honeycombSinks, hs)
+	}
+	return honeycombSinks
+}
+
+// startMirrors starts a Mirror for each of the downstream hosts in cfg.
+func startMirrors(cfg *Config) ([]*app.Mirror, error) {
+	mc := cfg.Sinks.Mirror
+	var mirrors []*app.Mirror
+	for _, dest := range mc.destinations() {
+		// The URL has already been validated.
+		downstreamURL, _ := url.Parse(dest.Downstream)
+		mirror := &app.Mirror{
+			Name:             dest.Name,
+			DownstreamURL:    downstreamURL,
+			Format:           dest.Format,
+			Services:         dest.Services,
+			Endpoints:        dest.Endpoints,
+			BufSize:          dest.QueueSize,
+			MaxConcurrency:   dest.Concurrency,
+			MaxBufferFill:    mc.ReadyMaxBufferFill,
+			MaxRetries:       mc.MaxRetries,
+			MinBackoff:       mc.MinBackoff.Duration,
+			MaxBackoff:       mc.MaxBackoff.Duration,
+			PayloadTimeout:   mc.Timeout.Duration,
+			BreakerThreshold: mc.BreakerThreshold,
+			BreakerCooldown:  mc.BreakerCooldown.Duration,
+
+			Headers:               dest.Headers,
+			BearerTokenFile:       dest.BearerTokenFile,
+			BasicAuthUser:         dest.BasicAuthUser,
+			BasicAuthPasswordFile: dest.BasicAuthPasswordFile,
+			CAFile:                dest.CAFile,
+			CertFile:              dest.CertFile,
+			KeyFile:               dest.KeyFile,
+			ConnectTimeout:        dest.ConnectTimeout.Duration,
+			RequestTimeout:        dest.RequestTimeout.Duration,
+			Compression:           dest.Compression,
+			CompressionLevel:      dest.CompressionLevel,
+		}
+		if cfg.Buffer.Dir != "" {
+			mirror.BufferDir = filepath.Join(cfg.Buffer.Dir, "mirrors", dest.Name)
+			if dest.legacy {
+				// Keep the buffer from before there could be several
+				// destinations, so that payloads in it are still sent.
+				mirror.BufferDir = filepath.Join(cfg.Buffer.Dir, "mirror")
+				mirror.BufferName = "mirror"
+			}
+			mirror.BufferMaxSize = cfg.Buffer.MaxSize
+		}
+		if err := mirror.Start(); err != nil {
+			return nil, fmt.Errorf("%s: %v", dest.Name, err)
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	return mirrors, nil
 }
 
-func waitForSignal() {
+// shutdown stops the proxy without losing data where possible: it stops
+// accepting requests and waits for those being handled, then flushes the sinks
+// and the mirror. It gives up once timeout has passed, and logs what couldn't
+// be delivered.
+func shutdown(a *app.App, sink *sinks.CompositeSink, honeycombSinks []*sinks.HoneycombSink, mirrors []*app.Mirror, timeout time.Duration) {
+	logrus.WithField("timeout", timeout).Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := a.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Error("Error waiting for requests to finish")
+	}
+
+	var wg sync.WaitGroup
+	for _, mirror := range mirrors {
+		wg.Add(1)
+		go func(mirror *app.Mirror) {
+			defer wg.Done()
+			if err := mirror.Shutdown(ctx); err != nil {
+				logrus.WithError(err).WithField("mirror", mirror.Name).Error("Error flushing downstream mirror")
+			}
+		}(mirror)
+	}
+
+	sinkErr := make(chan error, 1)
+	go func() {
+		sinkErr <- sink.Shutdown(ctx)
+	}()
+	select {
+	case err := <-sinkErr:
+		if err != nil {
+			logrus.WithError(err).Error("Error flushing sinks")
+		}
+	case <-ctx.Done():
+		var pending int
+		for _, hs := range honeycombSinks {
+			pending += hs.Pending()
+		}
+		logrus.WithField("events", pending).Error("Timed out flushing events to Honeycomb; events in the disk buffer, if any, will be sent after a restart")
+	}
+	wg.Wait()
+	logrus.Info("Shutdown complete")
+}
+
+// waitForSignal blocks until the process is asked to exit. In the meantime it
+// reloads the config file on SIGHUP, and when the file changes if
+// --config_watch is set.
+func waitForSignal(p *proxy) {
 	ch := make(chan os.Signal, 1)
 	defer close(ch)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	defer signal.Stop(ch)
-	<-ch
+
+	var watch <-chan time.Time
+	var modTime time.Time
+	if p.options.Config != "" && p.options.ConfigWatch > 0 {
+		ticker := time.NewTicker(p.options.ConfigWatch)
+		defer ticker.Stop()
+		watch = ticker.C
+		modTime = p.configModTime()
+	}
+
+	for {
+		select {
+		case sig := <-ch:
+			if sig != syscall.SIGHUP {
+				return
+			}
+			if p.options.Config == "" {
+				logrus.Info("Received SIGHUP, but no config file was given with --config")
+				continue
+			}
+			p.reload()
+		case <-watch:
+			if t := p.configModTime(); !t.Equal(modTime) {
+				modTime = t
+				p.reload()
+			}
+		}
+	}
 }
 
 func parseFlags() (*Options, error) {
@@ -0,0 +1,298 @@
+// Package metrics implements a small set of Prometheus-style metrics, and
+// serves them in the Prometheus text exposition format. See
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// overflowLabelValue replaces every label value of a series that would take a
+// metric over its MaxSeries limit.
+const overflowLabelValue = "other"
+
+// defaultMaxSeries is the number of distinct label value combinations a
+// metric may have if MaxSeries isn't set.
+const defaultMaxSeries = 1000
+
+// DefaultBuckets are the default histogram buckets, in seconds. They're the
+// same as the Prometheus client libraries' defaults.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry is the Registry that metrics are registered with unless
+// otherwise configured.
+var DefaultRegistry = &Registry{}
+
+// Collector is the interface for a metric that can be written out in the
+// Prometheus text format.
+type Collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry is a set of metrics. It implements http.Handler, serving all of the
+// registered metrics in the Prometheus text format.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	if err := bw.Flush(); err != nil {
+		logrus.WithError(err).Info("Error writing metrics")
+	}
+}
+
+// vec holds the series of a metric, one per distinct combination of label
+// values.
+type vec struct {
+	Name      string
+	Help      string
+	Labels    []string
+	MaxSeries int
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	sum         float64
+	count       uint64
+}
+
+// get returns the series for labelValues, creating it if needed. Callers must
+// hold v.mu.
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.Labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", v.Name, len(v.Labels), len(labelValues)))
+	}
+	if v.series == nil {
+		v.series = make(map[string]*series)
+	}
+	key := strings.Join(labelValues, "\xff")
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+
+	maxSeries := v.MaxSeries
+	if maxSeries == 0 {
+		maxSeries = defaultMaxSeries
+	}
+	if len(v.series) >= maxSeries-1 && len(labelValues) > 0 {
+		labelValues = make([]string, len(v.Labels))
+		for i := range labelValues {
+			labelValues[i] = overflowLabelValue
+		}
+		key = strings.Join(labelValues, "\xff")
+		if s, ok := v.series[key]; ok {
+			return s
+		}
+	}
+	s := &series{labelValues: append([]string(nil), labelValues...)}
+	v.series[key] = s
+	return s
+}
+
+// sortedSeries returns the series ordered by their label values, so that
+// output is stable. Callers must hold v.mu.
+func (v *vec) sortedSeries() []*series {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*series, len(keys))
+	for i, k := range keys {
+		out[i] = v.series[k]
+	}
+	return out
+}
+
+func (v *vec) writeHeader(w *bufio.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.Name, escapeHelp(v.Help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.Name, metricType)
+}
+
+// CounterVec is a counter, partitioned by label values.
+type CounterVec struct {
+	vec
+}
+
+// NewCounterVec returns a CounterVec registered with registry.
+func NewCounterVec(registry *Registry, name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec{Name: name, Help: help, Labels: labels}}
+	registry.Register(c)
+	return c
+}
+
+// Add adds delta, which must not be negative, to the series for labelValues.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	c.get(labelValues).value += delta
+	c.mu.Unlock()
+}
+
+// Inc increments the series for labelValues.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w, "counter")
+	for _, s := range c.sortedSeries() {
+		fmt.Fprintf(w, "%s%s %s\n", c.Name, formatLabels(c.Labels, s.labelValues, "", ""), formatValue(s.value))
+	}
+}
+
+// GaugeVec is a gauge, partitioned by label values.
+type GaugeVec struct {
+	vec
+}
+
+// NewGaugeVec returns a GaugeVec registered with registry.
+func NewGaugeVec(registry *Registry, name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec{Name: name, Help: help, Labels: labels}}
+	registry.Register(g)
+	return g
+}
+
+// Set sets the series for labelValues to value.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	g.get(labelValues).value = value
+	g.mu.Unlock()
+}
+
+// Add adds delta, which may be negative, to the series for labelValues.
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.mu.Lock()
+	g.get(labelValues).value += delta
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writeHeader(w, "gauge")
+	for _, s := range g.sortedSeries() {
+		fmt.Fprintf(w, "%s%s %s\n", g.Name, formatLabels(g.Labels, s.labelValues, "", ""), formatValue(s.value))
+	}
+}
+
+// HistogramVec is a histogram, partitioned by label values. Buckets are the
+// upper bounds of the histogram's buckets, in increasing order; the +Inf
+// bucket is implicit.
+type HistogramVec struct {
+	vec
+	Buckets []float64
+}
+
+// NewHistogramVec returns a HistogramVec registered with registry. If buckets
+// is empty, DefaultBuckets are used.
+func NewHistogramVec(registry *Registry, name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{vec: vec{Name: name, Help: help, Labels: labels}, Buckets: buckets}
+	registry.Register(h)
+	return h
+}
+
+// Observe adds a single observation to the series for labelValues.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.Buckets))
+	}
+	for i, upper := range h.Buckets {
+		if value <= upper {
+			s.buckets[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w, "histogram")
+	for _, s := range h.sortedSeries() {
+		for i, upper := range h.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.Labels, s.labelValues, "le", formatValue(upper)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.Labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, formatLabels(h.Labels, s.labelValues, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.Name, formatLabels(h.Labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+// formatLabels formats label names and values as `{name="value",...}`,
+// optionally with an extra label at the end.
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+escapeLabelValue(extraValue)+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(h string) string {
+	return helpEscaper.Replace(h)
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExposition(t *testing.T) {
+	assert := assert.New(t)
+	r := &Registry{}
+	c := NewCounterVec(r, "requests_total", "Number of requests.", "endpoint")
+	h := NewHistogramVec(r, "latency_seconds", "Request latency.", []float64{1, 0.1}, "endpoint")
+	g := NewGaugeVec(r, "queue_length", "Queue length.")
+
+	c.Inc("/b")
+	c.Add(2, `/a"quoted"`)
+	h.Observe(0.05, "/a")
+	h.Observe(0.5, "/a")
+	g.Set(7)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	assert.Equal(`# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{endpoint="/a\"quoted\""} 2
+requests_total{endpoint="/b"} 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="/a",le="0.1"} 1
+latency_seconds_bucket{endpoint="/a",le="1"} 2
+latency_seconds_bucket{endpoint="/a",le="+Inf"} 2
+latency_seconds_sum{endpoint="/a"} 0.55
+latency_seconds_count{endpoint="/a"} 2
+# HELP queue_length Queue length.
+# TYPE queue_length gauge
+queue_length 7
+`, string(body))
+}
+
+func TestMaxSeries(t *testing.T) {
+	assert := assert.New(t)
+	c := NewCounterVec(&Registry{}, "requests_total", "Number of requests.", "service", "operation")
+	c.MaxSeries = 3
+	c.Inc("a", "x")
+	c.Inc("b", "x")
+	c.Inc("c", "x")
+	c.Inc("d", "x")
+	c.Inc("a", "x")
+
+	assert.Equal(3, len(c.series))
+	assert.Equal(2.0, c.get([]string{"a", "x"}).value)
+	assert.Equal(2.0, c.get([]string{"other", "other"}).value)
+}
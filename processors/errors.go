@@ -0,0 +1,149 @@
+package processors
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+const errorKey = "error"
+const errorReasonKey = "error.reason"
+
+// The detection rules an ErrorClassifier can apply.
+const (
+	ErrorRuleTag        = "tag"
+	ErrorRuleHTTPStatus = "http_status"
+	ErrorRuleGRPCStatus = "grpc_status"
+	ErrorRuleAnnotation = "annotation"
+)
+
+// ErrorRules lists all of the detection rules, in the order they're applied by
+// default.
+var ErrorRules = []string{ErrorRuleTag, ErrorRuleHTTPStatus, ErrorRuleGRPCStatus, ErrorRuleAnnotation}
+
+// ErrorClassifier implements the Processor interface. Tracers signal errors in
+// different ways, so it sets a normalized boolean `error` field on every span,
+// and an `error.reason` field describing which rule matched on failed spans.
+// An `error` tag that the span already has is overwritten, e.g. "connection
+// reset" becomes true; its value is kept in `error.reason` if the tag rule
+// matched.
+// The rules are:
+// - tag: the ErrorTag tag is true, or a non-empty string other than "false".
+// - http_status: the HTTPStatusTag tag is at least MinHTTPStatus.
+// - grpc_status: the GRPCStatusTag tag is non-zero.
+// - annotation: an annotation value contains AnnotationMatch (ignoring case).
+// Rules are tried in the order given in Rules, and the first match wins. Zero
+// values are replaced with defaults that match common OpenTracing and Zipkin
+// conventions.
+type ErrorClassifier struct {
+	Rules           []string
+	ErrorTag        string
+	HTTPStatusTag   string
+	MinHTTPStatus   int64
+	GRPCStatusTag   string
+	AnnotationMatch string
+
+	once sync.Once
+}
+
+// Validate checks that all of the configured rules are known.
+func (ec *ErrorClassifier) Validate() error {
+	for _, r := range ec.Rules {
+		switch r {
+		case ErrorRuleTag, ErrorRuleHTTPStatus, ErrorRuleGRPCStatus, ErrorRuleAnnotation:
+		default:
+			return fmt.Errorf("unknown error rule %q", r)
+		}
+	}
+	return nil
+}
+
+func (ec *ErrorClassifier) setDefaults() {
+	if len(ec.Rules) == 0 {
+		ec.Rules = ErrorRules
+	}
+	if ec.ErrorTag == "" {
+		ec.ErrorTag = "error"
+	}
+	if ec.HTTPStatusTag == "" {
+		ec.HTTPStatusTag = "http.status_code"
+	}
+	if ec.MinHTTPStatus == 0 {
+		ec.MinHTTPStatus = 500
+	}
+	if ec.GRPCStatusTag == "" {
+		ec.GRPCStatusTag = "status.code"
+	}
+	if ec.AnnotationMatch == "" {
+		ec.AnnotationMatch = "error"
+	}
+	ec.AnnotationMatch = strings.ToLower(ec.AnnotationMatch)
+}
+
+func (ec *ErrorClassifier) Process(span *types.Span) {
+	ec.once.Do(ec.setDefaults)
+	if span.BinaryAnnotations == nil {
+		span.BinaryAnnotations = make(map[string]interface{})
+	}
+
+	reason := ec.classify(span)
+	span.BinaryAnnotations[errorKey] = reason != ""
+	if reason != "" {
+		span.BinaryAnnotations[errorReasonKey] = reason
+	}
+}
+
+// classify returns a description of why the span is considered failed, or the
+// empty string if it isn't.
+func (ec *ErrorClassifier) classify(span *types.Span) string {
+	for _, rule := range ec.Rules {
+		switch rule {
+		case ErrorRuleTag:
+			switch v := span.BinaryAnnotations[ec.ErrorTag].(type) {
+			case bool:
+				if v {
+					return ec.ErrorTag
+				}
+			case string:
+				if v != "" && v != "false" {
+					return fmt.Sprintf("%s: %s", ec.ErrorTag, v)
+				}
+			}
+		case ErrorRuleHTTPStatus:
+			if status, ok := extractInt(span.BinaryAnnotations[ec.HTTPStatusTag]); ok && status >= ec.MinHTTPStatus {
+				return fmt.Sprintf("%s=%d", ec.HTTPStatusTag, status)
+			}
+		case ErrorRuleGRPCStatus:
+			if code, ok := extractInt(span.BinaryAnnotations[ec.GRPCStatusTag]); ok && code != 0 {
+				return fmt.Sprintf("%s=%d", ec.GRPCStatusTag, code)
+			}
+		case ErrorRuleAnnotation:
+			for _, a := range span.Annotations {
+				if strings.Contains(strings.ToLower(a.Value), ec.AnnotationMatch) {
+					return fmt.Sprintf("annotation: %s", a.Value)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// extractInt gets an integer out of a tag value. Zipkin v2 tags are always
+// strings, and JSON numbers are decoded as float64, so handle both as well as
+// the int64 values produced by types.GuessAnnotationType.
+func extractInt(v interface{}) (int64, bool) {
+	switch val := v.(type) {
+	case int64:
+		return val, true
+	case float64:
+		return int64(val), true
+	case string:
+		i, err := strconv.ParseInt(val, 10, 64)
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,45 @@
+package processors
+
+import (
+	"sync"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// Processor is the interface for transforming spans after they've been
+// decoded, and before they're handed to a sink, e.g. normalizing
+// high-cardinality values.
+type Processor interface {
+	Process(*types.Span)
+}
+
+// CompositeProcessor is an implementation of Processor that runs each
+// provided individual processor in the order they were added. The set of
+// processors can be replaced while spans are being processed.
+type CompositeProcessor struct {
+	mu         sync.RWMutex
+	processors []Processor
+}
+
+func (cp *CompositeProcessor) Add(p Processor) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.processors = append(cp.processors, p)
+}
+
+// Replace atomically replaces all of the processors. Spans that are already
+// being processed finish with the old set.
+func (cp *CompositeProcessor) Replace(ps []Processor) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.processors = ps
+}
+
+func (cp *CompositeProcessor) Process(span *types.Span) {
+	cp.mu.RLock()
+	ps := cp.processors
+	cp.mu.RUnlock()
+	for _, p := range ps {
+		p.Process(span)
+	}
+}
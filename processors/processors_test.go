@@ -0,0 +1,145 @@
+package processors
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/metrics"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSpan(name string, tags map[string]interface{}) *types.Span {
+	if tags == nil {
+		tags = make(map[string]interface{})
+	}
+	return &types.Span{
+		CoreSpanMetadata:  types.CoreSpanMetadata{Name: name},
+		BinaryAnnotations: tags,
+	}
+}
+
+func TestPathTemplating(t *testing.T) {
+	assert := assert.New(t)
+	pt := &PathTemplater{}
+
+	testCases := []struct {
+		in       string
+		expected string
+	}{
+		{"GET /users/8812/orders/4411", "GET /users/{id}/orders/{id}"},
+		{"/objects/5a0c3b7e9f1d2c4b8e6a7f01", "/objects/{id}"},
+		{"/objects/6ba7b810-9dad-11d1-80b4-00c04fd430c8/meta", "/objects/{id}/meta"},
+		{"/feed/cafe/deadbeef", "/feed/cafe/deadbeef"},
+		{"/v1/users/12?page=2", "/v1/users/{id}?page=2"},
+		{"executeQuery", "executeQuery"},
+	}
+	for _, tc := range testCases {
+		span := newSpan(tc.in, nil)
+		pt.Process(span)
+		assert.Equal(tc.expected, span.Name)
+		assert.NotContains(span.BinaryAnnotations, "name.original")
+	}
+
+	span := newSpan("GET", map[string]interface{}{
+		"http.url":  "https://api.example.com/users/8812?expand=true",
+		"http.path": "/users/8812",
+	})
+	pt.Process(span)
+	assert.Equal("https://api.example.com/users/{id}?expand=true", span.BinaryAnnotations["http.url"])
+	assert.Equal("/users/{id}", span.BinaryAnnotations["http.path"])
+}
+
+func TestPathTemplatingWithTemplates(t *testing.T) {
+	assert := assert.New(t)
+	pt := &PathTemplater{
+		Templates:    []string{"/users/{user}/orders/{order}", "/teams/{team}"},
+		KeepOriginal: true,
+	}
+
+	span := newSpan("GET /users/alice/orders/4411", map[string]interface{}{
+		"http.path": "/teams/honeycomb",
+	})
+	pt.Process(span)
+	assert.Equal("GET /users/{user}/orders/{order}", span.Name)
+	assert.Equal("GET /users/alice/orders/4411", span.BinaryAnnotations["name.original"])
+	assert.Equal("/teams/{team}", span.BinaryAnnotations["http.path"])
+	assert.Equal("/teams/honeycomb", span.BinaryAnnotations["http.path.original"])
+
+	// Paths that don't match any template still have their IDs templated.
+	span = newSpan("GET /users/8812", nil)
+	pt.Process(span)
+	assert.Equal("GET /users/{id}", span.Name)
+}
+
+func TestErrorClassification(t *testing.T) {
+	assert := assert.New(t)
+	ec := &ErrorClassifier{}
+
+	testCases := []struct {
+		span   *types.Span
+		reason string
+	}{
+		{newSpan("ok", map[string]interface{}{"http.status_code": int64(200)}), ""},
+		{newSpan("tag", map[string]interface{}{"error": true}), "error"},
+		{newSpan("tagString", map[string]interface{}{"error": "connection reset"}), "error: connection reset"},
+		{newSpan("tagFalse", map[string]interface{}{"error": false}), ""},
+		{newSpan("http", map[string]interface{}{"http.status_code": "503"}), "http.status_code=503"},
+		{newSpan("grpc", map[string]interface{}{"status.code": float64(14)}), "status.code=14"},
+		{
+			&types.Span{
+				Annotations:       []*types.Annotation{{Value: "cs"}, {Value: "Error: timeout"}},
+				BinaryAnnotations: map[string]interface{}{},
+			},
+			"annotation: Error: timeout",
+		},
+	}
+	for _, tc := range testCases {
+		ec.Process(tc.span)
+		assert.Equal(tc.reason != "", tc.span.BinaryAnnotations["error"], tc.span.Name)
+		if tc.reason == "" {
+			assert.NotContains(tc.span.BinaryAnnotations, "error.reason")
+		} else {
+			assert.Equal(tc.reason, tc.span.BinaryAnnotations["error.reason"])
+		}
+	}
+
+	// Only the configured rules are applied.
+	ec = &ErrorClassifier{Rules: []string{ErrorRuleHTTPStatus}, MinHTTPStatus: 400}
+	assert.NoError(ec.Validate())
+	span := newSpan("http", map[string]interface{}{"http.status_code": int64(404), "status.code": int64(5)})
+	ec.Process(span)
+	assert.Equal("http.status_code=404", span.BinaryAnnotations["error.reason"])
+	span = newSpan("grpc", map[string]interface{}{"status.code": int64(5)})
+	ec.Process(span)
+	assert.Equal(false, span.BinaryAnnotations["error"])
+
+	assert.Error((&ErrorClassifier{Rules: []string{"bogus"}}).Validate())
+}
+
+func TestREDMetrics(t *testing.T) {
+	assert := assert.New(t)
+	registry := &metrics.Registry{}
+	rm := &REDMetrics{Registry: registry, Buckets: []float64{0.01, 0.1}}
+
+	for _, durationMs := range []float64{5, 50, 500} {
+		span := newSpan("GET /users/{id}", map[string]interface{}{"error": durationMs > 100})
+		span.ServiceName = "frontend"
+		span.DurationMs = durationMs
+		rm.Process(span)
+	}
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, line := range []string{
+		`spans_total{service="frontend",operation="GET /users/{id}"} 3`,
+		`span_errors_total{service="frontend",operation="GET /users/{id}"} 1`,
+		`span_duration_seconds_bucket{service="frontend",operation="GET /users/{id}",le="0.01"} 1`,
+		`span_duration_seconds_bucket{service="frontend",operation="GET /users/{id}",le="0.1"} 2`,
+		`span_duration_seconds_count{service="frontend",operation="GET /users/{id}"} 3`,
+	} {
+		assert.Contains(string(body), line)
+	}
+}
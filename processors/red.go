@@ -0,0 +1,53 @@
+package processors
+
+import (
+	"sync"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/metrics"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// REDMetrics implements the Processor interface. It doesn't modify spans, but
+// records request rate, error rate and latency (RED) metrics per service and
+// operation (span name) in Registry. Because processors run before any
+// sampling, the metrics cover every span the proxy receives.
+//
+// Spans count as errors if their `error` field is true, so REDMetrics should
+// run after an ErrorClassifier if there is one. Buckets are the latency
+// histogram buckets in seconds, and MaxSeries limits the number of distinct
+// service and operation pairs; additional pairs are recorded as "other".
+type REDMetrics struct {
+	Registry  *metrics.Registry
+	Buckets   []float64
+	MaxSeries int
+
+	once     sync.Once
+	spans    *metrics.CounterVec
+	errors   *metrics.CounterVec
+	duration *metrics.HistogramVec
+}
+
+func (rm *REDMetrics) init() {
+	if rm.Registry == nil {
+		rm.Registry = metrics.DefaultRegistry
+	}
+	rm.spans = metrics.NewCounterVec(rm.Registry, "spans_total",
+		"Number of spans received, by service and operation.", "service", "operation")
+	rm.errors = metrics.NewCounterVec(rm.Registry, "span_errors_total",
+		"Number of failed spans received, by service and operation.", "service", "operation")
+	rm.duration = metrics.NewHistogramVec(rm.Registry, "span_duration_seconds",
+		"Span durations, by service and operation.", rm.Buckets, "service", "operation")
+	rm.spans.MaxSeries = rm.MaxSeries
+	rm.errors.MaxSeries = rm.MaxSeries
+	rm.duration.MaxSeries = rm.MaxSeries
+}
+
+func (rm *REDMetrics) Process(span *types.Span) {
+	rm.once.Do(rm.init)
+
+	rm.spans.Inc(span.ServiceName, span.Name)
+	if isError, _ := span.BinaryAnnotations[errorKey].(bool); isError {
+		rm.errors.Inc(span.ServiceName, span.Name)
+	}
+	rm.duration.Observe(span.DurationMs/1000, span.ServiceName, span.Name)
+}
@@ -0,0 +1,192 @@
+package processors
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+const idPlaceholder = "{id}"
+const originalSuffix = ".original"
+
+// Hex strings shorter than this are too likely to be ordinary words (e.g.
+// "cafe" or "feed") to be treated as IDs.
+const minHexIDLength = 8
+
+// urlTagKeys are the span tags that hold a URL or URL path, and should be
+// templated along with the span name.
+var urlTagKeys = []string{"http.url", "http.path"}
+
+// PathTemplater implements the Processor interface. It replaces numeric IDs,
+// UUIDs and hex strings in URL paths with an `{id}` placeholder, so that span
+// names like `GET /users/8812/orders/4411` don't blow up the cardinality of
+// the `name` field. Both the span name and the `http.url` and `http.path` tags
+// are templated.
+//
+// Paths matching one of Templates, e.g. `/users/{user}/orders/{order}`, are
+// replaced by that template instead. If KeepOriginal is set, the untemplated
+// value is kept in a separate field with an `.original` suffix.
+type PathTemplater struct {
+	Templates    []string
+	KeepOriginal bool
+
+	once      sync.Once
+	templates [][]string
+}
+
+func (pt *PathTemplater) Process(span *types.Span) {
+	pt.once.Do(func() {
+		for _, t := range pt.Templates {
+			pt.templates = append(pt.templates, strings.Split(t, "/"))
+		}
+	})
+
+	if name := pt.templateName(span.Name); name != span.Name {
+		if pt.KeepOriginal {
+			if span.BinaryAnnotations == nil {
+				span.BinaryAnnotations = make(map[string]interface{})
+			}
+			span.BinaryAnnotations["name"+originalSuffix] = span.Name
+		}
+		span.Name = name
+	}
+
+	for _, k := range urlTagKeys {
+		v, ok := span.BinaryAnnotations[k].(string)
+		if !ok {
+			continue
+		}
+		if templated := pt.templateURL(v); templated != v {
+			if pt.KeepOriginal {
+				span.BinaryAnnotations[k+originalSuffix] = v
+			}
+			span.BinaryAnnotations[k] = templated
+		}
+	}
+}
+
+// templateName templates any path in a span name. Names commonly contain an
+// HTTP method followed by a path, so each space-separated word that looks like
+// a path is templated independently.
+func (pt *PathTemplater) templateName(name string) string {
+	if !strings.Contains(name, "/") {
+		return name
+	}
+	words := strings.Split(name, " ")
+	for i, w := range words {
+		if strings.HasPrefix(w, "/") {
+			words[i] = pt.templateURL(w)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// templateURL templates the path component of either a full URL or a bare
+// path. The scheme, host, query string and fragment are left untouched. We
+// don't round-trip through url.URL here, since that would escape the braces
+// of the placeholders.
+func (pt *PathTemplater) templateURL(u string) string {
+	start := 0
+	if i := strings.Index(u, "://"); i >= 0 {
+		j := strings.Index(u[i+3:], "/")
+		if j < 0 {
+			return u
+		}
+		start = i + 3 + j
+	}
+	end := len(u)
+	if i := strings.IndexAny(u[start:], "?#"); i >= 0 {
+		end = start + i
+	}
+	return u[:start] + pt.templatePath(u[start:end]) + u[end:]
+}
+
+func (pt *PathTemplater) templatePath(path string) string {
+	segments := strings.Split(path, "/")
+	for _, t := range pt.templates {
+		if matchTemplate(t, segments) {
+			return strings.Join(t, "/")
+		}
+	}
+	for i, s := range segments {
+		if isID(s) {
+			segments[i] = idPlaceholder
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// matchTemplate reports whether the path segments match the template
+// segments. Template segments of the form `{name}` match any non-empty
+// segment; all others must match exactly.
+func matchTemplate(template, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, t := range template {
+		if isPlaceholder(t) {
+			if segments[i] == "" {
+				return false
+			}
+		} else if t != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isPlaceholder(s string) bool {
+	return len(s) > 2 && s[0] == '{' && s[len(s)-1] == '}'
+}
+
+// isID reports whether a path segment looks like an identifier: a decimal
+// number, a UUID, or a hex string of at least minHexIDLength characters
+// containing at least one digit.
+func isID(s string) bool {
+	if s == "" {
+		return false
+	}
+	if isDigits(s) || isUUID(s) {
+		return true
+	}
+	return len(s) >= minHexIDLength && isHex(s) && strings.IndexAny(s, "0123456789") >= 0
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// isUUID reports whether s has the canonical 8-4-4-4-12 UUID form.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !isHex(string(c)) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/processors"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/sinks"
+)
+
+// proxy holds the running components whose settings can be changed by
+// reloading the config file or through the admin API. Other settings, such as
+// listener ports, only take effect on restart.
+type proxy struct {
+	options *Options
+
+	// mu serializes changes to the configuration.
+	mu  sync.Mutex
+	cfg *Config
+	// honeycombs are the Honeycomb sinks, by name.
+	honeycombs map[string]*sinks.HoneycombSink
+	stdout     *sinks.StdoutSink
+	processor  *processors.CompositeProcessor
+
+	// red is created at most once, and kept across reloads, since its
+	// metrics can only be registered once.
+	red *processors.REDMetrics
+}
+
+// apply updates the running components to match cfg.
+func (p *proxy) apply(cfg *Config) {
+	if cfg.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+
+	for _, hc := range cfg.Sinks.Honeycomb.sinks() {
+		// Sinks that were added since the proxy started only run after a
+		// restart.
+		if hs, ok := p.honeycombs[hc.Name]; ok {
+			hs.SetSettings(hc.settings())
+		}
+	}
+	p.stdout.SetEnabled(cfg.Sinks.Stdout.Enabled)
+	p.processor.Replace(p.processors(cfg))
+	p.cfg = cfg
+}
+
+// processors returns the processor chain described by cfg.
+func (p *proxy) processors(cfg *Config) []processors.Processor {
+	var ps []processors.Processor
+	if pt := cfg.Processors.PathTemplating; pt.Enabled {
+		ps = append(ps, &processors.PathTemplater{
+			Templates:    pt.Templates,
+			KeepOriginal: pt.KeepOriginal,
+		})
+	}
+	if cfg.Processors.ErrorClassification.Enabled {
+		ps = append(ps, cfg.errorClassifier())
+	}
+	if red := cfg.Processors.REDMetrics; red.Enabled {
+		if p.red == nil {
+			p.red = &processors.REDMetrics{
+				Buckets:   red.Buckets,
+				MaxSeries: red.MaxSeries,
+			}
+		}
+		ps = append(ps, p.red)
+	}
+	return ps
+}
+
+// reload reads the config file again, and applies it if it's valid. Requests
+// that are being handled aren't interrupted. Any changes made through the
+// admin API are replaced.
+func (p *proxy) reload() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cfg, err := loadConfig(p.options.Config, p.options)
+	if err != nil {
+		logrus.WithError(err).Error("Invalid config file, keeping the current config")
+		return
+	}
+	for _, setting := range p.restartRequired(cfg) {
+		logrus.WithField("setting", setting).Warn("Changed setting will only take effect after a restart")
+	}
+	p.apply(cfg)
+	logrus.WithField("config", p.options.Config).Info("Reloaded config file")
+}
+
+// restartRequired returns the names of the settings that differ between the
+// current config and cfg, but can't be changed while the proxy is running.
+func (p *proxy) restartRequired(cfg *Config) []string {
+	var changed []string
+	check := func(setting string, old, new interface{}) {
+		if !reflect.DeepEqual(old, new) {
+			changed = append(changed, setting)
+		}
+	}
+	check("listeners", p.cfg.Listeners, cfg.Listeners)
+	check("buffer", p.cfg.Buffer, cfg.Buffer)
+	check("sinks.honeycomb.writekey", p.cfg.Sinks.Honeycomb.Writekey, cfg.Sinks.Honeycomb.Writekey)
+	check("sinks.honeycomb.api_host", p.cfg.Sinks.Honeycomb.APIHost, cfg.Sinks.Honeycomb.APIHost)
+	check("sinks.honeycomb.ready_max_error_rate", p.cfg.Sinks.Honeycomb.ReadyMaxErrorRate, cfg.Sinks.Honeycomb.ReadyMaxErrorRate)
+	check("sinks.honeycomb.best_effort", p.cfg.Sinks.Honeycomb.BestEffort, cfg.Sinks.Honeycomb.BestEffort)
+	check("sinks.honeycomb.max_batch_size", p.cfg.Sinks.Honeycomb.MaxBatchSize, cfg.Sinks.Honeycomb.MaxBatchSize)
+	check("sinks.honeycomb.batch_timeout", p.cfg.Sinks.Honeycomb.BatchTimeout, cfg.Sinks.Honeycomb.BatchTimeout)
+	check("sinks.honeycomb.max_concurrent_batches", p.cfg.Sinks.Honeycomb.MaxConcurrentBatches, cfg.Sinks.Honeycomb.MaxConcurrentBatches)
+	check("sinks.honeycomb.pending_work_capacity", p.cfg.Sinks.Honeycomb.PendingWorkCapacity, cfg.Sinks.Honeycomb.PendingWorkCapacity)
+	check("sinks.honeycomb.queue", p.cfg.Sinks.Honeycomb.Queue, cfg.Sinks.Honeycomb.Queue)
+	// Named Honeycomb sinks can't be added or removed either.
+	oldDests := make(map[string]HoneycombSinkConfig)
+	for _, dest := range p.cfg.Sinks.Honeycomb.Destinations {
+		oldDests[dest.Name] = dest.restartOnly()
+	}
+	newDests := make(map[string]bool)
+	for _, dest := range cfg.Sinks.Honeycomb.Destinations {
+		check("sinks.honeycomb.destinations."+dest.Name, oldDests[dest.Name], dest.restartOnly())
+		newDests[dest.Name] = true
+	}
+	for _, dest := range p.cfg.Sinks.Honeycomb.Destinations {
+		if !newDests[dest.Name] {
+			changed = append(changed, "sinks.honeycomb.destinations."+dest.Name)
+		}
+	}
+	check("sinks.stdout.queue", p.cfg.Sinks.Stdout.Queue, cfg.Sinks.Stdout.Queue)
+	check("sinks.mirror", p.cfg.Sinks.Mirror, cfg.Sinks.Mirror)
+	check("sinks.trace_summary", p.cfg.Sinks.TraceSummary, cfg.Sinks.TraceSummary)
+	check("sinks.dependencies", p.cfg.Sinks.Dependencies, cfg.Sinks.Dependencies)
+	if p.red != nil {
+		check("processors.red_metrics.buckets", p.red.Buckets, cfg.Processors.REDMetrics.Buckets)
+		check("processors.red_metrics.max_series", p.red.MaxSeries, cfg.Processors.REDMetrics.MaxSeries)
+	}
+	return changed
+}
+
+// restartOnly returns the settings of hc that can't be changed while the
+// proxy is running, with the others left empty.
+func (hc HoneycombSinkConfig) restartOnly() HoneycombSinkConfig {
+	return HoneycombSinkConfig{
+		Writekey:             hc.Writekey,
+		APIHost:              hc.APIHost,
+		ReadyMaxErrorRate:    hc.ReadyMaxErrorRate,
+		BestEffort:           hc.BestEffort,
+		MaxBatchSize:         hc.MaxBatchSize,
+		BatchTimeout:         hc.BatchTimeout,
+		MaxConcurrentBatches: hc.MaxConcurrentBatches,
+		PendingWorkCapacity:  hc.PendingWorkCapacity,
+		Queue:                hc.Queue,
+	}
+}
+
+// configModTime returns the modification time of the config file, or the
+// zero time if it can't be read.
+func (p *proxy) configModTime() time.Time {
+	info, err := os.Stat(p.options.Config)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,271 @@
+package sinks
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// DependencyEdge is a caller/callee relationship between two services, with
+// the number of calls and failed calls observed over the DependencySink's
+// window.
+type DependencyEdge struct {
+	Parent string `json:"parent"`
+	Child  string `json:"child"`
+	Calls  int64  `json:"calls"`
+	Errors int64  `json:"errors"`
+}
+
+type edgeKey struct {
+	parent string
+	child  string
+}
+
+type spanKey struct {
+	traceID string
+	id      string
+}
+
+type spanInfo struct {
+	service  string
+	parentID string
+	isError  bool
+	isClient bool
+}
+
+// DependencySink implements the Sink interface. It watches parent/child
+// relationships between spans, and builds a rolling list of service-to-service
+// edges with call and error counts over the last Intervals intervals of
+// length Interval. It serves that list as JSON, and if Dataset is set, sends
+// one summary event per edge to that Honeycomb dataset with the Honeycomb sink
+// at the end of every interval, and for the partial interval on Stop. Stop
+// must be called before the Honeycomb sink is stopped for those to be sent.
+//
+// Parents and children are matched across requests, as long as they arrive
+// within roughly one interval of each other.
+type DependencySink struct {
+	Dataset   string
+	Honeycomb *HoneycombSink
+	Interval  time.Duration
+	Intervals int
+
+	mu          sync.Mutex
+	spans       map[spanKey]spanInfo
+	prevSpans   map[spanKey]spanInfo
+	pending     map[spanKey][]spanInfo
+	prevPending map[spanKey][]spanInfo
+	edges       []map[edgeKey]*DependencyEdge
+	started     time.Time // when the current interval started
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func (ds *DependencySink) Start() error {
+	if ds.Interval <= 0 {
+		ds.Interval = time.Minute
+	}
+	if ds.Intervals <= 0 {
+		ds.Intervals = 10
+	}
+	ds.spans = make(map[spanKey]spanInfo)
+	ds.pending = make(map[spanKey][]spanInfo)
+	ds.edges = []map[edgeKey]*DependencyEdge{make(map[edgeKey]*DependencyEdge)}
+	ds.started = time.Now()
+	ds.done = make(chan struct{})
+	ds.wg.Add(1)
+	go ds.run()
+	return nil
+}
+
+func (ds *DependencySink) Stop() error {
+	close(ds.done)
+	ds.wg.Wait()
+	ds.rotate(time.Now())
+	return nil
+}
+
+func (ds *DependencySink) Send(spans []*types.Span) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, s := range spans {
+		if s.ServiceName == "" {
+			continue
+		}
+		isError, _ := s.BinaryAnnotations["error"].(bool)
+		info := spanInfo{
+			service:  s.ServiceName,
+			parentID: s.ParentID,
+			isError:  isError,
+			isClient: isClientSpan(s),
+		}
+		ds.add(spanKey{s.TraceID, s.ID}, info)
+	}
+	return nil
+}
+
+// add records a span, and any edges that can be derived from it. Callers must
+// hold ds.mu.
+func (ds *DependencySink) add(key spanKey, info spanInfo) {
+	shared, isShared := ds.lookup(key)
+	if isShared && shared.service == info.service {
+		return
+	}
+	// For a span shared between a client and a server, the server half is
+	// the one that the span's children belong to.
+	if !isShared || !info.isClient {
+		ds.spans[key] = info
+	}
+
+	// Both halves of a shared span have the same parent, which belongs to
+	// the client's service, so only the server half produces an edge here.
+	if info.parentID != "" {
+		parentKey := spanKey{key.traceID, info.parentID}
+		if parent, ok := ds.lookup(parentKey); ok {
+			ds.record(parent.service, info.service, info.isError)
+		} else {
+			ds.pending[parentKey] = append(ds.pending[parentKey], info)
+		}
+	}
+
+	if isShared {
+		return
+	}
+	for _, pending := range []map[spanKey][]spanInfo{ds.pending, ds.prevPending} {
+		for _, child := range pending[key] {
+			ds.record(info.service, child.service, child.isError)
+		}
+		delete(pending, key)
+	}
+}
+
+func (ds *DependencySink) lookup(key spanKey) (spanInfo, bool) {
+	if info, ok := ds.spans[key]; ok {
+		return info, true
+	}
+	info, ok := ds.prevSpans[key]
+	return info, ok
+}
+
+func (ds *DependencySink) record(parent, child string, isError bool) {
+	if parent == child {
+		return
+	}
+	key := edgeKey{parent, child}
+	current := ds.edges[len(ds.edges)-1]
+	e, ok := current[key]
+	if !ok {
+		e = &DependencyEdge{Parent: parent, Child: child}
+		current[key] = e
+	}
+	e.Calls++
+	if isError {
+		e.Errors++
+	}
+}
+
+// Edges returns the service-to-service edges seen over the current window,
+// sorted by parent and then child service name.
+func (ds *DependencySink) Edges() []DependencyEdge {
+	ds.mu.Lock()
+	totals := make(map[edgeKey]*DependencyEdge)
+	for _, interval := range ds.edges {
+		for k, e := range interval {
+			t, ok := totals[k]
+			if !ok {
+				t = &DependencyEdge{Parent: e.Parent, Child: e.Child}
+				totals[k] = t
+			}
+			t.Calls += e.Calls
+			t.Errors += e.Errors
+		}
+	}
+	ds.mu.Unlock()
+
+	edges := make([]DependencyEdge, 0, len(totals))
+	for _, e := range totals {
+		edges = append(edges, *e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Parent != edges[j].Parent {
+			return edges[i].Parent < edges[j].Parent
+		}
+		return edges[i].Child < edges[j].Child
+	})
+	return edges
+}
+
+// ServeHTTP writes the current edge list as JSON.
+func (ds *DependencySink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ds.Edges()); err != nil {
+		logrus.WithError(err).Info("Error writing dependency graph")
+	}
+}
+
+func (ds *DependencySink) run() {
+	defer ds.wg.Done()
+	ticker := time.NewTicker(ds.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ds.done:
+			return
+		case now := <-ticker.C:
+			ds.rotate(now)
+		}
+	}
+}
+
+// rotate ends the current interval at now: it sends summary events for the
+// edges seen during the interval, and expires spans and edges that are too
+// old.
+func (ds *DependencySink) rotate(now time.Time) {
+	ds.mu.Lock()
+	intervalSec := now.Sub(ds.started).Seconds()
+	ds.started = now
+	finished := ds.edges[len(ds.edges)-1]
+	ds.edges = append(ds.edges, make(map[edgeKey]*DependencyEdge))
+	if len(ds.edges) > ds.Intervals {
+		ds.edges = ds.edges[len(ds.edges)-ds.Intervals:]
+	}
+	ds.prevSpans, ds.spans = ds.spans, make(map[spanKey]spanInfo)
+	ds.prevPending, ds.pending = ds.pending, make(map[spanKey][]spanInfo)
+	ds.mu.Unlock()
+
+	if ds.Dataset == "" || ds.Honeycomb == nil || len(finished) == 0 {
+		return
+	}
+	events := make([]map[string]interface{}, 0, len(finished))
+	for _, e := range finished {
+		events = append(events, map[string]interface{}{
+			"parentService": e.Parent,
+			"childService":  e.Child,
+			"calls":         e.Calls,
+			"errors":        e.Errors,
+			"intervalSec":   intervalSec,
+		})
+	}
+	if err := ds.Honeycomb.sendEvents(ds.Dataset, events); err != nil {
+		logrus.WithError(err).Info("Error sending dependency summary events")
+	}
+}
+
+// isClientSpan reports whether a span represents the client side of an RPC,
+// using the Zipkin v2 span kind or the Zipkin v1 "cs" (client send)
+// annotation.
+func isClientSpan(s *types.Span) bool {
+	if kind, ok := s.BinaryAnnotations["kind"].(string); ok && kind != "" {
+		return kind == "CLIENT"
+	}
+	for _, a := range s.Annotations {
+		if a.Value == "cs" {
+			return true
+		}
+	}
+	return false
+}
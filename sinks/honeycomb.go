@@ -1,74 +1,463 @@
 package sinks
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/Sirupsen/logrus"
+	"github.com/facebookgo/muster"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/diskqueue"
 	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
 	libhoney "github.com/honeycombio/libhoney-go"
 )
 
+const versionStr = "2.1.0"
+
 const datasetKey = "honeycomb.dataset"
 const sampleRateKey = "honeycomb.samplerate"
 
+// responseWindow is the number of recent Honeycomb API responses considered
+// when computing the sink's error rate, and minResponses is the number needed
+// before the error rate is considered meaningful.
+const responseWindow = 100
+const minResponses = 10
+
 // HoneycombSink implements the Sink interface. It sends spans to the Honeycomb
-// API.
+// API. It's not ready until it has started, or while the proportion of recent
+// API requests that failed is above MaxErrorRate (if set).
+//
+// Spans are sampled at SampleRate, or at the rate in ServiceSampleRates for
+// their service if there is one, and sent to Dataset, or to the dataset in
+// ServiceDatasets for their service. The first of the Routes that a span
+// matches, if any, overrides these with its own dataset and sample rate.
+// These settings can be changed after the sink has started with SetSettings.
+// A span's own WriteKey and Dataset, which the client that sent it asked for,
+// take precedence over the sink's, and a honeycomb.dataset tag takes
+// precedence over both.
+//
+// Events are sent in batches of up to MaxBatchSize, after waiting up to
+// BatchTimeout for a batch to fill, with up to MaxConcurrentBatches requests
+// in flight and up to PendingWorkCapacity events waiting to be batched. These
+// default to libhoney's defaults. Each sink sends its own events, so several
+// sinks with different write keys, API hosts and batching settings can run at
+// once. If Output is set, events are handed to it instead, e.g. to a
+// libhoney.MockOutput in tests.
+//
+// Name identifies the sink in metrics, and names its disk buffer. It defaults
+// to "honeycomb".
+//
+// If BufferDir is set, events are written to a disk queue in that directory
+// instead, and sent from there to the Honeycomb
+// batch API in order, retrying while the API is unavailable. Events still in
+// the queue when the process exits are sent once it restarts. BufferMaxSize
+// caps the size of the queue in bytes.
 type HoneycombSink struct {
-	Writekey   string
-	Dataset    string
-	APIHost    string
-	SampleRate uint
-	DropFields []string
+	Name               string
+	Writekey           string
+	Dataset            string
+	APIHost            string
+	SampleRate         uint
+	DropFields         []string
+	ServiceDatasets    map[string]string
+	ServiceSampleRates map[string]uint
+	Routes             []Route
+	MaxErrorRate       float64
+	BufferDir          string
+	BufferMaxSize      int64
+
+	MaxBatchSize         uint
+	BatchTimeout         time.Duration
+	MaxConcurrentBatches uint
+	PendingWorkCapacity  uint
+	Output               libhoney.Output
 
+	// pending is the number of events handed to the client whose responses
+	// haven't been received yet.
+	pending int64
+
+	builder  *libhoney.Builder
+	output   libhoney.Output
+	tx       *honeycombClient
+	buffer   *diskqueue.Queue
+	replayer *diskqueue.Replayer
+	client   *http.Client
+
+	// sendMu is held for reading while Send hands events to the output or the
+	// disk buffer, and for writing while stopping the sink, so that no events
+	// are handed to them once they're being stopped.
+	sendMu sync.RWMutex
+
+	mu           sync.Mutex
+	settings     *honeycombSettings
+	started      bool
+	stopped      bool
+	responses    [responseWindow]bool // true for failed responses
+	numResponses int
+	numErrors    int
+}
+
+// HoneycombSettings are the settings of a HoneycombSink that can be changed
+// while it's running.
+type HoneycombSettings struct {
+	Dataset            string            `json:"dataset"`
+	SampleRate         uint              `json:"samplerate"`
+	DropFields         []string          `json:"drop_fields"`
+	ServiceDatasets    map[string]string `json:"service_datasets"`
+	ServiceSampleRates map[string]uint   `json:"service_samplerates"`
+	Routes             []Route           `json:"routes"`
+}
+
+// honeycombSettings is an immutable copy of HoneycombSettings, so that Send
+// always sees a consistent set of settings.
+type honeycombSettings struct {
+	HoneycombSettings
 	dropFieldsMap map[string]struct{}
+	routes        []route
 }
 
-func (hs *HoneycombSink) Start() error {
-	hs.dropFieldsMap = make(map[string]struct{})
-	for _, v := range hs.DropFields {
+func newHoneycombSettings(s HoneycombSettings) *honeycombSettings {
+	hs := &honeycombSettings{
+		HoneycombSettings: HoneycombSettings{
+			Dataset:            s.Dataset,
+			SampleRate:         s.SampleRate,
+			DropFields:         append([]string(nil), s.DropFields...),
+			ServiceDatasets:    make(map[string]string, len(s.ServiceDatasets)),
+			ServiceSampleRates: make(map[string]uint, len(s.ServiceSampleRates)),
+			Routes:             append([]Route(nil), s.Routes...),
+		},
+		dropFieldsMap: make(map[string]struct{}, len(s.DropFields)),
+	}
+	for _, v := range s.DropFields {
 		hs.dropFieldsMap[v] = struct{}{}
 	}
-	versionStr := "2.1.0"
-	libhoney.UserAgentAddition = "honeycomb-opentracing-proxy/" + versionStr
-	libhoney.Init(libhoney.Config{
-		WriteKey: hs.Writekey,
-		Dataset:  hs.Dataset,
-		APIHost:  hs.APIHost,
-	})
-
-	go func() {
-		for resp := range libhoney.Responses() {
-			if resp.Err != nil || resp.StatusCode != 202 {
-				logrus.WithFields(logrus.Fields{
-					"error":  resp.Err,
-					"status": resp.StatusCode,
-					"body":   string(resp.Body),
-				}).Error("Error sending span to Honeycomb")
-			} else {
-				spanId, _ := resp.Metadata.(string)
-				logrus.WithField("spanId", spanId).Debug("Successfully sent span to Honeycomb")
-			}
+	for k, v := range s.ServiceDatasets {
+		hs.ServiceDatasets[k] = v
+	}
+	for k, v := range s.ServiceSampleRates {
+		hs.ServiceSampleRates[k] = v
+	}
+	for _, r := range s.Routes {
+		parsed, err := parseRoute(r)
+		if err != nil {
+			logrus.WithError(err).Error("Ignoring invalid route")
+			continue
+		}
+		hs.routes = append(hs.routes, parsed)
+	}
+	return hs
+}
+
+// route returns the first route that a span matches, or nil.
+func (hs *honeycombSettings) route(s *types.Span) *route {
+	for i := range hs.routes {
+		if hs.routes[i].matches(s) {
+			return &hs.routes[i]
+		}
+	}
+	return nil
+}
+
+func (hs *HoneycombSink) Start() error {
+	if hs.Name == "" {
+		hs.Name = "honeycomb"
+	}
+	hs.currentSettings()
+	if hs.MaxBatchSize == 0 {
+		hs.MaxBatchSize = libhoney.DefaultMaxBatchSize
+	}
+	if hs.BatchTimeout == 0 {
+		hs.BatchTimeout = libhoney.DefaultBatchTimeout
+	}
+	if hs.MaxConcurrentBatches == 0 {
+		hs.MaxConcurrentBatches = libhoney.DefaultMaxConcurrentBatches
+	}
+	if hs.PendingWorkCapacity == 0 {
+		hs.PendingWorkCapacity = libhoney.DefaultPendingWorkCapacity
+	}
+	hs.builder = &libhoney.Builder{
+		WriteKey:   hs.Writekey,
+		Dataset:    hs.Dataset,
+		APIHost:    hs.apiHost(),
+		SampleRate: 1,
+	}
+	hs.client = &http.Client{Timeout: requestTimeout}
+
+	if hs.Output != nil {
+		hs.output = hs.Output
+	} else {
+		hs.tx = &honeycombClient{
+			sink:    hs.Name,
+			apiHost: hs.apiHost(),
+			client:  hs.client,
+			respond: hs.handleResponse,
+			muster: muster.Client{
+				MaxBatchSize:         hs.MaxBatchSize,
+				BatchTimeout:         hs.BatchTimeout,
+				MaxConcurrentBatches: hs.MaxConcurrentBatches,
+				PendingWorkCapacity:  hs.PendingWorkCapacity,
+			},
 		}
-	}()
+		hs.output = hs.tx
+	}
+	if err := hs.output.Start(); err != nil {
+		return err
+	}
 
+	if hs.BufferDir != "" {
+		hs.buffer = &diskqueue.Queue{
+			Dir:     hs.BufferDir,
+			Name:    hs.Name,
+			MaxSize: hs.BufferMaxSize,
+		}
+		if err := hs.buffer.Open(); err != nil {
+			return err
+		}
+		hs.replayer = &diskqueue.Replayer{
+			Queue:     hs.buffer,
+			Deliver:   hs.deliverBuffered,
+			BatchSize: bufferedBatchSize,
+		}
+		hs.replayer.Start()
+	}
+
+	hs.mu.Lock()
+	hs.started = true
+	hs.mu.Unlock()
 	return nil
 }
 
+// Stop flushes queued events to Honeycomb, and waits for their responses.
+// Spans sent after Stop are dropped. If there's a disk buffer, Stop doesn't
+// return until it's empty.
 func (hs *HoneycombSink) Stop() error {
+	return hs.Shutdown(context.Background())
+}
+
+// Shutdown is like Stop, but only waits for the disk buffer to be sent until
+// ctx is done. In that case the remaining events stay in the buffer, to be
+// sent after a restart, and Shutdown returns an error with their number.
+func (hs *HoneycombSink) Shutdown(ctx context.Context) error {
+	hs.sendMu.Lock()
+	hs.mu.Lock()
+	started := hs.started
+	hs.started = false
+	hs.stopped = true
+	hs.mu.Unlock()
+	hs.sendMu.Unlock()
+	if !started {
+		return nil
+	}
+	var err error
+	if hs.replayer != nil {
+		if drainErr := hs.replayer.Drain(ctx); drainErr != nil {
+			err = fmt.Errorf("%d events weren't sent to Honeycomb, and remain in the disk buffer: %v",
+				hs.buffer.Len(), drainErr)
+		}
+		hs.buffer.Close()
+	}
+	if stopErr := hs.output.Stop(); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// handleResponse records the outcome of sending an event to Honeycomb.
+func (hs *HoneycombSink) handleResponse(resp libhoney.Response) {
+	atomic.AddInt64(&hs.pending, -1)
+	if resp.Err != nil {
+		honeycombResponses.Inc(hs.Name, "error")
+	} else {
+		honeycombResponses.Inc(hs.Name, strconv.Itoa(resp.StatusCode))
+	}
+	hs.recordResponse(resp.Err != nil || resp.StatusCode != 202)
+	if resp.Err != nil || resp.StatusCode != 202 {
+		logrus.WithFields(logrus.Fields{
+			"error":  resp.Err,
+			"status": resp.StatusCode,
+			"body":   string(resp.Body),
+		}).Error("Error sending span to Honeycomb")
+	} else {
+		spanId, _ := resp.Metadata.(string)
+		logrus.WithField("spanId", spanId).Debug("Successfully sent span to Honeycomb")
+	}
+}
+
+// apiHost returns the Honeycomb API server to send events to.
+func (hs *HoneycombSink) apiHost() string {
+	if hs.APIHost == "" {
+		return defaultAPIHost
+	}
+	return hs.APIHost
+}
+
+// Pending returns the number of events that have been queued to send to
+// Honeycomb, including in the disk buffer, but that haven't been acknowledged
+// yet.
+func (hs *HoneycombSink) Pending() int {
+	pending := int(atomic.LoadInt64(&hs.pending))
+	if hs.buffer != nil {
+		pending += hs.buffer.Len()
+	}
+	return pending
+}
+
+// QueueFill returns the number of events that haven't been sent yet as a
+// fraction of the number the sink can hold in memory: those waiting to be
+// batched, and those in batches being sent. Events in the disk buffer don't
+// count; see BufferFill.
+func (hs *HoneycombSink) QueueFill() float64 {
+	capacity := hs.PendingWorkCapacity + hs.MaxConcurrentBatches*hs.MaxBatchSize
+	if capacity == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&hs.pending)) / float64(capacity)
+}
+
+// BufferFill returns how full the disk buffer is, or 0 if there isn't one.
+func (hs *HoneycombSink) BufferFill() float64 {
+	if hs.buffer == nil {
+		return 0
+	}
+	return float64(hs.buffer.Size()) / float64(hs.buffer.MaxSize)
+}
+
+// Settings returns the sink's current settings.
+func (hs *HoneycombSink) Settings() HoneycombSettings {
+	return newHoneycombSettings(hs.currentSettings().HoneycombSettings).HoneycombSettings
+}
+
+// SetSettings atomically replaces the sink's settings. Spans that are already
+// being sent use the old settings.
+func (hs *HoneycombSink) SetSettings(s HoneycombSettings) {
+	settings := newHoneycombSettings(s)
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.settings = settings
+}
+
+// currentSettings returns the sink's current settings, taking them from its
+// fields the first time it's called.
+func (hs *HoneycombSink) currentSettings() *honeycombSettings {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.settings == nil {
+		hs.settings = newHoneycombSettings(HoneycombSettings{
+			Dataset:            hs.Dataset,
+			SampleRate:         hs.SampleRate,
+			DropFields:         hs.DropFields,
+			ServiceDatasets:    hs.ServiceDatasets,
+			ServiceSampleRates: hs.ServiceSampleRates,
+			Routes:             hs.Routes,
+		})
+	}
+	return hs.settings
+}
+
+// recordResponse records whether a Honeycomb API request failed, keeping
+// track of the last responseWindow outcomes.
+func (hs *HoneycombSink) recordResponse(failed bool) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	i := hs.numResponses % responseWindow
+	if hs.numResponses >= responseWindow && hs.responses[i] {
+		hs.numErrors--
+	}
+	hs.responses[i] = failed
+	if failed {
+		hs.numErrors++
+	}
+	hs.numResponses++
+}
+
+// Ready reports whether the sink has started, and its recent error rate is
+// acceptable.
+func (hs *HoneycombSink) Ready() error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if !hs.started {
+		return errors.New("honeycomb sink not started")
+	}
+	n := hs.numResponses
+	if n > responseWindow {
+		n = responseWindow
+	}
+	if hs.MaxErrorRate > 0 && n >= minResponses {
+		if rate := float64(hs.numErrors) / float64(n); rate > hs.MaxErrorRate {
+			return fmt.Errorf("%d of the last %d Honeycomb API requests failed", hs.numErrors, n)
+		}
+	}
 	return nil
 }
 
+// Send sends spans to Honeycomb, or to the disk buffer. If any of them can't
+// be sent, it returns a *SendError, with spans that were sampled out or had an
+// invalid dataset tag counted as dropped.
 func (hs *HoneycombSink) Send(spans []*types.Span) error {
+	hs.sendMu.RLock()
+	defer hs.sendMu.RUnlock()
+	if err := hs.checkRunning(); err != nil {
+		return err
+	}
+	settings := hs.currentSettings()
+	result := SendError{}
+
 spanLoop:
 	for _, s := range spans {
-		if hs.SampleRate > 1 && s.TraceIDAsInt%int64(hs.SampleRate) != 0 {
+		sampleRate := settings.SampleRate
+		if rate, ok := settings.ServiceSampleRates[s.ServiceName]; ok {
+			sampleRate = rate
+		}
+		matched := settings.route(s)
+		if matched != nil {
+			if logrus.GetLevel() >= logrus.DebugLevel {
+				logrus.WithFields(logrus.Fields{
+					"spanId":  s.ID,
+					"match":   matched.Match,
+					"dataset": matched.Dataset,
+				}).Debug("Span matched route")
+			}
+			if matched.SampleRate != 0 {
+				sampleRate = matched.SampleRate
+			}
+		}
+		if sampleRate > 1 && s.TraceIDAsInt%int64(sampleRate) != 0 {
+			spansSampledOut.Inc(hs.Name)
+			result.Dropped++
 			continue
 		}
-		ev := libhoney.NewEvent()
+		ev := hs.builder.NewEvent()
+		if sampleRate > 1 {
+			// Let Honeycomb weight the spans that were kept. A
+			// honeycomb.samplerate tag still takes precedence.
+			ev.SampleRate = sampleRate
+		}
+		if ds, ok := settings.ServiceDatasets[s.ServiceName]; ok {
+			ev.Dataset = ds
+		} else if settings.Dataset != "" {
+			ev.Dataset = settings.Dataset
+		}
+		if matched != nil && matched.Dataset != "" {
+			ev.Dataset = matched.Dataset
+		}
+		if s.Dataset != "" {
+			ev.Dataset = s.Dataset
+		}
+		if s.WriteKey != "" {
+			ev.WriteKey = s.WriteKey
+		}
 		ev.Timestamp = s.Timestamp
 		ev.Add(s.CoreSpanMetadata)
 		ev.Metadata = s.ID
 		for k, v := range s.BinaryAnnotations {
-			if _, ok := hs.dropFieldsMap[k]; ok {
+			if _, ok := settings.dropFieldsMap[k]; ok {
 				// drop this tag instead of sending its data to Honeycomb
+				fieldsDropped.Inc(hs.Name, k)
 				continue
 			}
 
@@ -81,6 +470,7 @@ spanLoop:
 				} else {
 					logrus.WithField("honeycomb.dataset", v).Error(
 						"unexpected type for honeycomb.dataset tag value")
+					result.Dropped++
 					continue spanLoop
 				}
 			case sampleRateKey:
@@ -95,10 +485,77 @@ spanLoop:
 				ev.AddField(k, v)
 			}
 		}
-		err := ev.SendPresampled()
-		if err != nil {
-			logrus.WithError(err).Info("Error sending libhoney event")
+		if err := hs.sendEvent(ev); err != nil {
+			eventSendErrors.Inc(hs.Name)
+			result.Failed++
+			if result.Err == nil {
+				result.Err = err
+			}
+			continue
 		}
+		eventsSent.Inc(hs.Name)
+		result.Accepted++
+	}
+	if result.Failed > 0 {
+		return &result
+	}
+	return nil
+}
+
+// sendEvents sends an event with each of events' fields to dataset, like Send
+// does for spans: none are handed to the output once the sink is stopping. It
+// returns the first error sending an event.
+func (hs *HoneycombSink) sendEvents(dataset string, events []map[string]interface{}) error {
+	hs.sendMu.RLock()
+	defer hs.sendMu.RUnlock()
+	if err := hs.checkRunning(); err != nil {
+		return err
+	}
+	var firstErr error
+	for _, fields := range events {
+		ev := hs.builder.NewEvent()
+		ev.Dataset = dataset
+		ev.Add(fields)
+		if err := hs.sendEvent(ev); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// checkRunning returns an error if the sink hasn't started, or has stopped.
+func (hs *HoneycombSink) checkRunning() error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.stopped {
+		return errors.New("honeycomb sink stopped")
+	}
+	if !hs.started {
+		return errors.New("honeycomb sink not started")
+	}
+	return nil
+}
+
+// sendEvent writes an event to the disk buffer, or hands it to the sink's
+// output to be sent.
+func (hs *HoneycombSink) sendEvent(ev *libhoney.Event) error {
+	if hs.buffer != nil {
+		return hs.bufferEvent(ev)
+	}
+	if ev.WriteKey == "" {
+		return errors.New("no write key for event")
+	}
+	if ev.Dataset == "" {
+		return errors.New("no dataset for event")
+	}
+	if hs.tx == nil {
+		hs.output.Add(ev)
+		return nil
+	}
+	atomic.AddInt64(&hs.pending, 1)
+	if err := hs.tx.add(ev); err != nil {
+		hs.handleResponse(libhoney.Response{Err: err, Metadata: ev.Metadata})
+		return err
 	}
 	return nil
 }
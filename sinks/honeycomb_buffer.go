@@ -0,0 +1,126 @@
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+const (
+	// bufferedBatchSize is the largest number of events sent from the disk
+	// buffer in one request.
+	bufferedBatchSize = 100
+	// requestTimeout is how long to wait for each request to the batch API.
+	requestTimeout = 30 * time.Second
+)
+
+// bufferedEvent is how an event is stored in the disk buffer. Event is the
+// event in the form used by the Honeycomb batch API. WriteKey is only set if
+// it's not the sink's own.
+type bufferedEvent struct {
+	Dataset  string          `json:"dataset"`
+	WriteKey string          `json:"writekey,omitempty"`
+	Event    json.RawMessage `json:"event"`
+}
+
+func (hs *HoneycombSink) bufferEvent(ev *libhoney.Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	be := bufferedEvent{Dataset: ev.Dataset, Event: data}
+	if ev.WriteKey != hs.Writekey {
+		be.WriteKey = ev.WriteKey
+	}
+	record, err := json.Marshal(be)
+	if err != nil {
+		return err
+	}
+	return hs.buffer.Push(record)
+}
+
+// deliverBuffered sends events from the disk buffer to the Honeycomb batch
+// API. It sends the leading events that share a dataset and write key, and
+// returns how many of them don't need to be retried. Events the API rejects as
+// invalid are logged and dropped, since retrying them wouldn't help.
+func (hs *HoneycombSink) deliverBuffered(records [][]byte) (int, error) {
+	var dataset, writeKey string
+	var events []json.RawMessage
+	for i, record := range records {
+		var be bufferedEvent
+		if err := json.Unmarshal(record, &be); err != nil {
+			if i == 0 {
+				logrus.WithError(err).Error("Dropping unreadable event from disk buffer")
+				return 1, nil
+			}
+			break
+		}
+		if i > 0 && (be.Dataset != dataset || be.WriteKey != writeKey) {
+			break
+		}
+		dataset, writeKey = be.Dataset, be.WriteKey
+		events = append(events, be.Event)
+	}
+
+	if writeKey == "" {
+		writeKey = hs.Writekey
+	}
+	resp, err := postBatch(hs.Name, hs.client, hs.apiHost(), writeKey, dataset, events)
+	if err != nil {
+		hs.recordResponses(len(events), "error")
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		hs.recordResponses(len(events), strconv.Itoa(resp.StatusCode))
+		responseBody, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 1024})
+		err := fmt.Errorf("Honeycomb API returned %s: %s", resp.Status, responseBody)
+		if isRetriable(resp.StatusCode) {
+			return 0, err
+		}
+		logrus.WithError(err).WithField("events", len(events)).Error("Dropping events rejected by Honeycomb")
+		return len(events), nil
+	}
+
+	var statuses []batchStatus
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		logrus.WithError(err).Info("Error decoding Honeycomb batch response")
+		return len(events), nil
+	}
+	for i, s := range statuses {
+		hs.recordResponses(1, strconv.Itoa(s.Status))
+		if isRetriable(s.Status) {
+			return i, fmt.Errorf("Honeycomb API returned status %d for an event: %s", s.Status, s.Error)
+		}
+		if s.Status != http.StatusAccepted {
+			logrus.WithFields(logrus.Fields{
+				"status": s.Status,
+				"error":  s.Error,
+			}).Error("Error sending span to Honeycomb")
+		}
+	}
+	return len(events), nil
+}
+
+// recordResponses records n responses from the Honeycomb API with the given
+// status code, or "error".
+func (hs *HoneycombSink) recordResponses(n int, code string) {
+	honeycombResponses.Add(float64(n), hs.Name, code)
+	for i := 0; i < n; i++ {
+		hs.recordResponse(code != strconv.Itoa(http.StatusAccepted))
+	}
+}
+
+// isRetriable reports whether a request that failed with an HTTP status code
+// might succeed if it were retried.
+func isRetriable(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
@@ -0,0 +1,183 @@
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/facebookgo/muster"
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+// defaultAPIHost is the Honeycomb API server events are sent to if a sink has
+// no APIHost.
+const defaultAPIHost = "https://api.honeycomb.io/"
+
+var errQueueOverflow = errors.New("queue overflow")
+
+// honeycombClient batches events and sends them to the Honeycomb batch API,
+// calling respond with the outcome for each one. It's like libhoney's own
+// transmission, but libhoney keeps that and its responses in package-level
+// state, so there can only be one per process. Each HoneycombSink has its own
+// honeycombClient instead, so that sinks with different write keys, API hosts
+// and batching settings can run side by side.
+type honeycombClient struct {
+	sink    string
+	apiHost string
+	client  *http.Client
+	respond func(libhoney.Response)
+
+	muster muster.Client
+}
+
+// batchKey identifies the events that can be sent in the same request.
+type batchKey struct {
+	writekey string
+	dataset  string
+}
+
+// honeycombBatch is a muster.Batch of events, grouped by batchKey.
+type honeycombBatch struct {
+	hc     *honeycombClient
+	events map[batchKey][]*libhoney.Event
+}
+
+func (hc *honeycombClient) Start() error {
+	hc.muster.BatchMaker = func() muster.Batch {
+		return &honeycombBatch{hc: hc, events: make(map[batchKey][]*libhoney.Event)}
+	}
+	return hc.muster.Start()
+}
+
+// Stop sends the events that are waiting to be batched, and waits for the
+// responses to every event.
+func (hc *honeycombClient) Stop() error {
+	return hc.muster.Stop()
+}
+
+// Add queues an event to be sent. If the queue is full, the event is dropped
+// and responded to with an error.
+func (hc *honeycombClient) Add(ev *libhoney.Event) {
+	if err := hc.add(ev); err != nil {
+		hc.respond(libhoney.Response{Err: err, Metadata: ev.Metadata})
+	}
+}
+
+// add is like Add, but returns an error instead of responding to the event if
+// it's dropped, so that callers can tell it wasn't queued.
+func (hc *honeycombClient) add(ev *libhoney.Event) error {
+	select {
+	case hc.muster.Work <- ev:
+		return nil
+	default:
+		return errQueueOverflow
+	}
+}
+
+func (b *honeycombBatch) Add(item interface{}) {
+	ev := item.(*libhoney.Event)
+	key := batchKey{ev.WriteKey, ev.Dataset}
+	b.events[key] = append(b.events[key], ev)
+}
+
+func (b *honeycombBatch) Fire(notifier muster.Notifier) {
+	defer notifier.Done()
+	for key, events := range b.events {
+		b.hc.send(key, events)
+	}
+}
+
+// send sends events that share a batchKey in one request.
+func (hc *honeycombClient) send(key batchKey, events []*libhoney.Event) {
+	var encoded []json.RawMessage
+	var sent []*libhoney.Event
+	for _, ev := range events {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			hc.respond(libhoney.Response{Err: err, Metadata: ev.Metadata})
+			continue
+		}
+		encoded = append(encoded, data)
+		sent = append(sent, ev)
+	}
+	if len(sent) == 0 {
+		return
+	}
+
+	start := time.Now()
+	resp, err := postBatch(hc.sink, hc.client, hc.apiHost, key.writekey, key.dataset, encoded)
+	duration := time.Since(start)
+	respondAll := func(r libhoney.Response) {
+		r.Duration = duration
+		for _, ev := range sent {
+			r.Metadata = ev.Metadata
+			hc.respond(r)
+		}
+	}
+	if err != nil {
+		respondAll(libhoney.Response{Err: err})
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 1024})
+		respondAll(libhoney.Response{StatusCode: resp.StatusCode, Body: body})
+		return
+	}
+	var statuses []batchStatus
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		respondAll(libhoney.Response{Err: err})
+		return
+	}
+	for i, ev := range sent {
+		r := libhoney.Response{Duration: duration, Metadata: ev.Metadata}
+		if i < len(statuses) {
+			r.StatusCode = statuses[i].Status
+			r.Body = []byte(statuses[i].Error)
+		} else {
+			r.Err = errors.New("no response for event from Honeycomb batch API")
+		}
+		hc.respond(r)
+	}
+}
+
+// batchStatus is the outcome for one event in a response from the Honeycomb
+// batch API.
+type batchStatus struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// postBatch sends events, encoded as the batch API expects, to dataset on the
+// Honeycomb API server at apiHost, and records how long the request took for
+// the named sink.
+func postBatch(sink string, client *http.Client, apiHost, writekey, dataset string, events []json.RawMessage) (*http.Response, error) {
+	apiURL, err := url.Parse(apiHost)
+	if err != nil {
+		return nil, err
+	}
+	apiURL.Path = path.Join(apiURL.Path, "/1/batch", dataset)
+	body, err := json.Marshal(events)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", apiURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "honeycomb-opentracing-proxy/"+versionStr)
+	req.Header.Set("X-Honeycomb-Team", writekey)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	honeycombDuration.Observe(time.Since(start).Seconds(), sink)
+	return resp, err
+}
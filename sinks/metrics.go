@@ -0,0 +1,24 @@
+package sinks
+
+import "github.com/honeycombio/honeycomb-opentracing-proxy/metrics"
+
+var (
+	spansSampledOut = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_spans_sampled_out_total",
+		"Number of spans not sent to Honeycomb because of sampling, by Honeycomb sink.", "sink")
+	fieldsDropped = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_fields_dropped_total",
+		"Number of span tags not sent to Honeycomb because of --drop_field, by Honeycomb sink and tag.", "sink", "field")
+	eventsSent = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_honeycomb_events_total",
+		"Number of events queued to send to Honeycomb, by Honeycomb sink.", "sink")
+	eventSendErrors = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_honeycomb_event_errors_total",
+		"Number of events that couldn't be queued to send to Honeycomb, by Honeycomb sink.", "sink")
+	sinkQueueDropped = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_sink_queue_dropped_total",
+		"Number of spans dropped because a sink's queue was full, by sink.", "sink")
+	traceSummaryDropped = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_trace_summary_dropped_total",
+		"Number of spans dropped because they were sent after the trace summary sink stopped.")
+	sinkQueueErrors = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_sink_queue_errors_total",
+		"Number of errors sending queued spans to a sink, by sink.", "sink")
+	honeycombResponses = metrics.NewCounterVec(metrics.DefaultRegistry, "proxy_honeycomb_responses_total",
+		"Number of responses from the Honeycomb API, by Honeycomb sink and status code. Code \"error\" means the event wasn't sent, e.g. because the sink's queue was full.", "sink", "code")
+	honeycombDuration = metrics.NewHistogramVec(metrics.DefaultRegistry, "proxy_honeycomb_request_duration_seconds",
+		"Time taken by requests to the Honeycomb API, by Honeycomb sink.", nil, "sink")
+)
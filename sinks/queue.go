@@ -0,0 +1,183 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// Overflow policies for a sink's queue, for when spans are sent to it faster
+// than it can take them.
+const (
+	// OverflowDropNewest rejects new spans while the queue is full.
+	OverflowDropNewest = "drop_newest"
+	// OverflowDropOldest drops the oldest queued spans to make room.
+	OverflowDropOldest = "drop_oldest"
+	// OverflowBlock waits up to the BlockTimeout for room.
+	OverflowBlock = "block"
+)
+
+// DefaultBlockTimeout is how long Send waits for room in a sink's queue with
+// OverflowBlock, if no BlockTimeout is set.
+const DefaultBlockTimeout = time.Second
+
+var errQueueFull = errors.New("sink queue full")
+
+// SinkOptions configures how a CompositeSink hands spans to one of its sinks.
+type SinkOptions struct {
+	// Required sinks' failures fail the CompositeSink's Send; other sinks
+	// are best effort.
+	Required bool
+
+	// QueueSize is the number of batches of spans that can wait to be sent
+	// to the sink by its Workers (1 if not set), so that a slow sink doesn't
+	// hold up its callers or the other sinks. Once they're queued, errors
+	// sending them are only logged. If QueueSize is 0, spans are sent to the
+	// sink straight away, and its errors are returned.
+	QueueSize int
+	Workers   int
+
+	// Overflow is the policy for when the queue is full. It's
+	// OverflowDropNewest if not set. BlockTimeout is how long OverflowBlock
+	// waits, and is DefaultBlockTimeout if not set.
+	Overflow     string
+	BlockTimeout time.Duration
+}
+
+// CheckSinkOptions returns an error if opts aren't valid.
+func CheckSinkOptions(opts SinkOptions) error {
+	switch opts.Overflow {
+	case "", OverflowDropNewest, OverflowDropOldest, OverflowBlock:
+	default:
+		return fmt.Errorf("unknown overflow policy %s. Must be drop_newest, drop_oldest or block", opts.Overflow)
+	}
+	if opts.QueueSize < 0 || opts.Workers < 0 || opts.BlockTimeout < 0 {
+		return errors.New("queue size, workers and block timeout must not be negative")
+	}
+	return nil
+}
+
+// sinkQueue queues batches of spans for a sink, and sends them to it from a
+// pool of workers.
+type sinkQueue struct {
+	name    string
+	sink    Sink
+	opts    SinkOptions
+	batches chan []*types.Span
+	wg      sync.WaitGroup
+
+	// abandoned is closed once the queue has stopped waiting for its spans to
+	// be sent, so that the workers drop the rest.
+	abandoned   chan struct{}
+	closeOnce   sync.Once
+	abandonOnce sync.Once
+}
+
+func (q *sinkQueue) start() {
+	workers := q.opts.Workers
+	if workers == 0 {
+		workers = 1
+	}
+	q.batches = make(chan []*types.Span, q.opts.QueueSize)
+	q.abandoned = make(chan struct{})
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.run()
+	}
+}
+
+func (q *sinkQueue) run() {
+	defer q.wg.Done()
+	for spans := range q.batches {
+		select {
+		case <-q.abandoned:
+			sinkQueueDropped.Add(float64(len(spans)), q.name)
+			continue
+		default:
+		}
+		if err := q.sink.Send(spans); err != nil {
+			sinkQueueErrors.Inc(q.name)
+			logrus.WithError(err).WithField("sink", q.name).Info("Error sending queued spans")
+		}
+	}
+}
+
+// push queues spans according to the overflow policy. It fails with
+// errQueueFull if they can't be queued.
+func (q *sinkQueue) push(spans []*types.Span) error {
+	select {
+	case q.batches <- spans:
+		return nil
+	default:
+	}
+	switch q.opts.Overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case q.batches <- spans:
+				return nil
+			case dropped := <-q.batches:
+				sinkQueueDropped.Add(float64(len(dropped)), q.name)
+			}
+		}
+	case OverflowBlock:
+		timeout := q.opts.BlockTimeout
+		if timeout == 0 {
+			timeout = DefaultBlockTimeout
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case q.batches <- spans:
+			return nil
+		case <-timer.C:
+		}
+	}
+	sinkQueueDropped.Add(float64(len(spans)), q.name)
+	return errQueueFull
+}
+
+func (q *sinkQueue) fill() float64 {
+	if cap(q.batches) == 0 {
+		return 0
+	}
+	return float64(len(q.batches)) / float64(cap(q.batches))
+}
+
+// close stops the queue from taking more spans. It's safe to call more than
+// once, and before start.
+func (q *sinkQueue) close() {
+	q.closeOnce.Do(func() {
+		if q.batches != nil {
+			close(q.batches)
+		}
+	})
+}
+
+// wait waits for the spans queued before close to be sent, until ctx is done.
+// In that case, the spans that are still queued are dropped, and wait returns
+// an error with their number. A sink that's stuck sending spans isn't
+// interrupted.
+func (q *sinkQueue) wait(ctx context.Context) error {
+	if q.batches == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	queued := len(q.batches)
+	q.abandonOnce.Do(func() { close(q.abandoned) })
+	return fmt.Errorf("%d batches of spans queued for %s weren't sent: %v", queued, q.name, ctx.Err())
+}
@@ -0,0 +1,106 @@
+package sinks
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// Route sends the spans that match it to Dataset, sampled at SampleRate. An
+// empty Dataset or a zero SampleRate leaves the sink's own.
+//
+// Match is a comma-separated list of conditions of the form field=pattern,
+// all of which a span has to meet, e.g. "service=payments*,environment=prod".
+// The field is service for the span's service name, name for the span's
+// name, or otherwise the name of a tag. Patterns can contain * wildcards. An
+// empty Match matches every span.
+type Route struct {
+	Match      string `toml:"match" json:"match"`
+	Dataset    string `toml:"dataset" json:"dataset"`
+	SampleRate uint   `toml:"samplerate" json:"samplerate"`
+}
+
+// route is a parsed Route.
+type route struct {
+	Route
+	conditions []condition
+}
+
+type condition struct {
+	field   string
+	pattern string
+}
+
+func parseRoute(r Route) (route, error) {
+	parsed := route{Route: r}
+	if strings.TrimSpace(r.Match) == "" {
+		return parsed, nil
+	}
+	for _, c := range strings.Split(r.Match, ",") {
+		i := strings.Index(c, "=")
+		if i < 0 {
+			return route{}, fmt.Errorf("invalid route condition %q. Must be field=pattern", c)
+		}
+		field := strings.TrimSpace(c[:i])
+		if field == "" {
+			return route{}, fmt.Errorf("invalid route condition %q. Must be field=pattern", c)
+		}
+		parsed.conditions = append(parsed.conditions, condition{field, strings.TrimSpace(c[i+1:])})
+	}
+	return parsed, nil
+}
+
+// CheckRoutes returns an error if any of routes can't be parsed.
+func CheckRoutes(routes []Route) error {
+	for _, r := range routes {
+		if _, err := parseRoute(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether a span meets all of the route's conditions.
+func (r *route) matches(s *types.Span) bool {
+	for _, c := range r.conditions {
+		var value string
+		switch c.field {
+		case "service":
+			value = s.ServiceName
+		case "name":
+			value = s.Name
+		default:
+			v, ok := s.BinaryAnnotations[c.field]
+			if !ok {
+				return false
+			}
+			value = fmt.Sprint(v)
+		}
+		if !globMatch(c.pattern, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// globMatch reports whether s matches pattern, in which * matches any
+// sequence of characters, including none.
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
@@ -1,6 +1,12 @@
 package sinks
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
 	"github.com/facebookgo/startstop"
 	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
 )
@@ -13,37 +19,267 @@ type Sink interface {
 	startstop.Stopper
 }
 
+// ReadinessChecker is implemented by sinks that can report whether they're
+// currently able to handle spans, e.g. because they've finished starting up
+// and aren't overloaded. Ready returns an error describing the problem if not.
+type ReadinessChecker interface {
+	Ready() error
+}
+
+// Shutdowner is implemented by sinks that can stop without waiting for
+// everything they've queued to be sent. Shutdown is like Stop, but gives up
+// waiting once ctx is done.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// shutdown stops s, waiting no longer than ctx allows if s is a Shutdowner.
+func shutdown(ctx context.Context, s Sink) error {
+	if sh, ok := s.(Shutdowner); ok {
+		return sh.Shutdown(ctx)
+	}
+	return s.Stop()
+}
+
+// QueueReporter is implemented by sinks that queue spans before sending them
+// on, so that callers can slow down before the queue overflows. QueueFill
+// returns how full the queue is, as a fraction of its capacity.
+type QueueReporter interface {
+	QueueFill() float64
+}
+
+// BufferReporter is implemented by sinks that buffer spans on disk before
+// sending them on. BufferFill returns how full the disk buffer is, as a
+// fraction of its maximum size.
+type BufferReporter interface {
+	BufferFill() float64
+}
+
+// SendError is returned by a sink's Send when it failed to take some of the
+// spans. Dropped spans were deliberately not sent, e.g. because they were
+// sampled out.
+type SendError struct {
+	Accepted int
+	Dropped  int
+	Failed   int
+	// Err is the first error.
+	Err error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("%d of %d spans failed: %v", e.Failed, e.Accepted+e.Dropped+e.Failed, e.Err)
+}
+
+var errSinkStopped = errors.New("sink stopped")
+
+// SinkResult is the outcome of sending spans to one of a CompositeSink's
+// sinks.
+type SinkResult struct {
+	Name     string
+	Required bool
+	Accepted int
+	Dropped  int
+	Failed   int
+	Err      error
+}
+
+// MultiError is returned by CompositeSink.Send when any of its sinks failed.
+// It holds the result for each sink, including those that succeeded.
+type MultiError struct {
+	Results []SinkResult
+}
+
+func (e *MultiError) Error() string {
+	var failures []string
+	for _, r := range e.Results {
+		if r.Err != nil {
+			failures = append(failures, r.Name+": "+r.Err.Error())
+		}
+	}
+	return strings.Join(failures, "; ")
+}
+
+// RequiredFailed reports whether any of the sinks that failed are required.
+func (e *MultiError) RequiredFailed() bool {
+	for _, r := range e.Results {
+		if r.Err != nil && r.Required {
+			return true
+		}
+	}
+	return false
+}
+
 // CompositeSink is an implementation of Sink that sends spans to each provided
-// individual sink.
+// individual sink. Sinks added with a queue are sent spans from their own
+// workers, so that a slow or failing sink doesn't hold up the caller or the
+// other sinks. Its Send fails with a MultiError if any of them fail, so
+// callers can tell whether only best-effort sinks failed.
 type CompositeSink struct {
-	sinks []Sink
+	sinks []namedSink
+
+	// mu guards stopped, so that spans aren't queued once the queues are
+	// stopped.
+	mu      sync.RWMutex
+	stopped bool
+}
+
+type namedSink struct {
+	Sink
+	name string
+	opts SinkOptions
+	// queue is nil if the sink is sent spans synchronously.
+	queue *sinkQueue
+}
+
+// Add adds a required sink that's sent spans synchronously.
+func (cs *CompositeSink) Add(name string, s Sink) {
+	cs.AddWithOptions(name, s, SinkOptions{Required: true})
 }
 
-func (cs *CompositeSink) Add(s Sink) {
-	cs.sinks = append(cs.sinks, s)
+// AddBestEffort adds a sink whose failures don't need to fail a request, and
+// that's sent spans synchronously.
+func (cs *CompositeSink) AddBestEffort(name string, s Sink) {
+	cs.AddWithOptions(name, s, SinkOptions{})
+}
+
+// AddWithOptions adds a sink, which is sent spans as configured by opts.
+func (cs *CompositeSink) AddWithOptions(name string, s Sink, opts SinkOptions) {
+	ns := namedSink{Sink: s, name: name, opts: opts}
+	if opts.QueueSize > 0 {
+		ns.queue = &sinkQueue{name: name, sink: s, opts: opts}
+	}
+	cs.sinks = append(cs.sinks, ns)
 }
 
 func (cs *CompositeSink) Send(spans []*types.Span) error {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	results := make([]SinkResult, len(cs.sinks))
+	failed := false
+	for i, s := range cs.sinks {
+		r := SinkResult{Name: s.name, Required: s.opts.Required, Accepted: len(spans)}
+		var err error
+		switch {
+		case s.queue == nil:
+			err = s.Send(spans)
+		case cs.stopped:
+			err = errSinkStopped
+		default:
+			err = s.queue.push(spans)
+		}
+		if err != nil {
+			failed = true
+			r.Err = err
+			if se, ok := err.(*SendError); ok {
+				r.Accepted, r.Dropped, r.Failed = se.Accepted, se.Dropped, se.Failed
+			} else {
+				r.Accepted, r.Failed = 0, len(spans)
+			}
+		}
+		results[i] = r
+	}
+	if !failed {
+		return nil
+	}
+	return &MultiError{Results: results}
+}
+
+// Ready checks the readiness of each individual sink that implements
+// ReadinessChecker.
+func (cs *CompositeSink) Ready() error {
 	for _, s := range cs.sinks {
-		s.Send(spans)
+		if rc, ok := s.Sink.(ReadinessChecker); ok {
+			if err := rc.Ready(); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// QueueFill returns the fill of the fullest queue among the sinks' own queues
+// and the individual sinks that implement QueueReporter.
+func (cs *CompositeSink) QueueFill() float64 {
+	var fill float64
+	for _, s := range cs.sinks {
+		if s.queue != nil {
+			if f := s.queue.fill(); f > fill {
+				fill = f
+			}
+		}
+		if qr, ok := s.Sink.(QueueReporter); ok {
+			if f := qr.QueueFill(); f > fill {
+				fill = f
+			}
+		}
+	}
+	return fill
+}
+
+// BufferFill returns the fill of the fullest disk buffer among the individual
+// sinks that implement BufferReporter.
+func (cs *CompositeSink) BufferFill() float64 {
+	var fill float64
+	for _, s := range cs.sinks {
+		if br, ok := s.Sink.(BufferReporter); ok {
+			if f := br.BufferFill(); f > fill {
+				fill = f
+			}
+		}
+	}
+	return fill
+}
+
+// Start starts each individual sink, and then the workers for their queues.
 func (cs *CompositeSink) Start() error {
 	for _, s := range cs.sinks {
 		if err := s.Start(); err != nil {
 			return err
 		}
 	}
+	for _, s := range cs.sinks {
+		if s.queue != nil {
+			s.queue.start()
+		}
+	}
 	return nil
 }
 
+// Stop waits for the spans in the sinks' queues to be sent, then stops each
+// individual sink, in the reverse of the order they were added, so that sinks
+// added later can still rely on earlier ones while they flush. All sinks are
+// stopped even if some fail; the first error is returned.
 func (cs *CompositeSink) Stop() error {
+	return cs.Shutdown(context.Background())
+}
+
+// Shutdown is like Stop, but gives up waiting for the sinks' queues once ctx
+// is done, dropping the spans that are still queued, and sinks that are
+// Shutdowners give up waiting for their spans to be sent then too.
+func (cs *CompositeSink) Shutdown(ctx context.Context) error {
+	cs.mu.Lock()
+	cs.stopped = true
+	cs.mu.Unlock()
+	// Close every queue before waiting for any, so that they all drain at
+	// once, and a stuck sink can't use up the others' time.
 	for _, s := range cs.sinks {
-		if err := s.Stop(); err != nil {
-			return err
+		if s.queue != nil {
+			s.queue.close()
 		}
 	}
-	return nil
+	var firstErr error
+	for _, s := range cs.sinks {
+		if s.queue != nil {
+			if err := s.queue.wait(ctx); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	for i := len(cs.sinks) - 1; i >= 0; i-- {
+		if err := shutdown(ctx, cs.sinks[i].Sink); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
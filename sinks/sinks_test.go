@@ -0,0 +1,765 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	libhoney "github.com/honeycombio/libhoney-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSink struct {
+	spans []*types.Span
+
+	sync.Mutex
+}
+
+func (ms *mockSink) Send(spans []*types.Span) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.spans = append(ms.spans, spans...)
+	return nil
+}
+
+func (ms *mockSink) Start() error { return nil }
+func (ms *mockSink) Stop() error  { return nil }
+
+func (ms *mockSink) count() int {
+	ms.Lock()
+	defer ms.Unlock()
+	return len(ms.spans)
+}
+
+func newSpan(traceID, id, parentID, service string, start time.Time, durationMs float64) *types.Span {
+	return &types.Span{
+		CoreSpanMetadata: types.CoreSpanMetadata{
+			TraceID:     traceID,
+			ID:          id,
+			ParentID:    parentID,
+			ServiceName: service,
+			DurationMs:  durationMs,
+		},
+		Timestamp:         start,
+		BinaryAnnotations: map[string]interface{}{},
+	}
+}
+
+func TestTraceSummary(t *testing.T) {
+	assert := assert.New(t)
+	ms := &mockSink{}
+	ts := &TraceSummarySink{Sink: ms}
+	assert.NoError(ts.Start())
+
+	start := time.Date(2017, 9, 28, 20, 15, 17, 0, time.UTC)
+	root := newSpan("t1", "a", "", "frontend", start, 100)
+	child := newSpan("t1", "b", "a", "backend", start.Add(10*time.Millisecond), 20)
+	grandchild := newSpan("t1", "c", "b", "db", start.Add(15*time.Millisecond), 110)
+	grandchild.BinaryAnnotations["error"] = true
+	orphan := newSpan("t2", "d", "x", "backend", start, 5)
+
+	// Spans for one trace can arrive in several requests, in any order.
+	assert.NoError(ts.Send([]*types.Span{grandchild, orphan}))
+	assert.NoError(ts.Send([]*types.Span{child, root}))
+	assert.Equal(0, ms.count())
+
+	assert.NoError(ts.Stop())
+	assert.Equal(4, ms.count())
+	var summarized *types.Span
+	for _, s := range ms.spans {
+		if s.ID == "a" {
+			summarized = s
+		}
+	}
+	assert.Equal(map[string]interface{}{
+		"trace.span_count":    3,
+		"trace.service_count": 3,
+		"trace.error_count":   1,
+		"trace.duration_ms":   125.0,
+		"trace.depth":         3,
+	}, summarized.BinaryAnnotations)
+	// The root span is copied, since other sinks may still be reading it.
+	assert.Empty(root.BinaryAnnotations)
+	assert.NotContains(child.BinaryAnnotations, "trace.span_count")
+	assert.NotContains(orphan.BinaryAnnotations, "trace.span_count")
+
+	// Spans sent after Stop are dropped, rather than buffered forever.
+	assert.Error(ts.Send([]*types.Span{newSpan("t3", "e", "", "frontend", start, 1)}))
+	assert.NoError(ts.Stop())
+	assert.Equal(4, ms.count())
+}
+
+// TestTraceSummaryConcurrentReads checks that summarizing a trace doesn't
+// modify spans that the handler may still be reading, e.g. to re-encode them
+// for a mirror. Run with -race.
+func TestTraceSummaryConcurrentReads(t *testing.T) {
+	ms := &mockSink{}
+	ts := &TraceSummarySink{Sink: ms, Timeout: time.Millisecond}
+	assert.NoError(t, ts.Start())
+	defer ts.Stop()
+
+	now := time.Now()
+	root := newSpan("t1", "a", "", "frontend", now, 1)
+	root.BinaryAnnotations["http.status_code"] = int64(200)
+	assert.NoError(t, ts.Send([]*types.Span{root, newSpan("t1", "b", "a", "backend", now, 1)}))
+	deadline := time.Now().Add(time.Second)
+	for ms.count() < 2 && time.Now().Before(deadline) {
+		json.Marshal(root)
+	}
+	assert.Equal(t, 2, ms.count())
+	assert.Equal(t, map[string]interface{}{"http.status_code": int64(200)}, root.BinaryAnnotations)
+}
+
+func TestTraceSummaryTimeout(t *testing.T) {
+	assert := assert.New(t)
+	ms := &mockSink{}
+	ts := &TraceSummarySink{Sink: ms, Timeout: 20 * time.Millisecond, MaxWait: time.Hour, MaxTraces: 1}
+	assert.NoError(ts.Start())
+	defer ts.Stop()
+
+	now := time.Now()
+	assert.NoError(ts.Send([]*types.Span{
+		newSpan("t1", "a", "", "frontend", now, 1),
+		newSpan("t1", "b", "a", "frontend", now, 1),
+	}))
+	// The buffer is full, so spans for other traces are passed through.
+	assert.NoError(ts.Send([]*types.Span{newSpan("t2", "c", "", "frontend", now, 1)}))
+	assert.Equal(1, ms.count())
+
+	deadline := time.Now().Add(time.Second)
+	for ms.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(3, ms.count())
+
+	// Timeouts too short to check twice per timeout still work.
+	short := &TraceSummarySink{Sink: &mockSink{}, Timeout: time.Nanosecond}
+	assert.NoError(short.Start())
+	assert.NoError(short.Stop())
+}
+
+func TestDependencyGraph(t *testing.T) {
+	assert := assert.New(t)
+	ds := &DependencySink{Interval: time.Hour}
+	assert.NoError(ds.Start())
+	defer ds.Stop()
+
+	now := time.Now()
+	root := newSpan("t1", "a", "", "frontend", now, 10)
+	call := newSpan("t1", "b", "a", "backend", now, 5)
+	call.BinaryAnnotations["error"] = true
+	internal := newSpan("t1", "c", "b", "backend", now, 1)
+	// The query's parent arrives after it does.
+	query := newSpan("t1", "e", "d", "db", now, 1)
+	lateCall := newSpan("t1", "d", "a", "backend", now, 1)
+
+	assert.NoError(ds.Send([]*types.Span{root, call, internal, query}))
+	assert.NoError(ds.Send([]*types.Span{lateCall}))
+	ds.rotate(time.Now())
+
+	// Zipkin v1 client and server halves of the same span.
+	clientHalf := newSpan("t2", "b", "a", "frontend", now, 5)
+	clientHalf.Annotations = []*types.Annotation{{Value: "cs"}, {Value: "cr"}}
+	serverHalf := newSpan("t2", "b", "a", "backend", now, 4)
+	serverHalf.Annotations = []*types.Annotation{{Value: "sr"}, {Value: "ss"}}
+	assert.NoError(ds.Send([]*types.Span{
+		serverHalf,
+		newSpan("t2", "c", "b", "db", now, 1),
+		clientHalf,
+		newSpan("t2", "a", "", "frontend", now, 10),
+	}))
+
+	assert.Equal([]DependencyEdge{
+		{Parent: "backend", Child: "db", Calls: 2},
+		{Parent: "frontend", Child: "backend", Calls: 3, Errors: 1},
+	}, ds.Edges())
+}
+
+// TestDependencySummaryEvents checks that the DependencySink sends summary
+// events for the partial interval when it stops, and none once the Honeycomb
+// sink has stopped.
+func TestDependencySummaryEvents(t *testing.T) {
+	assert := assert.New(t)
+	output := &libhoney.MockOutput{}
+	hs := &HoneycombSink{Writekey: "key", Dataset: "traces", Output: output}
+	assert.NoError(hs.Start())
+	ds := &DependencySink{Dataset: "deps", Honeycomb: hs, Interval: time.Hour}
+	assert.NoError(ds.Start())
+
+	now := time.Now()
+	assert.NoError(ds.Send([]*types.Span{
+		newSpan("t1", "a", "", "frontend", now, 10),
+		newSpan("t1", "b", "a", "backend", now, 5),
+	}))
+	assert.NoError(ds.Stop())
+	events := output.Events()
+	if assert.Equal(1, len(events)) {
+		assert.Equal("deps", events[0].Dataset)
+		fields := events[0].Fields()
+		assert.Equal("frontend", fields["parentService"])
+		assert.Equal("backend", fields["childService"])
+		assert.Equal(int64(1), fields["calls"])
+		assert.True(fields["intervalSec"].(float64) < time.Hour.Seconds())
+	}
+
+	ds = &DependencySink{Dataset: "deps", Honeycomb: hs, Interval: time.Hour}
+	assert.NoError(ds.Start())
+	assert.NoError(ds.Send([]*types.Span{
+		newSpan("t2", "a", "", "frontend", now, 10),
+		newSpan("t2", "b", "a", "backend", now, 5),
+	}))
+	assert.NoError(hs.Stop())
+	assert.NoError(ds.Stop())
+	assert.Equal(1, len(output.Events()))
+}
+
+type queueSink struct {
+	mockSink
+	fill float64
+}
+
+func (qs *queueSink) QueueFill() float64 { return qs.fill }
+
+func TestQueueFill(t *testing.T) {
+	assert := assert.New(t)
+	full, empty := &queueSink{fill: 0.7}, &queueSink{}
+	cs := &CompositeSink{}
+	cs.Add("mock", &mockSink{})
+	assert.Equal(0.0, cs.QueueFill())
+	cs.Add("trace_summary", &TraceSummarySink{Sink: full})
+	cs.AddBestEffort("empty", empty)
+	assert.Equal(0.7, cs.QueueFill())
+	empty.fill = 0.9
+	assert.Equal(0.9, cs.QueueFill())
+}
+
+type failingSink struct {
+	mockSink
+	err error
+}
+
+func (fs *failingSink) Send(spans []*types.Span) error { return fs.err }
+
+func TestCompositeSinkErrors(t *testing.T) {
+	assert := assert.New(t)
+	spans := []*types.Span{newSpan("1", "1", "", "a", time.Now(), 1), newSpan("1", "2", "1", "a", time.Now(), 1)}
+	ok := &mockSink{}
+	partial := &failingSink{}
+	broken := &failingSink{}
+	cs := &CompositeSink{}
+	cs.Add("ok", ok)
+	cs.Add("partial", partial)
+	cs.AddBestEffort("broken", broken)
+	assert.NoError(cs.Send(spans))
+
+	broken.err = errors.New("broken")
+	err := cs.Send(spans)
+	if me, isMulti := err.(*MultiError); assert.True(isMulti) {
+		assert.False(me.RequiredFailed())
+		assert.Equal([]SinkResult{
+			{Name: "ok", Required: true, Accepted: 2},
+			{Name: "partial", Required: true, Accepted: 2},
+			{Name: "broken", Failed: 2, Err: broken.err},
+		}, me.Results)
+	}
+	assert.Equal("broken: broken", err.Error())
+
+	partial.err = &SendError{Dropped: 1, Failed: 1, Err: errors.New("queue overflow")}
+	err = cs.Send(spans)
+	if me, isMulti := err.(*MultiError); assert.True(isMulti) {
+		assert.True(me.RequiredFailed())
+		assert.Equal(SinkResult{Name: "partial", Required: true, Dropped: 1, Failed: 1, Err: partial.err}, me.Results[1])
+	}
+	assert.Equal("partial: 1 of 2 spans failed: queue overflow; broken: broken", err.Error())
+	assert.Equal(6, ok.count())
+}
+
+// blockingSink takes spans only once they're released.
+type blockingSink struct {
+	mockSink
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (bs *blockingSink) Send(spans []*types.Span) error {
+	bs.sending <- struct{}{}
+	<-bs.release
+	return bs.mockSink.Send(spans)
+}
+
+func TestCompositeSinkQueues(t *testing.T) {
+	for _, tc := range []struct {
+		overflow string
+		// ids are the IDs of the spans the slow sink gets.
+		ids []string
+	}{
+		{OverflowDropNewest, []string{"1", "2"}},
+		{OverflowDropOldest, []string{"1", "3"}},
+		{OverflowBlock, []string{"1", "2"}},
+	} {
+		assert := assert.New(t)
+		fast := &mockSink{}
+		slow := &blockingSink{sending: make(chan struct{}), release: make(chan struct{})}
+		cs := &CompositeSink{}
+		cs.Add("fast", fast)
+		cs.AddWithOptions("slow", slow, SinkOptions{QueueSize: 1, Overflow: tc.overflow, BlockTimeout: 10 * time.Millisecond})
+		assert.NoError(cs.Start())
+
+		span := func(id string) []*types.Span {
+			return []*types.Span{newSpan("t", id, "", "a", time.Now(), 1)}
+		}
+		// The first span is being sent to the slow sink, and the second
+		// waits in its queue, without holding up the fast sink.
+		assert.NoError(cs.Send(span("1")))
+		<-slow.sending
+		assert.NoError(cs.Send(span("2")))
+		assert.Equal(1.0, cs.QueueFill(), tc.overflow)
+
+		err := cs.Send(span("3"))
+		if tc.overflow == OverflowDropOldest {
+			assert.NoError(err, tc.overflow)
+		} else if me, isMulti := err.(*MultiError); assert.True(isMulti, tc.overflow) {
+			assert.False(me.RequiredFailed())
+			assert.Equal(SinkResult{Name: "slow", Failed: 1, Err: errQueueFull}, me.Results[1], tc.overflow)
+		}
+		assert.Equal(3, fast.count(), tc.overflow)
+
+		// Stop waits for the queue to be emptied.
+		go func() {
+			for range slow.sending {
+			}
+		}()
+		close(slow.release)
+		assert.NoError(cs.Stop())
+		close(slow.sending)
+		var ids []string
+		for _, s := range slow.spans {
+			ids = append(ids, s.ID)
+		}
+		assert.Equal(tc.ids, ids, tc.overflow)
+		assert.Error(cs.Send(span("4")))
+	}
+}
+
+// TestCompositeSinkShutdownDeadline checks that a stuck sink doesn't hold up
+// Shutdown past its deadline, and that the spans still queued for it are
+// dropped.
+func TestCompositeSinkShutdownDeadline(t *testing.T) {
+	assert := assert.New(t)
+	stuck := &blockingSink{sending: make(chan struct{}), release: make(chan struct{})}
+	fast := &mockSink{}
+	cs := &CompositeSink{}
+	cs.AddWithOptions("stuck", stuck, SinkOptions{QueueSize: 2})
+	cs.AddWithOptions("fast", fast, SinkOptions{QueueSize: 2})
+	assert.NoError(cs.Start())
+
+	span := func(id string) []*types.Span {
+		return []*types.Span{newSpan("t", id, "", "a", time.Now(), 1)}
+	}
+	assert.NoError(cs.Send(span("1")))
+	<-stuck.sending
+	assert.NoError(cs.Send(span("2")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := cs.Shutdown(ctx)
+	assert.True(time.Since(start) < time.Second)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "1 batches of spans queued for stuck weren't sent")
+	}
+	// The other sink's queue was drained in the meantime.
+	assert.Equal(2, fast.count())
+
+	// Once the stuck sink returns, its queued spans are dropped.
+	close(stuck.release)
+	go func() {
+		for range stuck.sending {
+		}
+	}()
+	assert.NoError(cs.Shutdown(context.Background()))
+	close(stuck.sending)
+	assert.Equal(1, stuck.count())
+}
+
+// TestSinkQueueStop checks that a queue can be stopped more than once, and
+// before it's started.
+func TestSinkQueueStop(t *testing.T) {
+	q := &sinkQueue{name: "unstarted", sink: &mockSink{}}
+	q.close()
+	assert.NoError(t, q.wait(context.Background()))
+
+	q = &sinkQueue{name: "started", sink: &mockSink{}, opts: SinkOptions{QueueSize: 1}}
+	q.start()
+	q.close()
+	q.close()
+	assert.NoError(t, q.wait(context.Background()))
+	assert.NoError(t, q.wait(context.Background()))
+}
+
+// TestHoneycombDiskBuffer checks that buffered events are sent to the batch
+// API in order, and retried while it's failing.
+func TestHoneycombDiskBuffer(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "buffer")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var paths, writekeys []string
+	var events []map[string]interface{}
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&batch)
+		paths = append(paths, r.URL.Path)
+		writekeys = append(writekeys, r.Header.Get("X-Honeycomb-Team"))
+		events = append(events, batch...)
+		w.Write([]byte("[" + strings.Repeat(`{"status": 202},`, len(batch)-1) + `{"status": 202}]`))
+	}))
+	defer server.Close()
+
+	hs := &HoneycombSink{
+		Writekey:        "key",
+		Dataset:         "traces",
+		APIHost:         server.URL,
+		ServiceDatasets: map[string]string{"b": "other"},
+		BufferDir:       dir,
+	}
+	assert.NoError(hs.Start())
+	now := time.Now()
+	// The client that sent the last span asked for another write key.
+	tenant := newSpan("1", "4", "2", "b", now, 1)
+	tenant.WriteKey = "key2"
+	assert.NoError(hs.Send([]*types.Span{
+		newSpan("1", "1", "", "a", now, 1),
+		newSpan("1", "2", "1", "a", now, 1),
+		newSpan("1", "3", "2", "b", now, 1),
+		tenant,
+	}))
+	assert.NoError(hs.Stop())
+
+	assert.Equal([]string{"/1/batch/traces", "/1/batch/other", "/1/batch/other"}, paths)
+	assert.Equal([]string{"key", "key", "key2"}, writekeys)
+	assert.Equal(4, len(events))
+	for i, id := range []string{"1", "2", "3", "4"} {
+		assert.Equal(id, events[i]["data"].(map[string]interface{})["id"])
+	}
+	assert.Equal(0, hs.Pending())
+}
+
+// TestHoneycombDiskBufferShutdown checks that Shutdown doesn't wait for the
+// disk buffer to be sent for longer than its context allows, and that the
+// events left in the buffer are sent after a restart.
+func TestHoneycombDiskBufferShutdown(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "buffer")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	available := false
+	var received int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&batch)
+		received += len(batch)
+		w.Write([]byte("[" + strings.TrimSuffix(strings.Repeat(`{"status": 202},`, len(batch)), ",") + "]"))
+	}))
+	defer server.Close()
+
+	hs := &HoneycombSink{Writekey: "key", Dataset: "traces", APIHost: server.URL, BufferDir: dir}
+	assert.NoError(hs.Start())
+	now := time.Now()
+	assert.NoError(hs.Send([]*types.Span{
+		newSpan("1", "1", "", "a", now, 1),
+		newSpan("1", "2", "1", "a", now, 1),
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = hs.Shutdown(ctx)
+	assert.Error(err)
+	assert.Contains(err.Error(), "2 events")
+	assert.True(time.Since(start) < 5*time.Second)
+
+	mu.Lock()
+	available = true
+	mu.Unlock()
+	hs = &HoneycombSink{Writekey: "key", Dataset: "traces", APIHost: server.URL, BufferDir: dir}
+	assert.NoError(hs.Start())
+	assert.NoError(hs.Stop())
+	assert.Equal(2, received)
+}
+
+// TestHoneycombSinksSideBySide checks that HoneycombSinks with different write
+// keys, API hosts and batching settings each send their own events, and keep
+// track of their own responses.
+func TestHoneycombSinksSideBySide(t *testing.T) {
+	assert := assert.New(t)
+	type request struct {
+		path, writekey string
+		events         int
+	}
+	newServer := func(status int) (*httptest.Server, func() []request) {
+		var mu sync.Mutex
+		var requests []request
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var batch []map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&batch)
+			mu.Lock()
+			requests = append(requests, request{r.URL.Path, r.Header.Get("X-Honeycomb-Team"), len(batch)})
+			mu.Unlock()
+			w.Write([]byte("[" + strings.TrimSuffix(strings.Repeat(fmt.Sprintf(`{"status": %d},`, status), len(batch)), ",") + "]"))
+		}))
+		return server, func() []request {
+			mu.Lock()
+			defer mu.Unlock()
+			return requests
+		}
+	}
+	server1, requests1 := newServer(http.StatusAccepted)
+	defer server1.Close()
+	server2, requests2 := newServer(http.StatusBadRequest)
+	defer server2.Close()
+
+	hs1 := &HoneycombSink{Writekey: "key1", Dataset: "traces", APIHost: server1.URL, MaxBatchSize: 2, BatchTimeout: time.Hour}
+	hs2 := &HoneycombSink{Writekey: "key2", Dataset: "other", APIHost: server2.URL, MaxErrorRate: 0.5}
+	assert.NoError(hs1.Start())
+	assert.NoError(hs2.Start())
+
+	now := time.Now()
+	var spans []*types.Span
+	for _, id := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"} {
+		spans = append(spans, newSpan("1", id, "", "a", now, 1))
+	}
+	assert.NoError(hs1.Send(spans[:4]))
+	assert.NoError(hs2.Send(spans))
+	deadline := time.Now().Add(time.Second)
+	for (hs1.Pending() > 0 || hs2.Pending() > 0) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Only the sink whose events were rejected is unhealthy.
+	assert.NoError(hs1.Ready())
+	assert.Error(hs2.Ready())
+	assert.NoError(hs1.Stop())
+	assert.NoError(hs2.Stop())
+
+	assert.Equal([]request{{"/1/batch/traces", "key1", 2}, {"/1/batch/traces", "key1", 2}}, requests1())
+	total := 0
+	for _, r := range requests2() {
+		assert.Equal("/1/batch/other", r.path)
+		assert.Equal("key2", r.writekey)
+		total += r.events
+	}
+	assert.Equal(10, total)
+	assert.Equal(0, hs1.Pending())
+	assert.Equal(0, hs2.Pending())
+}
+
+// TestHoneycombQueueOverflow checks that events dropped because the sink's
+// queue is full count as failures, rather than as accepted.
+func TestHoneycombQueueOverflow(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`[{"status": 202}]`))
+	}))
+	defer server.Close()
+
+	hs := &HoneycombSink{Writekey: "key", Dataset: "traces", APIHost: server.URL,
+		MaxBatchSize: 1, MaxConcurrentBatches: 1, PendingWorkCapacity: 1}
+	assert.NoError(hs.Start())
+	now := time.Now()
+	var spans []*types.Span
+	for _, id := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"} {
+		spans = append(spans, newSpan("1", id, "", "a", now, 1))
+	}
+	err := hs.Send(spans)
+	close(release)
+	assert.NoError(hs.Stop())
+
+	// At most one event is being sent, one is waiting to be batched and one
+	// is queued; the rest are dropped.
+	if assert.IsType(&SendError{}, err) {
+		sendErr := err.(*SendError)
+		assert.True(sendErr.Accepted <= 3, "%+v", sendErr)
+		assert.Equal(10, sendErr.Accepted+sendErr.Failed)
+		assert.Equal(errQueueOverflow, sendErr.Err)
+	}
+	assert.Equal(0, hs.Pending())
+}
+
+// blockingOutput is a libhoney.Output whose first Add blocks until release is
+// closed, and which records whether any events were added after Stop.
+type blockingOutput struct {
+	adding, release chan struct{}
+
+	mu           sync.Mutex
+	adds         int
+	stopped      bool
+	addAfterStop bool
+}
+
+func (bo *blockingOutput) Add(ev *libhoney.Event) {
+	bo.mu.Lock()
+	bo.adds++
+	first := bo.adds == 1
+	bo.addAfterStop = bo.addAfterStop || bo.stopped
+	bo.mu.Unlock()
+	if first {
+		close(bo.adding)
+		<-bo.release
+	}
+}
+
+func (bo *blockingOutput) Start() error { return nil }
+
+func (bo *blockingOutput) Stop() error {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	bo.stopped = true
+	return nil
+}
+
+// TestHoneycombSendWhileStopping checks that spans being sent while the sink
+// stops are handed to its output before the output is stopped.
+func TestHoneycombSendWhileStopping(t *testing.T) {
+	assert := assert.New(t)
+	output := &blockingOutput{adding: make(chan struct{}), release: make(chan struct{})}
+	hs := &HoneycombSink{Writekey: "key", Dataset: "traces", Output: output}
+	assert.NoError(hs.Start())
+
+	now := time.Now()
+	sent := make(chan error)
+	go func() {
+		sent <- hs.Send([]*types.Span{newSpan("1", "1", "", "a", now, 1), newSpan("1", "2", "", "a", now, 1)})
+	}()
+	<-output.adding
+	stopped := make(chan error)
+	go func() { stopped <- hs.Stop() }()
+	select {
+	case <-stopped:
+		t.Fatal("sink stopped while spans were being sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(output.release)
+	assert.NoError(<-sent)
+	assert.NoError(<-stopped)
+
+	assert.Equal(2, output.adds)
+	assert.False(output.addAfterStop)
+	assert.Error(hs.Send([]*types.Span{newSpan("1", "3", "", "a", now, 1)}))
+}
+
+func TestHoneycombRoutes(t *testing.T) {
+	assert := assert.New(t)
+	output := &libhoney.MockOutput{}
+	hs := &HoneycombSink{
+		Writekey:   "key",
+		Dataset:    "traces",
+		SampleRate: 1,
+		Routes: []Route{
+			{Match: "service=payments*,environment=prod", Dataset: "payments-prod", SampleRate: 2},
+			{Match: "service=payments*", Dataset: "payments"},
+			{Match: "name=*health*", SampleRate: 1000},
+		},
+		Output: output,
+	}
+	assert.NoError(hs.Start())
+
+	now := time.Now()
+	prod := newSpan("1", "1", "", "payments-api", now, 1)
+	prod.BinaryAnnotations["environment"] = "prod"
+	sampled := newSpan("1", "2", "", "payments-api", now, 1)
+	sampled.BinaryAnnotations["environment"] = "prod"
+	sampled.TraceIDAsInt = 1
+	staging := newSpan("1", "3", "", "payments-worker", now, 1)
+	staging.BinaryAnnotations["environment"] = "staging"
+	health := newSpan("1", "4", "", "frontend", now, 1)
+	health.Name = "GET /healthz"
+	health.TraceIDAsInt = 1
+	other := newSpan("1", "5", "", "frontend", now, 1)
+	other.Name = "GET /"
+	assert.NoError(hs.Send([]*types.Span{prod, sampled, staging, health, other}))
+	assert.NoError(hs.Stop())
+
+	// The first matching route wins, and spans that match none fall back to
+	// the sink's dataset and sample rate. Spans 2 and 4 are sampled out at
+	// their routes' rates.
+	events := output.Events()
+	assert.Equal(3, len(events))
+	for i, expected := range []struct {
+		id, dataset string
+		sampleRate  uint
+	}{
+		{"1", "payments-prod", 2},
+		{"3", "payments", 1},
+		{"5", "traces", 1},
+	} {
+		assert.Equal(expected.id, events[i].Fields()["id"])
+		assert.Equal(expected.dataset, events[i].Dataset)
+		assert.Equal(expected.sampleRate, events[i].SampleRate)
+	}
+}
+
+func TestRouteMatching(t *testing.T) {
+	assert := assert.New(t)
+	for _, c := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"payments", "payments", true},
+		{"payments", "payments-api", false},
+		{"payments*", "payments-api", true},
+		{"*-api", "payments-api", true},
+		{"p*s-*i", "payments-api", true},
+		{"p*x*", "payments-api", false},
+		{"*", "", true},
+	} {
+		assert.Equal(c.match, globMatch(c.pattern, c.s), c.pattern+" "+c.s)
+	}
+
+	span := newSpan("1", "1", "", "payments", time.Now(), 1)
+	span.BinaryAnnotations["http.status_code"] = 500
+	for _, c := range []struct {
+		match string
+		ok    bool
+	}{
+		{"", true},
+		{"http.status_code=5*", true},
+		{"service=payments, http.status_code=4*", false},
+		{"region=*", false},
+	} {
+		r, err := parseRoute(Route{Match: c.match})
+		assert.NoError(err)
+		assert.Equal(c.ok, r.matches(span), c.match)
+	}
+
+	assert.Error(CheckRoutes([]Route{{Match: "service"}}))
+	assert.Error(CheckRoutes([]Route{{Match: "service=a,=b"}}))
+}
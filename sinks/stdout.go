@@ -3,13 +3,26 @@ package sinks
 import (
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
 )
 
-// StdoutSink implements the Sink interface. It writes span data to stdout.
-type StdoutSink struct{}
+// StdoutSink implements the Sink interface. It writes span data to stdout,
+// unless it has been disabled with SetEnabled.
+type StdoutSink struct {
+	disabled int32
+}
+
+// SetEnabled turns writing spans to stdout on or off.
+func (s *StdoutSink) SetEnabled(enabled bool) {
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	atomic.StoreInt32(&s.disabled, disabled)
+}
 
 func (s *StdoutSink) Start() error {
 	return nil
@@ -20,6 +33,9 @@ func (s *StdoutSink) Stop() error {
 }
 
 func (s *StdoutSink) Send(spans []*types.Span) error {
+	if atomic.LoadInt32(&s.disabled) != 0 {
+		return nil
+	}
 	for _, span := range spans {
 		marshalled, err := json.Marshal(span)
 		if err != nil {
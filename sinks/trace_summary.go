@@ -0,0 +1,280 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+const (
+	traceSpanCountKey    = "trace.span_count"
+	traceServiceCountKey = "trace.service_count"
+	traceErrorCountKey   = "trace.error_count"
+	traceDurationMsKey   = "trace.duration_ms"
+	traceDepthKey        = "trace.depth"
+)
+
+// TraceSummarySink implements the Sink interface. It buffers spans by trace
+// before handing them to Sink, so that it can annotate each trace's root span
+// (the span without a ParentID) with facts that no single span knows: the
+// number of spans, services and errors in the trace, its overall duration and
+// its depth.
+//
+// A trace is flushed once its root span has arrived and no new spans have
+// arrived for Timeout, or once it has been buffered for MaxWait, whichever is
+// first. Traces flushed without a root span aren't annotated. If MaxTraces
+// traces are already buffered, spans for new traces are passed straight
+// through.
+type TraceSummarySink struct {
+	Sink      Sink
+	Timeout   time.Duration
+	MaxWait   time.Duration
+	MaxTraces int
+
+	mu      sync.Mutex
+	traces  map[string]*bufferedTrace
+	stopped bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type bufferedTrace struct {
+	spans     []*types.Span
+	root      *types.Span
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+func (ts *TraceSummarySink) Start() error {
+	if ts.Timeout <= 0 {
+		ts.Timeout = 5 * time.Second
+	}
+	if ts.MaxWait <= 0 {
+		ts.MaxWait = time.Minute
+	}
+	if ts.MaxTraces == 0 {
+		ts.MaxTraces = 10000
+	}
+	ts.traces = make(map[string]*bufferedTrace)
+	ts.done = make(chan struct{})
+	ts.wg.Add(1)
+	go ts.run()
+	return ts.Sink.Start()
+}
+
+func (ts *TraceSummarySink) Stop() error {
+	return ts.Shutdown(context.Background())
+}
+
+// Shutdown sends the buffered traces on, and shuts down the wrapped Sink,
+// which gives up waiting for them to be sent once ctx is done if it's a
+// Shutdowner. Spans sent after Shutdown are dropped.
+func (ts *TraceSummarySink) Shutdown(ctx context.Context) error {
+	ts.mu.Lock()
+	stopped := ts.stopped
+	ts.stopped = true
+	ts.mu.Unlock()
+	if stopped {
+		return nil
+	}
+	close(ts.done)
+	ts.wg.Wait()
+	ts.flush(func(*bufferedTrace) bool { return true })
+	return shutdown(ctx, ts.Sink)
+}
+
+func (ts *TraceSummarySink) Send(spans []*types.Span) error {
+	var passthrough []*types.Span
+	now := time.Now()
+
+	ts.mu.Lock()
+	if ts.stopped {
+		ts.mu.Unlock()
+		traceSummaryDropped.Add(float64(len(spans)))
+		logrus.WithField("spans", len(spans)).Info("Dropping spans sent after the trace summary sink stopped")
+		return errors.New("trace summary sink stopped")
+	}
+	for _, s := range spans {
+		bt, ok := ts.traces[s.TraceID]
+		if !ok {
+			if len(ts.traces) >= ts.MaxTraces {
+				passthrough = append(passthrough, s)
+				continue
+			}
+			bt = &bufferedTrace{firstSeen: now}
+			ts.traces[s.TraceID] = bt
+		}
+		bt.spans = append(bt.spans, s)
+		bt.lastSeen = now
+		if s.ParentID == "" && bt.root == nil {
+			bt.root = s
+		}
+	}
+	ts.mu.Unlock()
+
+	if len(passthrough) > 0 {
+		logrus.WithField("traces", ts.MaxTraces).Debug("Trace buffer full, sending spans without summary")
+		return ts.Sink.Send(passthrough)
+	}
+	return nil
+}
+
+// Ready reports whether the wrapped sink is ready, and the trace buffer isn't
+// full.
+func (ts *TraceSummarySink) Ready() error {
+	ts.mu.Lock()
+	started, buffered := ts.traces != nil, len(ts.traces)
+	ts.mu.Unlock()
+	if !started {
+		return errors.New("trace buffer not started")
+	}
+	if buffered >= ts.MaxTraces {
+		return errors.New("trace buffer full")
+	}
+	if rc, ok := ts.Sink.(ReadinessChecker); ok {
+		return rc.Ready()
+	}
+	return nil
+}
+
+// QueueFill returns the wrapped sink's queue fill, if it has a queue. The trace
+// buffer doesn't count, since spans are passed straight through when it's
+// full.
+func (ts *TraceSummarySink) QueueFill() float64 {
+	if qr, ok := ts.Sink.(QueueReporter); ok {
+		return qr.QueueFill()
+	}
+	return 0
+}
+
+// BufferFill returns the wrapped sink's disk buffer fill, if it has one.
+func (ts *TraceSummarySink) BufferFill() float64 {
+	if br, ok := ts.Sink.(BufferReporter); ok {
+		return br.BufferFill()
+	}
+	return 0
+}
+
+func (ts *TraceSummarySink) run() {
+	defer ts.wg.Done()
+	// Check for finished traces twice per Timeout, but no more often than
+	// time.NewTicker allows.
+	interval := ts.Timeout / 2
+	if interval <= 0 {
+		interval = ts.Timeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ts.done:
+			return
+		case now := <-ticker.C:
+			ts.flush(func(bt *bufferedTrace) bool {
+				return (bt.root != nil && now.Sub(bt.lastSeen) >= ts.Timeout) ||
+					now.Sub(bt.firstSeen) >= ts.MaxWait
+			})
+		}
+	}
+}
+
+// flush summarizes and sends every buffered trace for which ready returns
+// true.
+func (ts *TraceSummarySink) flush(ready func(*bufferedTrace) bool) {
+	var spans []*types.Span
+	ts.mu.Lock()
+	for id, bt := range ts.traces {
+		if ready(bt) {
+			delete(ts.traces, id)
+			summarizeTrace(bt)
+			spans = append(spans, bt.spans...)
+		}
+	}
+	ts.mu.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+	if err := ts.Sink.Send(spans); err != nil {
+		logrus.WithError(err).Info("Error sending buffered spans")
+	}
+}
+
+// summarizeTrace adds trace-level fields to the root span of a buffered trace.
+func summarizeTrace(bt *bufferedTrace) {
+	if bt.root == nil {
+		return
+	}
+
+	byID := make(map[string]*types.Span, len(bt.spans))
+	services := make(map[string]struct{})
+	var errorCount int
+	var start, end time.Time
+	for _, s := range bt.spans {
+		byID[s.ID] = s
+		if s.ServiceName != "" {
+			services[s.ServiceName] = struct{}{}
+		}
+		if isError, _ := s.BinaryAnnotations["error"].(bool); isError {
+			errorCount++
+		}
+		spanEnd := s.Timestamp.Add(time.Duration(s.DurationMs * float64(time.Millisecond)))
+		if start.IsZero() || s.Timestamp.Before(start) {
+			start = s.Timestamp
+		}
+		if spanEnd.After(end) {
+			end = spanEnd
+		}
+	}
+
+	depth := 0
+	for _, s := range bt.spans {
+		if d := spanDepth(s, byID); d > depth {
+			depth = d
+		}
+	}
+
+	// Annotate a copy of the root span, since the original may still be
+	// being read by other sinks.
+	root := *bt.root
+	root.BinaryAnnotations = make(map[string]interface{}, len(bt.root.BinaryAnnotations)+5)
+	for k, v := range bt.root.BinaryAnnotations {
+		root.BinaryAnnotations[k] = v
+	}
+	root.BinaryAnnotations[traceSpanCountKey] = len(bt.spans)
+	root.BinaryAnnotations[traceServiceCountKey] = len(services)
+	root.BinaryAnnotations[traceErrorCountKey] = errorCount
+	root.BinaryAnnotations[traceDurationMsKey] = float64(end.Sub(start)) / float64(time.Millisecond)
+	root.BinaryAnnotations[traceDepthKey] = depth
+	for i, s := range bt.spans {
+		if s == bt.root {
+			bt.spans[i] = &root
+		}
+	}
+	bt.root = &root
+}
+
+// spanDepth returns the number of spans on the path from s up to the root of
+// its trace, counting both ends. Spans whose parent wasn't received stop the
+// walk early.
+func spanDepth(s *types.Span, byID map[string]*types.Span) int {
+	depth := 1
+	seen := map[string]struct{}{s.ID: struct{}{}}
+	for s.ParentID != "" {
+		parent, ok := byID[s.ParentID]
+		if !ok {
+			break
+		}
+		if _, ok := seen[parent.ID]; ok {
+			break
+		}
+		seen[parent.ID] = struct{}{}
+		depth++
+		s = parent
+	}
+	return depth
+}
@@ -0,0 +1,78 @@
+// Package jsonbench benchmarks the JSON span decoders of the v1 and v2
+// packages in the same way, on payloads of the same size.
+//
+// Most of the time spent decoding goes to encoding/json's reflection on each
+// span, which is the same whether the array is decoded whole or element by
+// element, so the streaming decoders take about as long as Baseline, within
+// the noise between runs. What they save is memory: they never hold every
+// decoded ZipkinJSONSpan at once, and allocate less than half the bytes.
+package jsonbench
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// Spans is the number of spans in each benchmark payload.
+const Spans = 10000
+
+// Decoders are the ways of decoding a JSON array of spans to compare.
+type Decoders struct {
+	// DecodeJSON decodes the array span by span and returns all the spans.
+	DecodeJSON func(io.Reader) ([]*types.Span, error)
+	// DecodeJSONFunc handles each span as it's decoded, without keeping
+	// them all.
+	DecodeJSONFunc func(io.Reader, func(*types.Span) error) error
+	// Baseline decodes the whole array before converting it, as DecodeJSON
+	// used to, for comparison.
+	Baseline func(io.Reader) ([]*types.Span, error)
+}
+
+// Payload returns a JSON array with Spans elements. Each is span formatted
+// with a trace ID, ID and parent ID as integers, and its index.
+func Payload(span string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i := 0; i < Spans; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, span, i/10, i+1, i/10*10+1, i)
+	}
+	buf.WriteString("]")
+	return buf.Bytes()
+}
+
+// Run benchmarks each of the decoders on payload.
+func Run(b *testing.B, payload []byte, d Decoders) {
+	b.Run("DecodeJSON", func(b *testing.B) {
+		run(b, func() error {
+			_, err := d.DecodeJSON(bytes.NewReader(payload))
+			return err
+		})
+	})
+	b.Run("DecodeJSONFunc", func(b *testing.B) {
+		run(b, func() error {
+			return d.DecodeJSONFunc(bytes.NewReader(payload), func(*types.Span) error { return nil })
+		})
+	})
+	b.Run("Baseline", func(b *testing.B) {
+		run(b, func() error {
+			_, err := d.Baseline(bytes.NewReader(payload))
+			return err
+		})
+	})
+}
+
+func run(b *testing.B, decode func() error) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := decode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+var errNotArray = errors.New("expected a JSON array of spans")
+
+// DecodeJSONArray reads a JSON array from an io.Reader one element at a time,
+// so that the whole array doesn't have to be held in memory at once. It calls
+// decodeElement to decode each element from the json.Decoder, and stops if it
+// returns an error. A null array is treated as an empty one.
+func DecodeJSONArray(r io.Reader, decodeElement func(*json.Decoder) error) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return errNotArray
+	}
+	for dec.More() {
+		if err := decodeElement(dec); err != nil {
+			return err
+		}
+	}
+	// Read the closing bracket.
+	_, err = dec.Token()
+	return err
+}
@@ -1,6 +1,8 @@
 package types
 
 import (
+	"fmt"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -14,18 +16,37 @@ import (
 //   values, respectively.
 type Span struct {
 	CoreSpanMetadata
-	Annotations       []*annotation          `json:"annotations,omitempty"` // TODO lift annotation struct definition into this file
+	Annotations       []*Annotation          `json:"annotations,omitempty"`
 	BinaryAnnotations map[string]interface{} `json:"binaryAnnotations,omitempty"`
 	Timestamp         time.Time              `json:"timestamp,omitempty"`
+
+	// WriteKey and Dataset, if set, are the Honeycomb write key and dataset
+	// that the client asked for the span to be sent with.
+	WriteKey string `json:"-"`
+	Dataset  string `json:"-"`
+}
+
+// BinaryAnnotationKeys returns the keys of BinaryAnnotations, sorted.
+func (s *Span) BinaryAnnotationKeys() []string {
+	keys := make([]string, 0, len(s.BinaryAnnotations))
+	for k := range s.BinaryAnnotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-type annotation struct {
+// Annotation is a timestamped event within a span, e.g. "cs" (client send) or
+// a log message. The timestamp is a Unix timestamp in microseconds, as in
+// Zipkin.
+type Annotation struct {
 	Timestamp int64     `json:"timestamp"`
 	Value     string    `json:"value"`
-	Host      *endpoint `json:"endpoint,omitempty"`
+	Host      *Endpoint `json:"endpoint,omitempty"`
 }
 
-type endpoint struct {
+// Endpoint is the network context of a node in the service graph.
+type Endpoint struct {
 	Ipv4        string `json:"ipv4"`
 	Port        int    `json:"port"`
 	ServiceName string `json:"serviceName"`
@@ -57,6 +78,32 @@ func ConvertTimestamp(tsMicros int64) time.Time {
 	return time.Unix(tsMicros/1000000, (tsMicros%1000000)*1000).UTC()
 }
 
+// TimestampMicros turns a time.Time value into a Zipkin timestamp (a Unix
+// timestamp in microseconds), or 0 if it's the zero time.
+func TimestampMicros(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / 1000
+}
+
+// AnnotationString turns a BinaryAnnotation value back into a string, for
+// encoding spans in Zipkin formats whose tag values are always strings. It's
+// the inverse of GuessAnnotationType.
+func AnnotationString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
 // GuessAnnotationType takes a value and, if it is a string, turns it into a bool,
 // int64 or float64 value when possible. This is a workaround for the fact that
 // Zipkin v1 BinaryAnnotation values are always transmitted as strings.
@@ -12,19 +12,40 @@ import (
 // DecodeJSON reads an array of JSON-encoded spans from an io.Reader, and
 // converts that array to a slice of Spans.
 func DecodeJSON(r io.Reader) ([]*types.Span, error) {
-	var jsonSpans []ZipkinJSONSpan
-	err := json.NewDecoder(r).Decode(&jsonSpans)
+	spans := []*types.Span{}
+	err := DecodeJSONFunc(r, func(s *types.Span) error {
+		spans = append(spans, s)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	spans := make([]*types.Span, len(jsonSpans))
-	for i, s := range jsonSpans {
-		spans[i] = convertJSONSpan(s)
-	}
-
 	return spans, nil
 }
 
+// DecodeJSONFunc reads an array of JSON-encoded spans from an io.Reader one at
+// a time, and calls fn with each span as soon as it's converted. It stops if
+// fn returns an error, and returns that error.
+func DecodeJSONFunc(r io.Reader, fn func(*types.Span) error) error {
+	return types.DecodeJSONArray(r, func(dec *json.Decoder) error {
+		var zs ZipkinJSONSpan
+		if err := dec.Decode(&zs); err != nil {
+			return err
+		}
+		return fn(convertJSONSpan(zs))
+	})
+}
+
+// EncodeJSON writes spans to w as a JSON array of Zipkin V1 spans. Tags are
+// written as string binary annotations, attributed to the span's own endpoint.
+func EncodeJSON(w io.Writer, spans []*types.Span) error {
+	jsonSpans := make([]ZipkinJSONSpan, len(spans))
+	for i, s := range spans {
+		jsonSpans[i] = convertSpan(s)
+	}
+	return json.NewEncoder(w).Encode(jsonSpans)
+}
+
 // ZipkinJSONSpan represents the Zipkin V1 Span object. See
 // https://github.com/openzipkin/zipkin-api/blob/master/zipkin-api.yaml
 type ZipkinJSONSpan struct {
@@ -76,21 +97,80 @@ func convertJSONSpan(zs ZipkinJSONSpan) *types.Span {
 		s.BinaryAnnotations[ba.Key] = types.GuessAnnotationType(ba.Value)
 	}
 	for _, a := range zs.Annotations {
-		// TODO: do more with annotations (i.e., point-in-time logs within a span)
-		// besides extracting host info.
+		if a == nil {
+			continue
+		}
 		if a.Host != nil {
 			endpoint = a.Host
 		}
+		s.Annotations = append(s.Annotations, &types.Annotation{
+			Timestamp: a.Timestamp,
+			Value:     a.Value,
+			Host:      convertEndpoint(a.Host),
+		})
 	}
 	if endpoint != nil {
 		s.HostIPv4 = endpoint.Ipv4
 		s.ServiceName = endpoint.ServiceName
 		s.Port = endpoint.Port
 	}
-	// TODO: do something with annotations
 	return s
 }
 
+// convertSpan is the inverse of convertJSONSpan.
+func convertSpan(s *types.Span) ZipkinJSONSpan {
+	zs := ZipkinJSONSpan{
+		TraceID:           s.TraceID,
+		Name:              s.Name,
+		ID:                s.ID,
+		ParentID:          s.ParentID,
+		Annotations:       make([]*Annotation, 0, len(s.Annotations)),
+		BinaryAnnotations: make([]*binaryAnnotation, 0, len(s.BinaryAnnotations)),
+		Debug:             s.Debug,
+		Timestamp:         types.TimestampMicros(s.Timestamp),
+		Duration:          int64(s.DurationMs*float64(time.Microsecond) + 0.5),
+	}
+	var endpoint *Endpoint
+	if s.ServiceName != "" || s.HostIPv4 != "" {
+		endpoint = &Endpoint{Ipv4: s.HostIPv4, Port: s.Port, ServiceName: s.ServiceName}
+	}
+	for _, a := range s.Annotations {
+		host := endpoint
+		if a.Host != nil {
+			host = &Endpoint{Ipv4: a.Host.Ipv4, Port: a.Host.Port, ServiceName: a.Host.ServiceName}
+		}
+		zs.Annotations = append(zs.Annotations, &Annotation{
+			Timestamp: a.Timestamp,
+			Value:     a.Value,
+			Host:      host,
+		})
+	}
+	for _, k := range s.BinaryAnnotationKeys() {
+		v := s.BinaryAnnotations[k]
+		if k == "kind" && v == "" {
+			// Added by the V2 decoder for spans without a kind.
+			continue
+		}
+		zs.BinaryAnnotations = append(zs.BinaryAnnotations, &binaryAnnotation{
+			Key:      k,
+			Value:    types.AnnotationString(v),
+			Endpoint: endpoint,
+		})
+	}
+	return zs
+}
+
+func convertEndpoint(e *Endpoint) *types.Endpoint {
+	if e == nil {
+		return nil
+	}
+	return &types.Endpoint{
+		Ipv4:        e.Ipv4,
+		Port:        e.Port,
+		ServiceName: e.ServiceName,
+	}
+}
+
 type Annotation struct {
 	Timestamp int64     `json:"timestamp"`
 	Value     string    `json:"value"`
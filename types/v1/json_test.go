@@ -0,0 +1,39 @@
+package v1
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types/internal/jsonbench"
+)
+
+func BenchmarkDecode(b *testing.B) {
+	payload := jsonbench.Payload(`{"traceId": "%016x", "id": "%016x", "parentId": "%016x", "name": "get /api/v1/users",
+		"timestamp": 1502787600000000, "duration": 1500,
+		"annotations": [
+			{"timestamp": 1502787600000000, "value": "sr", "endpoint": {"serviceName": "frontend", "ipv4": "10.0.0.1", "port": 8080}},
+			{"timestamp": 1502787600001500, "value": "ss", "endpoint": {"serviceName": "frontend", "ipv4": "10.0.0.1", "port": 8080}}
+		],
+		"binaryAnnotations": [
+			{"key": "http.method", "value": "GET"},
+			{"key": "http.status_code", "value": "200"},
+			{"key": "http.url", "value": "/api/v1/users/%d"}
+		]}`)
+	jsonbench.Run(b, payload, jsonbench.Decoders{
+		DecodeJSON:     DecodeJSON,
+		DecodeJSONFunc: DecodeJSONFunc,
+		Baseline: func(r io.Reader) ([]*types.Span, error) {
+			var jsonSpans []ZipkinJSONSpan
+			if err := json.NewDecoder(r).Decode(&jsonSpans); err != nil {
+				return nil, err
+			}
+			spans := make([]*types.Span, len(jsonSpans))
+			for i, s := range jsonSpans {
+				spans[i] = convertJSONSpan(s)
+			}
+			return spans, nil
+		},
+	})
+}
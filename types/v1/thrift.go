@@ -3,6 +3,7 @@ package v1
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -59,11 +60,14 @@ func convertThriftSpan(ts *zipkincore.Span) *types.Span {
 	}
 
 	for _, a := range ts.Annotations {
-		// TODO: do more with annotations (i.e., point-in-time logs within a span)
-		// besides extracting host info.
 		if a.Host != nil {
 			endpoint = a.Host
 		}
+		s.Annotations = append(s.Annotations, &types.Annotation{
+			Timestamp: a.Timestamp,
+			Value:     a.Value,
+			Host:      convertThriftEndpoint(a.Host),
+		})
 	}
 	if endpoint != nil {
 		s.HostIPv4 = convertIPv4(endpoint.Ipv4)
@@ -73,6 +77,17 @@ func convertThriftSpan(ts *zipkincore.Span) *types.Span {
 	return s
 }
 
+func convertThriftEndpoint(e *zipkincore.Endpoint) *types.Endpoint {
+	if e == nil {
+		return nil
+	}
+	return &types.Endpoint{
+		Ipv4:        convertIPv4(e.Ipv4),
+		Port:        int(e.Port),
+		ServiceName: e.ServiceName,
+	}
+}
+
 func convertID(id int64) string {
 	return fmt.Sprintf("%016x", uint64(id))
 }
@@ -110,14 +125,14 @@ func DecodeThrift(r io.Reader) ([]*types.Span, error) {
 	buffer := thrift.NewTMemoryBuffer()
 	buffer.Write(body)
 
-	transport := thrift.NewTBinaryProtocolTransport(buffer)
+	transport := boundedProtocol{thrift.NewTBinaryProtocolTransport(buffer), buffer}
 	_, size, err := transport.ReadListBegin() // Ignore the returned element type
 	if err != nil {
 		return nil, err
 	}
 
 	// We don't depend on the size returned by ReadListBegin to preallocate the array because it
-	// sometimes returns a nil error on bad input and provides an unreasonably large int for size
+	// can still be much larger than the number of spans that are actually there
 	var spans []*types.Span
 	for i := 0; i < size; i++ {
 		zs := &zipkincore.Span{}
@@ -129,3 +144,45 @@ func DecodeThrift(r io.Reader) ([]*types.Span, error) {
 
 	return spans, nil
 }
+
+var errInvalidSize = errors.New("collection size larger than remaining data")
+
+// boundedProtocol rejects lists, sets and maps that claim to have more
+// elements than there are bytes left to read. The generated code preallocates
+// them with the size from the wire, so otherwise a few bytes of bad input
+// could allocate gigabytes.
+type boundedProtocol struct {
+	thrift.TProtocol
+	buffer *thrift.TMemoryBuffer
+}
+
+func (p boundedProtocol) checkSize(size int) error {
+	if uint64(size) > p.buffer.RemainingBytes() {
+		return errInvalidSize
+	}
+	return nil
+}
+
+func (p boundedProtocol) ReadListBegin() (thrift.TType, int, error) {
+	elemType, size, err := p.TProtocol.ReadListBegin()
+	if err == nil {
+		err = p.checkSize(size)
+	}
+	return elemType, size, err
+}
+
+func (p boundedProtocol) ReadSetBegin() (thrift.TType, int, error) {
+	elemType, size, err := p.TProtocol.ReadSetBegin()
+	if err == nil {
+		err = p.checkSize(size)
+	}
+	return elemType, size, err
+}
+
+func (p boundedProtocol) ReadMapBegin() (thrift.TType, thrift.TType, int, error) {
+	keyType, valueType, size, err := p.TProtocol.ReadMapBegin()
+	if err == nil {
+		err = p.checkSize(size)
+	}
+	return keyType, valueType, size, err
+}
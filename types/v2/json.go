@@ -19,7 +19,7 @@ type ZipkinJSONSpan struct {
 	Kind           string                 `json:"kind,omitempty"`
 	LocalEndpoint  localEndpoint          `json:"localEndpoint,omitempty"`
 	RemoteEndpoint remoteEndpoint         `json:"remoteEndpoint,omitempty"`
-	Annotations    []*annotation          `json:"annotation"`
+	Annotations    []*annotation          `json:"annotations"`
 	Tags           map[string]interface{} `json:"tags"`
 	Debug          bool                   `json:"debug,omitempty"`
 	Timestamp      int64                  `json:"timestamp,omitempty"`
@@ -46,17 +46,121 @@ type remoteEndpoint struct {
 // DecodeJSON reads an array of JSON-encoded spans from an io.Reader, and
 // converts that array to a slice of Spans.
 func DecodeJSON(r io.Reader) ([]*types.Span, error) {
-	var jsonSpans []ZipkinJSONSpan
-	err := json.NewDecoder(r).Decode(&jsonSpans)
+	spans := []*types.Span{}
+	err := DecodeJSONFunc(r, func(s *types.Span) error {
+		spans = append(spans, s)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	spans := make([]*types.Span, len(jsonSpans))
-	for i, s := range jsonSpans {
-		spans[i] = convertJSONSpan(s)
+	return spans, nil
+}
+
+// DecodeJSONFunc reads an array of JSON-encoded spans from an io.Reader one at
+// a time, and calls fn with each span as soon as it's converted. It stops if
+// fn returns an error, and returns that error.
+func DecodeJSONFunc(r io.Reader, fn func(*types.Span) error) error {
+	return types.DecodeJSONArray(r, func(dec *json.Decoder) error {
+		var zs ZipkinJSONSpan
+		if err := dec.Decode(&zs); err != nil {
+			return err
+		}
+		return fn(convertJSONSpan(zs))
+	})
+}
+
+// EncodeJSON writes spans to w as a JSON array of Zipkin V2 spans.
+func EncodeJSON(w io.Writer, spans []*types.Span) error {
+	outSpans := make([]*outputSpan, len(spans))
+	for i, s := range spans {
+		outSpans[i] = convertSpan(s)
 	}
+	return json.NewEncoder(w).Encode(outSpans)
+}
 
-	return spans, nil
+// outputSpan is a Zipkin V2 span to be encoded. Unlike ZipkinJSONSpan, empty
+// fields are left out entirely, as some collectors reject empty endpoints.
+type outputSpan struct {
+	TraceID       string             `json:"traceId"`
+	Name          string             `json:"name,omitempty"`
+	ID            string             `json:"id"`
+	ParentID      string             `json:"parentId,omitempty"`
+	Kind          string             `json:"kind,omitempty"`
+	LocalEndpoint *outputEndpoint    `json:"localEndpoint,omitempty"`
+	Annotations   []outputAnnotation `json:"annotations,omitempty"`
+	Tags          map[string]string  `json:"tags,omitempty"`
+	Debug         bool               `json:"debug,omitempty"`
+	Timestamp     int64              `json:"timestamp,omitempty"`
+	Duration      int64              `json:"duration,omitempty"`
+}
+
+type outputEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	Ipv4        string `json:"ipv4,omitempty"`
+	Port        int    `json:"port,omitempty"`
+}
+
+type outputAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// coreAnnotationKinds maps the Zipkin V1 annotations that mark the start and
+// end of an RPC to the kind of span they imply. In V2, they're replaced by the
+// span's kind, timestamp and duration.
+var coreAnnotationKinds = map[string]string{
+	"cs": "CLIENT",
+	"cr": "CLIENT",
+	"sr": "SERVER",
+	"ss": "SERVER",
+	"ms": "PRODUCER",
+	"mr": "CONSUMER",
+}
+
+// convertSpan is the inverse of convertJSONSpan. Spans decoded from V1
+// payloads get their kind from their core annotations.
+func convertSpan(s *types.Span) *outputSpan {
+	out := &outputSpan{
+		TraceID:   s.TraceID,
+		Name:      s.Name,
+		ID:        s.ID,
+		ParentID:  s.ParentID,
+		Debug:     s.Debug,
+		Timestamp: types.TimestampMicros(s.Timestamp),
+		Duration:  int64(s.DurationMs*float64(time.Microsecond) + 0.5),
+	}
+	if s.ServiceName != "" || s.HostIPv4 != "" || s.Port != 0 {
+		out.LocalEndpoint = &outputEndpoint{
+			ServiceName: s.ServiceName,
+			Ipv4:        s.HostIPv4,
+			Port:        s.Port,
+		}
+	}
+	for _, a := range s.Annotations {
+		if kind, ok := coreAnnotationKinds[a.Value]; ok {
+			out.Kind = kind
+			continue
+		}
+		out.Annotations = append(out.Annotations, outputAnnotation{
+			Timestamp: a.Timestamp,
+			Value:     a.Value,
+		})
+	}
+	for _, k := range s.BinaryAnnotationKeys() {
+		v := types.AnnotationString(s.BinaryAnnotations[k])
+		if k == "kind" {
+			if v != "" {
+				out.Kind = v
+			}
+			continue
+		}
+		if out.Tags == nil {
+			out.Tags = make(map[string]string, len(s.BinaryAnnotations))
+		}
+		out.Tags[k] = v
+	}
+	return out
 }
 
 func convertJSONSpan(zs ZipkinJSONSpan) *types.Span {
@@ -91,6 +195,15 @@ func convertJSONSpan(zs ZipkinJSONSpan) *types.Span {
 		s.Port = zs.LocalEndpoint.Port
 	}
 
-	// TODO: do something with annotations
+	for _, a := range zs.Annotations {
+		if a == nil {
+			continue
+		}
+		s.Annotations = append(s.Annotations, &types.Annotation{
+			Timestamp: a.Timestamp,
+			Value:     a.Value,
+		})
+	}
+
 	return s
 }
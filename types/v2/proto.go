@@ -0,0 +1,196 @@
+package v2
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// Field numbers and values from the Zipkin V2 protocol buffer definition. See
+// https://github.com/openzipkin/zipkin-api/blob/master/zipkin.proto
+const (
+	listOfSpansSpans = 1
+
+	spanTraceID       = 1
+	spanParentID      = 2
+	spanID            = 3
+	spanKind          = 4
+	spanName          = 5
+	spanTimestamp     = 6
+	spanDuration      = 7
+	spanLocalEndpoint = 8
+	spanAnnotations   = 10
+	spanTags          = 11
+	spanDebug         = 12
+
+	endpointServiceName = 1
+	endpointIpv4        = 2
+	endpointPort        = 4
+
+	annotationTimestamp = 1
+	annotationValue     = 2
+
+	mapEntryKey   = 1
+	mapEntryValue = 2
+
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+var protoKinds = map[string]uint64{
+	"CLIENT":   1,
+	"SERVER":   2,
+	"PRODUCER": 3,
+	"CONSUMER": 4,
+}
+
+// EncodeProto encodes spans as a Zipkin V2 ListOfSpans protocol buffer
+// message. It fails if a span's IDs aren't hex strings.
+func EncodeProto(spans []*types.Span) ([]byte, error) {
+	var list protoBuffer
+	for _, s := range spans {
+		span, err := encodeProtoSpan(convertSpan(s))
+		if err != nil {
+			return nil, err
+		}
+		list.message(listOfSpansSpans, span)
+	}
+	return list.b, nil
+}
+
+func encodeProtoSpan(s *outputSpan) (*protoBuffer, error) {
+	var p protoBuffer
+	traceIDLen := 8
+	if len(s.TraceID) > 16 {
+		traceIDLen = 16
+	}
+	for _, id := range []struct {
+		field  int
+		value  string
+		length int
+	}{
+		{spanTraceID, s.TraceID, traceIDLen},
+		{spanParentID, s.ParentID, 8},
+		{spanID, s.ID, 8},
+	} {
+		if id.value == "" {
+			continue
+		}
+		b, err := decodeID(id.value, id.length)
+		if err != nil {
+			return nil, err
+		}
+		p.bytes(id.field, b)
+	}
+	p.varint(spanKind, protoKinds[s.Kind])
+	p.string(spanName, s.Name)
+	if s.Timestamp != 0 {
+		p.fixed64(spanTimestamp, uint64(s.Timestamp))
+	}
+	p.varint(spanDuration, uint64(s.Duration))
+	if e := s.LocalEndpoint; e != nil {
+		var endpoint protoBuffer
+		endpoint.string(endpointServiceName, e.ServiceName)
+		if ip := net.ParseIP(e.Ipv4).To4(); ip != nil {
+			endpoint.bytes(endpointIpv4, ip)
+		}
+		endpoint.varint(endpointPort, uint64(e.Port))
+		p.message(spanLocalEndpoint, &endpoint)
+	}
+	for _, a := range s.Annotations {
+		var annotation protoBuffer
+		annotation.fixed64(annotationTimestamp, uint64(a.Timestamp))
+		annotation.string(annotationValue, a.Value)
+		p.message(spanAnnotations, &annotation)
+	}
+	for _, k := range sortedTagKeys(s.Tags) {
+		var entry protoBuffer
+		entry.string(mapEntryKey, k)
+		entry.string(mapEntryValue, s.Tags[k])
+		p.message(spanTags, &entry)
+	}
+	if s.Debug {
+		p.varint(spanDebug, 1)
+	}
+	return &p, nil
+}
+
+func sortedTagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// decodeID turns a hex ID into length bytes, padding it with leading zeros if
+// it's shorter.
+func decodeID(id string, length int) ([]byte, error) {
+	if len(id) > 2*length {
+		return nil, fmt.Errorf("span ID %s too long", id)
+	}
+	b, err := hex.DecodeString(strings.Repeat("0", 2*length-len(id)) + id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid span ID %s: %v", id, err)
+	}
+	return b, nil
+}
+
+// protoBuffer builds an encoded protocol buffer message. Fields with zero
+// values are left out, as in proto3.
+type protoBuffer struct {
+	b []byte
+}
+
+func (p *protoBuffer) key(field, wireType int) {
+	p.b = appendVarint(p.b, uint64(field<<3|wireType))
+}
+
+func (p *protoBuffer) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	p.key(field, wireVarint)
+	p.b = appendVarint(p.b, v)
+}
+
+func (p *protoBuffer) fixed64(field int, v uint64) {
+	p.key(field, wireFixed64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	p.b = append(p.b, b[:]...)
+}
+
+func (p *protoBuffer) bytes(field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	p.key(field, wireBytes)
+	p.b = appendVarint(p.b, uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *protoBuffer) string(field int, s string) {
+	p.bytes(field, []byte(s))
+}
+
+// message adds an embedded message. Unlike other fields, it's added even if
+// it's empty, since it may be an element of a repeated field.
+func (p *protoBuffer) message(field int, m *protoBuffer) {
+	p.key(field, wireBytes)
+	p.b = appendVarint(p.b, uint64(len(m.b)))
+	p.b = append(p.b, m.b...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}